@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const MAX_ACTUATOR_CHANGES = 1000 // upper limit to the number of changes in one reply
+
+// Sources of actuator changes, as recorded in the audit log.
+const (
+	SourceDevice = "device"
+)
+
+// ActuatorChange is one entry in the audit log of actuator changes.
+type ActuatorChange struct {
+	Name     string      `json:"name"`
+	Time     int64       `json:"time"`
+	Value    interface{} `json:"value"`
+	Previous interface{} `json:"previous"`
+	Source   string      `json:"source"`
+}
+
+// controlSource returns the audit log source for a change made by a control.
+func controlSource(control *ControlConnection) string {
+	return fmt.Sprintf("user %s (control %d)", control.user.name, control.id)
+}
+
+// restSource returns the audit log source for a change made over the REST
+// API.
+func restSource(user *User) string {
+	return fmt.Sprintf("user %s (REST)", user.name)
+}
+
+// ActuatorHistory returns the changes of one actuator (or all actuators if the
+// name is empty) between start and end (UNIX time in seconds), leaving out the
+// actuators the permissions don't allow to see the history of. Missing
+// arguments are replaced with sane defaults.
+func (d *Device) ActuatorHistory(name string, start, end int64, permissions *Permissions) []*ActuatorChange {
+	if end <= 0 {
+		end = time.Now().Unix() + 1
+	}
+	if start <= 0 || start >= end {
+		start = end - GRAPH_TIME
+	}
+	changes, err := store.GetActuatorChanges(d.dbId, name, time.Duration(start)*time.Second, time.Duration(end)*time.Second, MAX_ACTUATOR_CHANGES)
+	if err != nil {
+		log.Print("could not fetch actuator history: ", err)
+		return nil
+	}
+	allowed := make([]*ActuatorChange, 0, len(changes))
+	for _, change := range changes {
+		if permissions.CanReadActuatorHistory(change.Name) {
+			allowed = append(allowed, change)
+		}
+	}
+	return allowed
+}
+
+// reverseActuatorChanges reverses the order of the changes in place. Stores use
+// it to put the newest changes, which they find from newest to oldest, in
+// chronological order.
+func reverseActuatorChanges(changes []*ActuatorChange) {
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+}
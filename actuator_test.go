@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActuatorHistoryPermissions(t *testing.T) {
+	d, _ := newTestDevice(t)
+	now := time.Now().Unix()
+	for i, name := range []string{"led", "heater", "led"} {
+		err := store.AddActuatorChange(d.dbId, &ActuatorChange{
+			Name:   name,
+			Time:   now - 10 + int64(i),
+			Value:  true,
+			Source: "user alice (REST)",
+		})
+		if err != nil {
+			t.Fatal("could not add actuator change:", err)
+		}
+	}
+
+	tests := []struct {
+		permissions *Permissions
+		expected    int
+	}{
+		{&Permissions{Role: RoleAdmin}, 3},
+		{&Permissions{Role: RoleOperator}, 3},
+		{&Permissions{Role: RoleViewer, Actuators: map[string]bool{"led": true}}, 2},
+		{&Permissions{Role: RoleViewer}, 0},
+	}
+	for _, tc := range tests {
+		changes := d.ActuatorHistory("", 0, 0, tc.permissions)
+		if changes == nil {
+			t.Fatal("could not fetch actuator history")
+		}
+		if len(changes) != tc.expected {
+			t.Errorf("%s with grants %v: got %d changes, expected %d", tc.permissions.Role, tc.permissions.Actuators, len(changes), tc.expected)
+		}
+		for _, change := range changes {
+			if !tc.permissions.CanReadActuatorHistory(change.Name) {
+				t.Errorf("%s with grants %v: got change of %s", tc.permissions.Role, tc.permissions.Actuators, change.Name)
+			}
+		}
+	}
+}
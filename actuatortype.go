@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+)
+
+// Kinds of actuator values.
+const (
+	ActuatorBoolean = "boolean"
+	ActuatorInteger = "integer"
+	ActuatorColor   = "color" // RGB color, as "#rrggbb"
+	ActuatorEnum    = "enum"
+	ActuatorString  = "string"
+)
+
+var colorPattern = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// ActuatorType describes which values an actuator accepts, so invalid values
+// are never sent to the device and UIs can show the right widget. Types are
+// declared by the device (retained message on t/<name>) or by an admin.
+type ActuatorType struct {
+	Type      string   `json:"type"`
+	Min       *int64   `json:"min,omitempty"`       // integer: lowest allowed value
+	Max       *int64   `json:"max,omitempty"`       // integer: highest allowed value
+	Values    []string `json:"values,omitempty"`    // enum: allowed values
+	MaxLength int      `json:"maxLength,omitempty"` // string: maximum length in bytes (0 means no limit)
+}
+
+// validate checks the type declaration itself.
+func (t *ActuatorType) validate() error {
+	switch t.Type {
+	case ActuatorBoolean, ActuatorColor:
+	case ActuatorInteger:
+		if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+			return errors.New("integer minimum is above the maximum")
+		}
+	case ActuatorEnum:
+		if len(t.Values) == 0 {
+			return errors.New("enum has no values")
+		}
+	case ActuatorString:
+		if t.MaxLength < 0 {
+			return errors.New("maximum length cannot be negative")
+		}
+	default:
+		return fmt.Errorf("unknown actuator type: %s", t.Type)
+	}
+	return nil
+}
+
+// check returns an error if the value is not valid for this type.
+func (t *ActuatorType) check(value interface{}) error {
+	switch t.Type {
+	case ActuatorBoolean:
+		if _, ok := value.(bool); !ok {
+			return errors.New("expected a boolean")
+		}
+	case ActuatorInteger:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return errors.New("expected an integer")
+		}
+		if (t.Min != nil && n < float64(*t.Min)) || (t.Max != nil && n > float64(*t.Max)) {
+			return errors.New("value out of range")
+		}
+	case ActuatorColor:
+		s, ok := value.(string)
+		if !ok || !colorPattern.MatchString(s) {
+			return errors.New("expected a color like #rrggbb")
+		}
+	case ActuatorEnum:
+		s, ok := value.(string)
+		if ok {
+			for _, allowed := range t.Values {
+				if s == allowed {
+					return nil
+				}
+			}
+		}
+		return errors.New("value is not one of the allowed values")
+	case ActuatorString:
+		s, ok := value.(string)
+		if !ok {
+			return errors.New("expected a string")
+		}
+		if t.MaxLength != 0 && len(s) > t.MaxLength {
+			return errors.New("string too long")
+		}
+	}
+	return nil
+}
+
+// CheckActuator returns an error if the value is not valid for the actuator.
+// Actuators without a declared type accept any value.
+func (d *Device) CheckActuator(name string, value interface{}) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.checkActuator(name, value)
+}
+
+// checkActuator is CheckActuator with the lock held.
+func (d *Device) checkActuator(name string, value interface{}) error {
+	if value == nil {
+		return errors.New("empty actuator value")
+	}
+	actuatorType := d.actuatorTypes[name]
+	if actuatorType == nil {
+		return nil
+	}
+	err := actuatorType.check(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for actuator %s: %s", name, err)
+	}
+	return nil
+}
+
+// CheckScene returns an error if one of the values of the scene is not valid.
+func (d *Device) CheckScene(scene *Scene) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.checkScene(scene)
+}
+
+// checkScene is CheckScene with the lock held.
+func (d *Device) checkScene(scene *Scene) error {
+	for name, value := range scene.Actuators {
+		err := d.checkActuator(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckRule returns an error if one of the values the rule sets is not valid.
+func (d *Device) CheckRule(rule *Rule) error {
+	err := d.CheckActuator(rule.Actuator, rule.Value)
+	if err != nil {
+		return err
+	}
+	if rule.ReleaseValue != nil {
+		return d.CheckActuator(rule.Actuator, rule.ReleaseValue)
+	}
+	return nil
+}
+
+// CheckThermostat returns an error if one of the values the thermostat sets is
+// not valid.
+func (d *Device) CheckThermostat(thermostat *Thermostat) error {
+	for _, value := range []interface{}{thermostat.OnValue, thermostat.OffValue, thermostat.FallbackValue} {
+		err := d.CheckActuator(thermostat.Actuator, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckSchedule returns an error if the value the schedule sets is not valid.
+func (d *Device) CheckSchedule(schedule *Schedule) error {
+	return d.CheckActuator(schedule.Actuator, schedule.Value)
+}
+
+// ActuatorTypes returns a copy of the declared actuator types.
+func (d *Device) ActuatorTypes() map[string]*ActuatorType {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	actuatorTypes := make(map[string]*ActuatorType, len(d.actuatorTypes))
+	for name, actuatorType := range d.actuatorTypes {
+		actuatorTypes[name] = actuatorType
+	}
+	return actuatorTypes
+}
+
+// SetActuatorType declares (or, if actuatorType is nil, removes) the type of
+// an actuator and sends it to all controls.
+func (d *Device) SetActuatorType(name string, actuatorType *ActuatorType) error {
+	if name == "" {
+		return errors.New("no actuator name")
+	}
+	if actuatorType != nil {
+		err := actuatorType.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := store.SetActuatorType(d.dbId, name, actuatorType)
+	if err != nil {
+		log.Printf("could not store type of actuator %s: %s", name, err)
+		return errors.New("could not store actuator type")
+	}
+	if actuatorType == nil {
+		delete(d.actuatorTypes, name)
+	} else {
+		d.actuatorTypes[name] = actuatorType
+	}
+
+	msg := ControlMessageActuatorType{
+		Message: "actuatorType",
+		Name:    name,
+		Type:    actuatorType,
+	}
+	for _, control := range d.controls {
+		control.sendChan <- msg
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestActuatorTypeValidate(t *testing.T) {
+	low, high := int64(0), int64(100)
+	tests := []struct {
+		actuatorType *ActuatorType
+		valid        bool
+	}{
+		{&ActuatorType{Type: ActuatorBoolean}, true},
+		{&ActuatorType{Type: ActuatorColor}, true},
+		{&ActuatorType{Type: ActuatorInteger}, true},
+		{&ActuatorType{Type: ActuatorInteger, Min: &low, Max: &high}, true},
+		{&ActuatorType{Type: ActuatorInteger, Min: &low, Max: &low}, true},
+		{&ActuatorType{Type: ActuatorInteger, Min: &high, Max: &low}, false},
+		{&ActuatorType{Type: ActuatorEnum, Values: []string{"on", "off"}}, true},
+		{&ActuatorType{Type: ActuatorEnum}, false},
+		{&ActuatorType{Type: ActuatorString}, true},
+		{&ActuatorType{Type: ActuatorString, MaxLength: 10}, true},
+		{&ActuatorType{Type: ActuatorString, MaxLength: -1}, false},
+		{&ActuatorType{Type: "float"}, false},
+		{&ActuatorType{}, false},
+	}
+	for _, tc := range tests {
+		err := tc.actuatorType.validate()
+		if (err == nil) != tc.valid {
+			t.Errorf("type %+v: got error %v, expected valid=%v", tc.actuatorType, err, tc.valid)
+		}
+	}
+}
+
+func TestActuatorTypeCheck(t *testing.T) {
+	low, high := int64(-10), int64(100)
+	boolean := &ActuatorType{Type: ActuatorBoolean}
+	integer := &ActuatorType{Type: ActuatorInteger}
+	percent := &ActuatorType{Type: ActuatorInteger, Min: &low, Max: &high}
+	color := &ActuatorType{Type: ActuatorColor}
+	enum := &ActuatorType{Type: ActuatorEnum, Values: []string{"low", "high"}}
+	str := &ActuatorType{Type: ActuatorString}
+	short := &ActuatorType{Type: ActuatorString, MaxLength: 3}
+	tests := []struct {
+		actuatorType *ActuatorType
+		value        interface{}
+		valid        bool
+	}{
+		{boolean, true, true},
+		{boolean, false, true},
+		{boolean, "true", false},
+		{boolean, 1.0, false},
+		{integer, 5.0, true},
+		{integer, -1e9, true},
+		{integer, 5.5, false},
+		{integer, "5", false},
+		{integer, 5, false}, // JSON numbers are always float64
+		{percent, -10.0, true},
+		{percent, 100.0, true},
+		{percent, -11.0, false},
+		{percent, 101.0, false},
+		{color, "#00ff00", true},
+		{color, "#00FF00", true},
+		{color, "00ff00", false},
+		{color, "#0f0", false},
+		{color, "#00ff00 ", false},
+		{color, "#00gg00", false},
+		{color, 0xff00, false},
+		{enum, "low", true},
+		{enum, "high", true},
+		{enum, "medium", false},
+		{enum, "Low", false},
+		{enum, true, false},
+		{str, "", true},
+		{str, "a long string", true},
+		{str, 1.0, false},
+		{short, "abc", true},
+		{short, "abcd", false},
+		{short, "é", true},   // two bytes
+		{short, "éé", false}, // four bytes
+	}
+	for _, tc := range tests {
+		err := tc.actuatorType.check(tc.value)
+		if (err == nil) != tc.valid {
+			t.Errorf("type %+v, value %#v: got error %v, expected valid=%v", tc.actuatorType, tc.value, err, tc.valid)
+		}
+	}
+}
+
+func TestDeviceCheckValues(t *testing.T) {
+	d, _ := newTestDevice(t)
+	d.actuatorTypes["heater"] = &ActuatorType{Type: ActuatorBoolean}
+	d.actuatorTypes["fan"] = &ActuatorType{Type: ActuatorEnum, Values: []string{"off", "low", "high"}}
+
+	tests := []struct {
+		name  string
+		check func() error
+		valid bool
+	}{
+		{"untyped actuator", func() error { return d.CheckActuator("led", "anything") }, true},
+		{"untyped actuator without value", func() error { return d.CheckActuator("led", nil) }, false},
+		{"scene", func() error {
+			return d.CheckScene(&Scene{Actuators: map[string]interface{}{"heater": true, "fan": "low"}})
+		}, true},
+		{"scene with an invalid value", func() error {
+			return d.CheckScene(&Scene{Actuators: map[string]interface{}{"heater": true, "fan": "max"}})
+		}, false},
+		{"rule", func() error {
+			return d.CheckRule(&Rule{Actuator: "fan", Value: "high", ReleaseValue: "off"})
+		}, true},
+		{"rule without release value", func() error {
+			return d.CheckRule(&Rule{Actuator: "fan", Value: "high"})
+		}, true},
+		{"rule with an invalid value", func() error {
+			return d.CheckRule(&Rule{Actuator: "fan", Value: "max", ReleaseValue: "off"})
+		}, false},
+		{"rule with an invalid release value", func() error {
+			return d.CheckRule(&Rule{Actuator: "fan", Value: "high", ReleaseValue: false})
+		}, false},
+		{"thermostat", func() error {
+			return d.CheckThermostat(&Thermostat{Actuator: "heater", OnValue: true, OffValue: false, FallbackValue: false})
+		}, true},
+		{"thermostat with an invalid on value", func() error {
+			return d.CheckThermostat(&Thermostat{Actuator: "heater", OnValue: "on", OffValue: false, FallbackValue: false})
+		}, false},
+		{"thermostat with an invalid off value", func() error {
+			return d.CheckThermostat(&Thermostat{Actuator: "heater", OnValue: true, OffValue: 0.0, FallbackValue: false})
+		}, false},
+		{"thermostat without fallback value", func() error {
+			return d.CheckThermostat(&Thermostat{Actuator: "heater", OnValue: true, OffValue: false})
+		}, false},
+		{"schedule", func() error {
+			return d.CheckSchedule(&Schedule{Actuator: "fan", Value: "off"})
+		}, true},
+		{"schedule with an invalid value", func() error {
+			return d.CheckSchedule(&Schedule{Actuator: "heater", Value: "off"})
+		}, false},
+	}
+	for _, tc := range tests {
+		err := tc.check()
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: got error %v, expected valid=%v", tc.name, err, tc.valid)
+		}
+	}
+}
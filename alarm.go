@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Kinds of alarms.
+const (
+	AlarmLow  = "low"  // the value dropped below the alarm minimum
+	AlarmHigh = "high" // the value rose above the alarm maximum
+)
+
+// States of an alarm. An alarm is open until it is cleared, and a sensor has at
+// most one open alarm.
+const (
+	AlarmActive       = "active"       // nobody has acknowledged the alarm yet
+	AlarmAcknowledged = "acknowledged" // a user has seen the alarm, but the value is still out of range
+	AlarmCleared      = "cleared"      // the value is back within the limits
+)
+
+// Alarm is raised when a sensor value crosses one of the alarm limits of the
+// sensor, for example when the freezer gets warmer than -15°C. It is sent to
+// controls once when it is raised, acknowledged and cleared, not for every new
+// value.
+type Alarm struct {
+	Id             int64   `json:"id"`
+	Sensor         string  `json:"sensor"`
+	Kind           string  `json:"kind"` // 'low' or 'high'
+	State          string  `json:"state"`
+	Threshold      float64 `json:"threshold"` // the limit that was crossed
+	Value          float64 `json:"value"`     // the value that raised the alarm
+	Unit           string  `json:"unit"`
+	Raised         int64   `json:"raised"`         // UNIX time
+	Acknowledged   int64   `json:"acknowledged"`   // UNIX time, 0 if not acknowledged
+	AcknowledgedBy string  `json:"acknowledgedBy"` // user name
+	Cleared        int64   `json:"cleared"`        // UNIX time, 0 if still open
+}
+
+// convert returns a copy of the alarm with the values converted to the given
+// unit system.
+func (a *Alarm) convert(units string) *Alarm {
+	converter := converterFor(a.Unit, units)
+	alarm := *a
+	alarm.Threshold = converter.convertFloat(a.Threshold)
+	alarm.Value = converter.convertFloat(a.Value)
+	alarm.Unit = converter.unit
+	return &alarm
+}
+
+// loadAlarms loads the open alarms of this device from the database. The lock
+// must be held.
+func (d *Device) loadAlarms() {
+	alarms, err := store.GetOpenAlarms(d.dbId)
+	if err != nil {
+		log.Printf("could not load alarms of device %d: %s", d.dbId, err)
+		alarms = nil
+	}
+	d.alarms = make(map[string]*Alarm, len(alarms))
+	for _, alarm := range alarms {
+		d.alarms[alarm.Sensor] = alarm
+	}
+}
+
+// checkAlarm raises an alarm when a new sensor value is outside the limits of
+// the sensor, and clears the open alarm when the value is back within the
+// limits by at least the alarm hysteresis. Nothing happens while the value
+// stays on the same side of a limit.
+func (d *Device) checkAlarm(sensor *Sensor, value interface{}) {
+	valueFl, ok := value.(float64)
+	if !ok {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.alarms == nil {
+		d.loadAlarms()
+	}
+
+	kind := ""
+	var threshold float64
+	if alarmMin, ok := toFloat(sensor.alarmMin); ok && valueFl < alarmMin {
+		kind = AlarmLow
+		threshold = alarmMin
+	} else if alarmMax, ok := toFloat(sensor.alarmMax); ok && valueFl > alarmMax {
+		kind = AlarmHigh
+		threshold = alarmMax
+	}
+
+	alarm := d.alarms[sensor.name]
+	if alarm != nil && kind == "" {
+		// The alarm only clears when the value came back far enough, so that
+		// a value hovering around the limit doesn't raise it over and over.
+		if alarmMin, ok := toFloat(sensor.alarmMin); ok && alarm.Kind == AlarmLow && valueFl < alarmMin+sensor.alarmHysteresis {
+			kind = AlarmLow
+		} else if alarmMax, ok := toFloat(sensor.alarmMax); ok && alarm.Kind == AlarmHigh && valueFl > alarmMax-sensor.alarmHysteresis {
+			kind = AlarmHigh
+		}
+	}
+	if alarm != nil && alarm.Kind == kind {
+		// Still the same alarm.
+		return
+	}
+	now := time.Now()
+
+	if alarm != nil {
+		if *flagVerbose {
+			log.Printf("Alarm %d of sensor %s cleared (%v)", alarm.Id, sensor.name, valueFl)
+		}
+		alarm.State = AlarmCleared
+		alarm.Cleared = now.Unix()
+		d.saveAlarm(alarm)
+		delete(d.alarms, sensor.name)
+		d.sendAlarm(alarm)
+		d.notify("alarm", "Sensor "+sensor.name+" is back to normal", fmt.Sprintf("%s is %v%s.", sensor.name, valueFl, sensor.unit))
+	}
+
+	if kind == "" {
+		return
+	}
+	alarm = &Alarm{
+		Sensor:    sensor.name,
+		Kind:      kind,
+		State:     AlarmActive,
+		Threshold: threshold,
+		Value:     valueFl,
+		Unit:      sensor.unit,
+		Raised:    now.Unix(),
+	}
+	log.Printf("Alarm for sensor %s of device %s: %v%s is %s the limit of %v%s", sensor.name, d.name, valueFl, sensor.unit, alarmDirection(kind), threshold, sensor.unit)
+	d.saveAlarm(alarm)
+	d.alarms[sensor.name] = alarm
+	d.sendAlarm(alarm)
+	d.notify("alarm", fmt.Sprintf("Sensor %s is too %s", sensor.name, kind), fmt.Sprintf("%s is %v%s, %s the limit of %v%s.", sensor.name, valueFl, sensor.unit, alarmDirection(kind), threshold, sensor.unit))
+}
+
+// alarmDirection describes how a value relates to the limit it crossed.
+func alarmDirection(kind string) string {
+	if kind == AlarmLow {
+		return "below"
+	}
+	return "above"
+}
+
+// saveAlarm stores the alarm, setting the ID of a new alarm. Failures are only
+// logged, the alarm is still sent to controls. The lock must be held.
+func (d *Device) saveAlarm(alarm *Alarm) {
+	id, err := store.SaveAlarm(d.dbId, alarm)
+	if err != nil {
+		log.Printf("could not save alarm of sensor '%s': %s", alarm.Sensor, err)
+		return
+	}
+	alarm.Id = id
+}
+
+// sendAlarm sends the alarm to all controls that may read the sensor. The lock
+// must be held.
+func (d *Device) sendAlarm(alarm *Alarm) {
+	for _, control := range d.controls {
+		if !control.permissions.CanReadSensor(alarm.Sensor) {
+			continue
+		}
+		control.sendChan <- ControlMessageAlarm{
+			Message: "alarm",
+			Alarm:   alarm.convert(control.units),
+		}
+	}
+}
+
+// OpenAlarms returns all alarms that have not been cleared, converted to the
+// given unit system and leaving out sensors the permissions don't allow to
+// read.
+func (d *Device) OpenAlarms(permissions *Permissions, units string) []*Alarm {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.alarms == nil {
+		d.loadAlarms()
+	}
+	alarms := make([]*Alarm, 0, len(d.alarms))
+	for _, alarm := range d.alarms {
+		if permissions.CanReadSensor(alarm.Sensor) {
+			alarms = append(alarms, alarm.convert(units))
+		}
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].Id < alarms[j].Id
+	})
+	return alarms
+}
+
+// errPermissionDenied is returned when the permissions don't allow a change.
+var errPermissionDenied = errors.New("permission denied")
+
+// AcknowledgeAlarm marks an open alarm as seen by the given user, sends the new
+// state to all controls and returns the alarm in the given unit system. It
+// returns errNotFound if there is no open alarm with this ID the permissions
+// allow to see, and errPermissionDenied if they don't allow to acknowledge it.
+func (d *Device) AcknowledgeAlarm(id int64, permissions *Permissions, userName, units string) (*Alarm, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.alarms == nil {
+		d.loadAlarms()
+	}
+	var alarm *Alarm
+	for _, openAlarm := range d.alarms {
+		if openAlarm.Id == id && permissions.CanReadSensor(openAlarm.Sensor) {
+			alarm = openAlarm
+		}
+	}
+	if alarm == nil {
+		return nil, errNotFound
+	}
+	if !permissions.CanAcknowledgeAlarm(alarm.Sensor) {
+		return nil, errPermissionDenied
+	}
+	if alarm.State == AlarmAcknowledged {
+		return alarm.convert(units), nil
+	}
+
+	acknowledged := *alarm
+	acknowledged.State = AlarmAcknowledged
+	acknowledged.Acknowledged = time.Now().Unix()
+	acknowledged.AcknowledgedBy = userName
+	_, err := store.SaveAlarm(d.dbId, &acknowledged)
+	if err != nil {
+		log.Printf("could not acknowledge alarm %d: %s", id, err)
+		return nil, errors.New("could not save alarm")
+	}
+	*alarm = acknowledged
+	d.sendAlarm(alarm)
+	return alarm.convert(units), nil
+}
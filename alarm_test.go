@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckAlarmHysteresis(t *testing.T) {
+	oldStore := store
+	store = newMemoryStore()
+	defer func() { store = oldStore }()
+
+	d := &Device{
+		DeviceSet: &DeviceSet{},
+		name:      "house",
+		controls:  make(map[int]*ControlConnection),
+	}
+	sensor := &Sensor{
+		name:            "freezer",
+		unit:            "°C",
+		alarmMin:        -30.0,
+		alarmMax:        -15.0,
+		alarmHysteresis: 2,
+	}
+	steps := []struct {
+		value float64
+		kind  string // kind of the open alarm after the value, "" for none
+	}{
+		{-20, ""},
+		{-14, AlarmHigh},
+		{-16, AlarmHigh}, // within the limits, but not by the hysteresis
+		{-14.5, AlarmHigh},
+		{-17, ""},
+		{-16, ""}, // no new alarm without crossing the limit
+		{-31, AlarmLow},
+		{-29, AlarmLow},
+		{-10, AlarmHigh}, // crossing the other limit replaces the alarm
+		{-28, ""},
+	}
+	for i, step := range steps {
+		d.checkAlarm(sensor, step.value)
+		kind := ""
+		if alarm := d.alarms[sensor.name]; alarm != nil {
+			kind = alarm.Kind
+		}
+		if kind != step.kind {
+			t.Errorf("step %d: value %v gave alarm %q, expected %q", i, step.value, kind, step.kind)
+		}
+	}
+}
+
+func TestAcknowledgeAlarm(t *testing.T) {
+	d, _ := newTestDevice(t)
+	d.alarms = make(map[string]*Alarm)
+	controlChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", "", controlChan)
+	sensor := &Sensor{name: "freezer", unit: "°C", alarmMax: -15.0}
+	d.checkAlarm(sensor, -10.0)
+	alarm := d.alarms["freezer"]
+	if alarm == nil {
+		t.Fatal("no alarm raised")
+	}
+	<-controlChan
+
+	tests := []struct {
+		name        string
+		permissions *Permissions
+		err         error
+	}{
+		{"viewer", &Permissions{Role: RoleViewer}, errPermissionDenied},
+		{"viewer of another sensor", &Permissions{Role: RoleViewer, Sensors: map[string]bool{"fridge": true}}, errNotFound},
+		{"operator of another sensor", &Permissions{Role: RoleOperator, Sensors: map[string]bool{"fridge": true}}, errNotFound},
+		{"viewer of the sensor", &Permissions{Role: RoleViewer, Sensors: map[string]bool{"freezer": true}}, nil},
+		{"operator", &Permissions{Role: RoleOperator}, nil},
+	}
+	for _, tc := range tests {
+		_, err := d.AcknowledgeAlarm(alarm.Id, tc.permissions, "bob", "")
+		if err != tc.err {
+			t.Errorf("%s: got error %v, expected %v", tc.name, err, tc.err)
+		}
+		if tc.err != nil && (d.alarms["freezer"].State != AlarmActive || len(controlChan) != 0) {
+			t.Errorf("%s: alarm was acknowledged", tc.name)
+		}
+	}
+	if d.alarms["freezer"].State != AlarmAcknowledged || d.alarms["freezer"].AcknowledgedBy != "bob" {
+		t.Errorf("got alarm %+v, expected it to be acknowledged by bob", d.alarms["freezer"])
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Administrative subcommands, run against the log database instead of
+// starting the server.
+
+const commandUsage = `Commands:
+  device list                        list all devices
+  device rename <device-id> <name>   change the name of a device
+  user add <name>                    add a user (reads the password from stdin)
+  user passwd <name>                 change a password (reads it from stdin)
+  user list                          list all users and their devices
+  user grant <name> <device-id> [<role>]
+                                     give a user access to a device as viewer,
+                                     operator (default) or admin
+  user revoke <name> <device-id>     take away access to a device
+  user allow <name> <device-id> actuator|sensor <name>
+                                     let a viewer set this actuator, or
+                                     restrict a non-admin to these sensors
+  user deny <name> <device-id> actuator|sensor <name>
+                                     remove an actuator or sensor grant
+  token add <user> [<label>]         create an API token and print it
+  token list <user>                  list the API tokens of a user
+  token revoke <token-id>            revoke an API token`
+
+// runCommand runs an administrative subcommand.
+func runCommand(args []string) error {
+	if len(args) < 2 {
+		return errors.New("expected a command\n" + commandUsage)
+	}
+	command := args[0] + " " + args[1]
+	args = args[2:]
+	switch command {
+	case "device list":
+		devices, err := store.GetDevices()
+		if err != nil {
+			return err
+		}
+		ids := make([]int64, 0, len(devices))
+		for id := range devices {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+		for _, id := range ids {
+			fmt.Printf("%d\t%s\n", id, devices[id])
+		}
+	case "device rename":
+		if len(args) != 2 || args[1] == "" {
+			return errors.New("expected a device ID and a name")
+		}
+		deviceId, err := commandDevice(args[0])
+		if err != nil {
+			return err
+		}
+		return store.SetDeviceName(deviceId, args[1])
+	case "user add", "user passwd":
+		if len(args) != 1 {
+			return errors.New("expected a user name")
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		if command == "user add" {
+			_, err = store.AddUser(args[0], hash)
+			return err
+		}
+		user, err := commandUser(args[0])
+		if err != nil {
+			return err
+		}
+		return store.SetUserPassword(user.dbId, hash)
+	case "user list":
+		users, err := store.GetUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			deviceIds, err := store.GetUserDevices(user.dbId)
+			if err != nil {
+				return err
+			}
+			fmt.Println(user.name)
+			for _, deviceId := range deviceIds {
+				permissions, err := store.GetPermissions(user.dbId, deviceId)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("\tdevice %d\t%s", deviceId, permissions.Role)
+				for name := range permissions.Actuators {
+					fmt.Printf("\tactuator:%s", name)
+				}
+				for name := range permissions.Sensors {
+					fmt.Printf("\tsensor:%s", name)
+				}
+				fmt.Println()
+			}
+		}
+	case "user grant", "user revoke":
+		if len(args) < 2 || len(args) > 3 || (command == "user revoke" && len(args) != 2) {
+			return errors.New("expected a user name, device ID and optional role")
+		}
+		user, deviceId, err := commandUserDevice(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if command == "user revoke" {
+			return store.RevokeDevice(user.dbId, deviceId)
+		}
+		role := RoleOperator
+		if len(args) == 3 {
+			var ok bool
+			role, ok = parseRole(args[2])
+			if !ok {
+				return fmt.Errorf("unknown role: %s", args[2])
+			}
+		}
+		return store.GrantDevice(user.dbId, deviceId, role)
+	case "user allow", "user deny":
+		if len(args) != 4 {
+			return errors.New("expected a user name, device ID, kind and name")
+		}
+		user, deviceId, err := commandUserDevice(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if args[2] != GrantActuator && args[2] != GrantSensor {
+			return fmt.Errorf("unknown grant kind: %s", args[2])
+		}
+		if _, err := store.GetPermissions(user.dbId, deviceId); err == errNotFound {
+			return errors.New("user has no access to this device")
+		}
+		if command == "user allow" {
+			return store.AddGrant(user.dbId, deviceId, args[2], args[3])
+		}
+		return store.RemoveGrant(user.dbId, deviceId, args[2], args[3])
+	case "token add":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.New("expected a user name and optional label")
+		}
+		user, err := commandUser(args[0])
+		if err != nil {
+			return err
+		}
+		label := ""
+		if len(args) == 2 {
+			label = args[1]
+		}
+		token := newToken()
+		_, err = store.AddToken(user.dbId, label, hashToken(token), time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+	case "token list":
+		if len(args) != 1 {
+			return errors.New("expected a user name")
+		}
+		user, err := commandUser(args[0])
+		if err != nil {
+			return err
+		}
+		tokens, err := store.GetTokens(user.dbId)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			status := "valid"
+			if !token.revoked.IsZero() {
+				status = "revoked " + token.revoked.Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", token.dbId, token.name, token.created.Format(time.RFC3339), status)
+		}
+	case "token revoke":
+		if len(args) != 1 {
+			return errors.New("expected a token ID")
+		}
+		tokenId, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid token ID: %s", args[0])
+		}
+		err = store.RevokeToken(tokenId, time.Now())
+		if err == errNotFound {
+			return errors.New("no such (valid) token")
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command: %s\n%s", command, commandUsage)
+	}
+	return nil
+}
+
+func commandUser(name string) (*User, error) {
+	user, err := store.GetUser(name)
+	if err == errNotFound {
+		return nil, fmt.Errorf("unknown user: %s", name)
+	}
+	return user, err
+}
+
+func commandUserDevice(userName, deviceId string) (*User, int64, error) {
+	user, err := commandUser(userName)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := commandDevice(deviceId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return user, id, nil
+}
+
+// commandDevice parses the ID of a device that exists.
+func commandDevice(deviceId string) (int64, error) {
+	id, err := strconv.ParseInt(deviceId, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device ID: %s", deviceId)
+	}
+	// Not every store enforces foreign keys, so check that the device exists
+	// before creating grants for it or renaming it.
+	devices, err := store.GetDevices()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := devices[id]; !ok {
+		return 0, fmt.Errorf("unknown device: %d", id)
+	}
+	return id, nil
+}
+
+// readPassword reads a password from the first line of stdin.
+func readPassword() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("could not read password from stdin")
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
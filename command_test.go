@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// commandOutput runs the command and returns what it printed.
+func commandOutput(t *testing.T, args ...string) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("could not create pipe:", err)
+	}
+	defer r.Close()
+	oldStdout := os.Stdout
+	os.Stdout = w
+	err = runCommand(args)
+	os.Stdout = oldStdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	output, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("could not read output:", err)
+	}
+	return string(output)
+}
+
+func TestCommandDeviceList(t *testing.T) {
+	oldStore := store
+	defer func() { store = oldStore }()
+
+	testStores(t, func(t *testing.T, s Store) {
+		store = s
+		var expected strings.Builder
+		for i := 0; i < 20; i++ {
+			serial := "device" + strconv.Itoa(i)
+			id := addTestDevice(t, s, serial)
+			expected.WriteString(strconv.FormatInt(id, 10) + "\t" + serial + " name\n")
+		}
+		if output := commandOutput(t, "device", "list"); output != expected.String() {
+			t.Errorf("got output:\n%s\nexpected:\n%s", output, expected.String())
+		}
+
+		id, _, err := s.GetDevice("device3")
+		if err != nil {
+			t.Fatal("could not get device:", err)
+		}
+		if err := runCommand([]string{"device", "rename", strconv.FormatInt(id, 10), "Living room"}); err != nil {
+			t.Fatal("could not rename device:", err)
+		}
+		if _, name, err := s.GetDevice("device3"); err != nil || name != "Living room" {
+			t.Errorf("got name %q (%v), expected \"Living room\"", name, err)
+		}
+		for _, args := range [][]string{
+			{"device", "rename", strconv.FormatInt(id+100, 10), "Attic"},
+			{"device", "rename", "x", "Attic"},
+			{"device", "rename", strconv.FormatInt(id, 10), ""},
+			{"device", "rename", strconv.FormatInt(id, 10)},
+		} {
+			if err := runCommand(args); err == nil {
+				t.Errorf("%v: expected an error", args)
+			}
+		}
+	})
+}
+
+func TestCommandUserGrant(t *testing.T) {
+	oldStore := store
+	defer func() { store = oldStore }()
+
+	testStores(t, func(t *testing.T, s Store) {
+		store = s
+		id := addTestDevice(t, s, "device")
+		userId, err := s.AddUser("alice", "hash")
+		if err != nil {
+			t.Fatal("could not add user:", err)
+		}
+		deviceId := strconv.FormatInt(id, 10)
+		unknownId := strconv.FormatInt(id+100, 10)
+
+		if err := runCommand([]string{"user", "grant", "alice", deviceId, "viewer"}); err != nil {
+			t.Fatal("could not grant device:", err)
+		}
+		permissions, err := s.GetPermissions(userId, id)
+		if err != nil || permissions.Role != RoleViewer {
+			t.Errorf("got permissions %+v (%v), expected a viewer", permissions, err)
+		}
+
+		for _, args := range [][]string{
+			{"user", "grant", "alice", unknownId},
+			{"user", "revoke", "alice", unknownId},
+			{"user", "allow", "alice", unknownId, "actuator", "led"},
+		} {
+			if err := runCommand(args); err == nil || !strings.Contains(err.Error(), "unknown device") {
+				t.Errorf("%v: got error %v, expected unknown device", args, err)
+			}
+		}
+		for _, args := range [][]string{
+			{"user", "grant", "alice", "x"},
+			{"user", "grant", "bob", deviceId},
+			{"user", "grant", "alice", deviceId, "owner"},
+		} {
+			if err := runCommand(args); err == nil {
+				t.Errorf("%v: expected an error", args)
+			}
+		}
+		if _, err := s.GetPermissions(userId, id+100); err != errNotFound {
+			t.Errorf("unknown device: got error %v, expected no grant", err)
+		}
+	})
+}
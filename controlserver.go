@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -10,34 +11,123 @@ import (
 
 // Received message from control
 type ControlMessage struct {
-	Message      string                 `json:"message"`      // 'connect', 'actuator'
-	Name         string                 `json:"name"`         // actuator name
-	Password     string                 `json:"password"`     // client password (no username)
+	Message      string                 `json:"message"`      // 'connect', 'actuator', 'setActuatorType', 'history', 'actuatorHistory', 'rules', 'setRule', 'deleteRule', 'thermostats', 'setThermostat', 'deleteThermostat', 'schedules', 'setSchedule', 'deleteSchedule', 'scenes', 'setScene', 'deleteScene', 'applyScene', 'setSensor', 'acknowledgeAlarm'
+	Name         string                 `json:"name"`         // actuator name, sensor name, scene name
+	User         string                 `json:"user"`         // user name
+	Password     string                 `json:"password"`     // user password
+	Token        string                 `json:"token"`        // API token (instead of user and password)
+	Device       int64                  `json:"device"`       // device ID (optional if the user has only one device)
+	Units        string                 `json:"units"`        // unit system for sensor values: 'metric', 'imperial' or empty for no conversion
 	LastLogTimes map[string]LastLogTime `json:"lastLogTimes"` // last timestamp of a sensor log
 	Value        interface{}            `json:"value"`        // actuator
+	ActuatorType *ActuatorType          `json:"actuatorType"` // actuator type to declare (nil to remove)
+	Start        int64                  `json:"start"`        // (actuator) history start time
+	End          int64                  `json:"end"`          // (actuator) history end time
+	Bucket       int64                  `json:"bucket"`       // history bucket size in seconds
+	Id           int64                  `json:"id"`           // rule, thermostat, schedule, scene or alarm ID
+	Rule         *Rule                  `json:"rule"`         // rule to add or update
+	Thermostat   *Thermostat            `json:"thermostat"`   // thermostat to add or update
+	Schedule     *Schedule              `json:"schedule"`     // schedule to add or update
+	Scene        *Scene                 `json:"scene"`        // scene to add or update
+	Sensor       *SensorUpdate          `json:"sensor"`       // sensor metadata to change
 }
 type LastLogTime struct {
 	LastLogTime int64 `json:"lastTime"`
 }
 
 type ControlMessageConnected struct {
-	Message   string                 `json:"message"`
-	Logs      map[string]*LogReply   `json:"logs"`
-	Actuators map[string]interface{} `json:"actuators"`
+	Message       string                   `json:"message"`
+	Logs          map[string]*LogReply     `json:"logs"`
+	Actuators     map[string]interface{}   `json:"actuators"`
+	ActuatorTypes map[string]*ActuatorType `json:"actuatorTypes"`
+	Status        *DeviceStatus            `json:"status"`
+	Alarms        []*Alarm                 `json:"alarms"` // open alarms
 }
 
 type ControlMessageError struct {
 	Message string `json:"message"`
 	Error   string `json:"error"`
+	Request string `json:"request,omitempty"` // message type of the failed request
+	Name    string `json:"name,omitempty"`    // actuator or sensor name of the failed request
+}
+
+type ControlMessageHistory struct {
+	Message string `json:"message"`
+	*HistoryReply
+}
+
+type ControlMessageActuatorHistory struct {
+	Message string            `json:"message"`
+	Name    string            `json:"name"`
+	History []*ActuatorChange `json:"history"`
+}
+
+type ControlMessageActuatorType struct {
+	Message string        `json:"message"`
+	Name    string        `json:"name"`
+	Type    *ActuatorType `json:"type"` // nil if the type was removed
+}
+
+// ControlMessageStatus is sent when a device (or, if Sensor is set, a sensor)
+// comes online or goes offline, and when a sensor misses several reports
+// (stale) or reports again (fresh).
+type ControlMessageStatus struct {
+	Message  string `json:"message"` // 'online', 'offline', 'stale' or 'fresh'
+	Sensor   string `json:"sensor,omitempty"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// ControlMessageAlarm is sent when an alarm is raised, acknowledged or
+// cleared.
+type ControlMessageAlarm struct {
+	Message string `json:"message"`
+	Alarm   *Alarm `json:"alarm"`
+}
+
+type ControlMessageRules struct {
+	Message string  `json:"message"`
+	Rules   []*Rule `json:"rules"`
+}
+
+type ControlMessageThermostats struct {
+	Message     string        `json:"message"`
+	Thermostats []*Thermostat `json:"thermostats"`
+}
+
+type ControlMessageSchedules struct {
+	Message   string      `json:"message"`
+	Schedules []*Schedule `json:"schedules"`
+}
+
+type ControlMessageScenes struct {
+	Message string   `json:"message"`
+	Scenes  []*Scene `json:"scenes"`
+}
+
+// ControlMessageActuators is sent when several actuators change at once, for
+// example when a scene is applied.
+type ControlMessageActuators struct {
+	Message   string                 `json:"message"`
+	Scene     string                 `json:"scene,omitempty"`
+	Actuators map[string]interface{} `json:"actuators"`
 }
 
+type ControlMessageSensor struct {
+	Message string      `json:"message"`
+	Sensor  *SensorInfo `json:"sensor"`
+}
+
+// ControlMessageNewLog contains new values of one sensor (Sensor and Log), or
+// of several sensors that were measured together (Batch, with the sensor name
+// as key).
 type ControlMessageNewLog struct {
-	Message string         `json:"message"`
-	Sensor  string         `json:"sensor"`
-	Log     []*LogReplyRow `json:"log"`
+	Message string                    `json:"message"`
+	Sensor  string                    `json:"sensor,omitempty"`
+	Log     []*LogReplyRow            `json:"log,omitempty"`
+	Batch   map[string][]*LogReplyRow `json:"batch,omitempty"`
 }
 
-func ControlServer(w http.ResponseWriter, r *http.Request, device *Device) {
+func ControlServer(w http.ResponseWriter, r *http.Request, deviceSet *DeviceSet) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Could not upgrade control WebSocket: ", err)
@@ -49,7 +139,7 @@ func ControlServer(w http.ResponseWriter, r *http.Request, device *Device) {
 	send := make(chan interface{})
 	defer close(recv)
 
-	go runControlServer(recv, send, device)
+	go runControlServer(recv, send, deviceSet)
 
 	go func() {
 		for msg := range send {
@@ -63,6 +153,9 @@ func ControlServer(w http.ResponseWriter, r *http.Request, device *Device) {
 				continue
 			}
 		}
+		// The control server stopped, for example because the token was
+		// revoked. Stop reading as well.
+		conn.Close()
 	}()
 
 	for {
@@ -78,7 +171,7 @@ func ControlServer(w http.ResponseWriter, r *http.Request, device *Device) {
 	}
 }
 
-func runControlServer(recv chan ControlMessage, send chan interface{}, device *Device) {
+func runControlServer(recv chan ControlMessage, send chan interface{}, deviceSet *DeviceSet) {
 	msg := <-recv
 	defer close(send)
 
@@ -90,15 +183,34 @@ func runControlServer(recv chan ControlMessage, send chan interface{}, device *D
 		return
 	}
 
-	controlConnection := device.AddControl(msg.Password, send)
-	if controlConnection == nil {
-		// password invalid
+	user := authenticateUser(msg.User, msg.Password, msg.Token)
+	if user == nil {
+		send <- ControlMessageError{
+			Message: "disconnected",
+			Error:   "connection refused - invalid credentials?",
+		}
+		return
+	}
+	if err := checkUnits(msg.Units); err != nil {
 		send <- ControlMessageError{
 			Message: "disconnected",
-			Error:   "connection refused - invalid password?",
+			Error:   "connection refused - " + err.Error(),
 		}
 		return
 	}
+	device, permissions := deviceSet.userDevice(user, msg.Device)
+	if device == nil {
+		send <- ControlMessageError{
+			Message: "disconnected",
+			Error:   "connection refused - no access to device",
+		}
+		return
+	}
+	tokenHash := ""
+	if msg.Token != "" {
+		tokenHash = hashToken(msg.Token)
+	}
+	controlConnection := device.AddControl(user, permissions, tokenHash, msg.Units, send)
 	defer controlConnection.Close()
 
 	lastValueTimes := make(map[string]int64, len(msg.LastLogTimes))
@@ -106,19 +218,269 @@ func runControlServer(recv chan ControlMessage, send chan interface{}, device *D
 		lastValueTimes[n] = subscr.LastLogTime
 	}
 	send <- ControlMessageConnected{
-		Message:   "connected",
-		Logs:      controlConnection.Logs(lastValueTimes),
-		Actuators: controlConnection.actuators,
+		Message:       "connected",
+		Logs:          controlConnection.Logs(lastValueTimes),
+		Actuators:     controlConnection.Actuators(),
+		ActuatorTypes: controlConnection.ActuatorTypes(),
+		Status:        controlConnection.Status(permissions),
+		Alarms:        controlConnection.OpenAlarms(permissions, controlConnection.units),
 	}
 
-	for msg := range recv {
+	for {
+		var msg ControlMessage
+		select {
+		case received, ok := <-recv:
+			if !ok {
+				return
+			}
+			msg = received
+		case <-controlConnection.revoked:
+			send <- ControlMessageError{
+				Message: "disconnected",
+				Error:   "token has been revoked",
+			}
+			return
+		}
 		switch msg.Message {
 		case "actuator":
 			if msg.Value == nil {
 				log.Println("Control sent empty actuator data")
 				continue
 			}
+			if !permissions.CanSetActuator(msg.Name) {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			if err := controlConnection.CheckActuator(msg.Name, msg.Value); err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+				continue
+			}
 			controlConnection.SetActuator(msg.Name, msg.Value)
+		case "setActuatorType":
+			if permissions.Role != RoleAdmin {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			// The new type is sent to all controls, including this one.
+			err := controlConnection.SetActuatorType(msg.Name, msg.ActuatorType)
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+			}
+		case "history":
+			if !permissions.CanReadSensor(msg.Name) {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			history := controlConnection.History(msg.Name, msg.Start, msg.End, msg.Bucket)
+			if history == nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   "could not fetch history for sensor " + msg.Name,
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+				continue
+			}
+			send <- ControlMessageHistory{
+				Message:      "history",
+				HistoryReply: history,
+			}
+		case "actuatorHistory":
+			if msg.Name != "" && !permissions.CanReadActuatorHistory(msg.Name) {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			history := controlConnection.ActuatorHistory(msg.Name, msg.Start, msg.End, permissions)
+			if history == nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   "could not fetch actuator history",
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+				continue
+			}
+			send <- ControlMessageActuatorHistory{
+				Message: "actuatorHistory",
+				Name:    msg.Name,
+				History: history,
+			}
+		case "rules", "setRule", "deleteRule":
+			if permissions.Role != RoleAdmin {
+				send <- permissionDenied(msg.Message, "")
+				continue
+			}
+			var err error
+			if msg.Message == "setRule" {
+				if msg.Rule == nil {
+					err = errors.New("no rule")
+				} else {
+					err = controlConnection.SaveRule(msg.Rule)
+				}
+			} else if msg.Message == "deleteRule" {
+				err = controlConnection.DeleteRule(msg.Id)
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+				}
+				continue
+			}
+			send <- ControlMessageRules{
+				Message: "rules",
+				Rules:   controlConnection.Rules(),
+			}
+		case "thermostats", "setThermostat", "deleteThermostat":
+			if permissions.Role != RoleAdmin {
+				send <- permissionDenied(msg.Message, "")
+				continue
+			}
+			var err error
+			if msg.Message == "setThermostat" {
+				if msg.Thermostat == nil {
+					err = errors.New("no thermostat")
+				} else {
+					err = controlConnection.SaveThermostat(msg.Thermostat)
+				}
+			} else if msg.Message == "deleteThermostat" {
+				err = controlConnection.DeleteThermostat(msg.Id)
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+				}
+				continue
+			}
+			send <- ControlMessageThermostats{
+				Message:     "thermostats",
+				Thermostats: controlConnection.Thermostats(),
+			}
+		case "schedules", "setSchedule", "deleteSchedule":
+			if permissions.Role != RoleAdmin {
+				send <- permissionDenied(msg.Message, "")
+				continue
+			}
+			var err error
+			if msg.Message == "setSchedule" {
+				if msg.Schedule == nil {
+					err = errors.New("no schedule")
+				} else {
+					err = controlConnection.SaveSchedule(msg.Schedule)
+				}
+			} else if msg.Message == "deleteSchedule" {
+				err = controlConnection.DeleteSchedule(msg.Id)
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+				}
+				continue
+			}
+			send <- ControlMessageSchedules{
+				Message:   "schedules",
+				Schedules: controlConnection.Schedules(),
+			}
+		case "scenes", "setScene", "deleteScene":
+			if msg.Message != "scenes" && permissions.Role != RoleAdmin {
+				send <- permissionDenied(msg.Message, "")
+				continue
+			}
+			var err error
+			if msg.Message == "setScene" {
+				if msg.Scene == nil {
+					err = errors.New("no scene")
+				} else {
+					err = controlConnection.SaveScene(msg.Scene)
+				}
+			} else if msg.Message == "deleteScene" {
+				err = controlConnection.DeleteScene(msg.Id)
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+				}
+				continue
+			}
+			send <- ControlMessageScenes{
+				Message: "scenes",
+				Scenes:  controlConnection.Scenes(),
+			}
+		case "applyScene":
+			scene := controlConnection.Scene(msg.Name)
+			if scene == nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   "unknown scene",
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+				continue
+			}
+			if !permissions.CanApplyScene(scene) {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			// The new values are sent to all controls, including this one.
+			if err := controlConnection.ApplyScene(scene, controlSource(controlConnection)); err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+			}
+		case "setSensor":
+			if permissions.Role < RoleOperator || !permissions.CanReadSensor(msg.Name) {
+				send <- permissionDenied(msg.Message, msg.Name)
+				continue
+			}
+			if msg.Sensor == nil {
+				msg.Sensor = &SensorUpdate{}
+			}
+			// The change is sent to all controls, including this one.
+			_, err := controlConnection.UpdateSensor(msg.Name, *msg.Sensor, controlConnection.units)
+			if err == errNotFound {
+				err = errors.New("unknown sensor")
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+					Name:    msg.Name,
+				}
+			}
+		case "acknowledgeAlarm":
+			// The new state is sent to all controls, including this one.
+			_, err := controlConnection.AcknowledgeAlarm(msg.Id, permissions, controlConnection.user.name, controlConnection.units)
+			if err == errNotFound {
+				err = errors.New("unknown alarm")
+			}
+			if err != nil {
+				send <- ControlMessageError{
+					Message: "error",
+					Error:   err.Error(),
+					Request: msg.Message,
+				}
+			}
 		default:
 			log.Println("Unknown control message:", msg.Message)
 		}
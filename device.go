@@ -4,15 +4,19 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/subtle"
-	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"reflect"
 	"sync"
 	"time"
 )
 
 const GRAPH_TIME = 86400 // one day
 
+const HISTORY_BUCKETS = 500       // default number of buckets in a history query
+const MAX_HISTORY_BUCKETS = 10000 // upper limit to the number of buckets
+
 type DeviceSet struct {
 	devices map[[32]byte]*Device
 	lock    sync.Mutex
@@ -21,24 +25,47 @@ type DeviceSet struct {
 type Device struct {
 	*DeviceSet
 	dbId             int64
+	name             string
 	passwordHash     [32]byte
 	nextConnectionId int
 	connections      map[int]*DeviceConnection
 	nextControlId    int
 	controls         map[int]*ControlConnection
 	actuators        map[string]interface{}
+	actuatorTypes    map[string]*ActuatorType
+	rules            []*ruleState       // nil if not yet loaded
+	thermostats      []*thermostatState // nil if not yet loaded
+	schedules        []*scheduleState   // nil if not yet loaded
+	online           bool
+	lastSeen         time.Time            // last message from the device
+	sensorsSeen      map[string]time.Time // last value of each sensor
+	offlineSensors   map[string]bool
+	sampleTimes      map[string]sampleTiming // nil if not yet loaded
+	staleSensors     map[string]bool
+	alarms           map[string]*Alarm // open alarm of each sensor, nil if not yet loaded
+
+	// sendLock is held while sending actuator values to the connections. It
+	// is only taken with lock held, so devices get the values in the same
+	// order as they were changed, even when lock is released before sending.
+	sendLock sync.Mutex
 }
 
 type DeviceConnection struct {
 	id int
 	*Device
 	SendChan chan MessageValue
+	samples  chan receivedSample // sensor values for the rules and thermostats
 }
 
 type ControlConnection struct {
 	id int
 	*Device
-	sendChan chan interface{}
+	user        *User
+	permissions *Permissions
+	tokenHash   string // set when logged in with a token
+	units       string // unit system to convert sensor values to
+	sendChan    chan interface{}
+	revoked     chan struct{} // closed when the token has been revoked
 }
 
 var idKey []byte
@@ -80,6 +107,7 @@ func (d *Device) Connect() *DeviceConnection {
 		Device:   d,
 		id:       d.nextConnectionId,
 		SendChan: make(chan MessageValue, 5),
+		samples:  make(chan receivedSample, SAMPLE_QUEUE),
 	}
 	d.connections[connection.id] = connection
 	d.nextConnectionId++
@@ -87,49 +115,68 @@ func (d *Device) Connect() *DeviceConnection {
 	return connection
 }
 
+// deviceSerial returns the serial a device is stored with: a hash of its
+// password, so the database doesn't contain the password itself.
+func deviceSerial(password string) string {
+	return hashToken(password)
+}
+
+// getDevice returns the device with the given password, loading it if needed.
+// If insert is true, a device that doesn't exist yet is added with the given
+// name. The name of an existing device is left alone.
 func (ds *DeviceSet) getDevice(password, name string, insert bool) *Device {
 	if password == "" {
 		return nil
 	}
 
 	passwordHash := idHash(password)
-	var deviceId int64
-	var deviceName string
-	err := db.QueryRow("SELECT id,name FROM devices WHERE serial=?", password).Scan(&deviceId, &deviceName)
-	if err == sql.ErrNoRows {
+	serial := deviceSerial(password)
+	deviceId, deviceName, err := store.GetDevice(serial)
+	if err == errNotFound {
+		// Older databases contain the password itself, replace it.
+		deviceId, deviceName, err = store.GetDevice(password)
+		if err == nil {
+			err = store.SetDeviceSerial(deviceId, serial)
+		}
+	}
+	if err == errNotFound {
 		if !insert {
 			return nil
 		}
-		result, err := db.Exec("INSERT INTO devices (serial, name) VALUES (?, ?)", password, name)
+		deviceId, err = store.AddDevice(serial, name)
 		if err != nil {
 			log.Println("could not add device: ", err)
 			return nil
 		}
-		deviceId, err = result.LastInsertId()
-		if err != nil {
-			log.Println("could not get ID of just inserted device: ", err)
-			return nil
-		}
+		deviceName = name
 	} else if err != nil {
-		log.Printf("could not query device row for '%s' (%s): %s", name, password, err)
+		log.Printf("could not query device row for '%s': %s", name, err)
 		return nil
 	}
-	if deviceName != name && name != "" && insert {
-		_, err := db.Exec("UPDATE devices SET name=? WHERE id=?", name, deviceId)
-		if err != nil {
-			log.Println("could not update device name:", err)
-		}
-	}
-
 	device, ok := ds.devices[passwordHash]
 	if !ok {
+		actuators, err := store.GetActuators(deviceId)
+		if err != nil {
+			log.Printf("could not restore actuators of device %d: %s", deviceId, err)
+			actuators = make(map[string]interface{})
+		}
+		actuatorTypes, err := store.GetActuatorTypes(deviceId)
+		if err != nil {
+			log.Printf("could not restore actuator types of device %d: %s", deviceId, err)
+			actuatorTypes = make(map[string]*ActuatorType)
+		}
 		device = &Device{
-			dbId:         deviceId,
-			passwordHash: passwordHash,
-			DeviceSet:    ds,
-			connections:  make(map[int]*DeviceConnection),
-			controls:     make(map[int]*ControlConnection),
-			actuators:    make(map[string]interface{}),
+			dbId:           deviceId,
+			name:           deviceName,
+			passwordHash:   passwordHash,
+			DeviceSet:      ds,
+			connections:    make(map[int]*DeviceConnection),
+			controls:       make(map[int]*ControlConnection),
+			actuators:      actuators,
+			actuatorTypes:  actuatorTypes,
+			sensorsSeen:    make(map[string]time.Time),
+			offlineSensors: make(map[string]bool),
+			staleSensors:   make(map[string]bool),
 		}
 		ds.devices[device.passwordHash] = device
 	}
@@ -137,24 +184,11 @@ func (ds *DeviceSet) getDevice(password, name string, insert bool) *Device {
 }
 
 func (d *Device) getSensors() []*Sensor {
-	rows, err := db.Query("SELECT id, name, type, humanName, desiredValue FROM sensors WHERE deviceId=?", d.dbId)
+	sensors, err := store.GetSensors(d.dbId)
 	if err != nil {
 		log.Printf("could not query sensors for device %d: %s", d.dbId, err)
 		return nil
 	}
-	defer rows.Close()
-	sensors := make([]*Sensor, 0, 1)
-	for rows.Next() {
-		sensor := &Sensor{
-			deviceId: d.dbId,
-		}
-		err := rows.Scan(&sensor.dbId, &sensor.name, &sensor.sensorType, &sensor.humanName, &sensor.desiredValue)
-		if err != nil {
-			log.Println("could not read sensor:", err)
-			return nil
-		}
-		sensors = append(sensors, sensor)
-	}
 	return sensors
 }
 
@@ -173,30 +207,61 @@ func (d *DeviceConnection) Close() {
 	d.Device.mayClose()
 }
 
-func (d *Device) SendLogItem(sensorName string, value interface{}, logtime, interval time.Duration) {
+func (d *Device) SendLogItem(sensor *Sensor, value interface{}, logtime, interval time.Duration) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	valueFl, ok := value.(float64)
-	if !ok {
-		log.Println("WARNING: device sent value that is not a float")
-		return
-	}
-
-	msg := ControlMessageNewLog{
-		Message: "log",
-		Sensor:  sensorName,
-		Log: []*LogReplyRow{
-			&LogReplyRow{
-				Time:     int64(logtime / time.Second),
-				Interval: int64(interval / time.Second),
-				Value:    valueFl,
+	for _, control := range d.controls {
+		if !control.permissions.CanReadSensor(sensor.name) {
+			continue
+		}
+		control.sendChan <- ControlMessageNewLog{
+			Message: "log",
+			Sensor:  sensor.name,
+			Log: []*LogReplyRow{
+				&LogReplyRow{
+					Time:     int64(logtime / time.Second),
+					Interval: int64(interval / time.Second),
+					Value:    converterFor(sensor.unit, control.units).convert(value),
+				},
 			},
-		},
+		}
 	}
+}
+
+// sensorReading is one value in a batch of sensor values.
+type sensorReading struct {
+	sensor *Sensor
+	value  interface{}
+}
+
+// SendLogBatch sends sensor values that were measured together to all
+// controls, in a single message.
+func (d *Device) SendLogBatch(readings []sensorReading, logtime, interval time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
 	for _, control := range d.controls {
-		control.sendChan <- msg
+		batch := make(map[string][]*LogReplyRow, len(readings))
+		for _, reading := range readings {
+			if !control.permissions.CanReadSensor(reading.sensor.name) {
+				continue
+			}
+			batch[reading.sensor.name] = []*LogReplyRow{
+				&LogReplyRow{
+					Time:     int64(logtime / time.Second),
+					Interval: int64(interval / time.Second),
+					Value:    converterFor(reading.sensor.unit, control.units).convert(reading.value),
+				},
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		control.sendChan <- ControlMessageNewLog{
+			Message: "log",
+			Batch:   batch,
+		}
 	}
 }
 
@@ -205,7 +270,7 @@ func (d *DeviceConnection) SetActuator(name string, data interface{}) {
 	defer d.lock.Unlock()
 
 	// Update stored actuator value
-	d.actuators[name] = data
+	d.storeActuator(name, data, SourceDevice)
 
 	// send message to connected controls
 
@@ -220,21 +285,47 @@ func (d *DeviceConnection) SetActuator(name string, data interface{}) {
 	}
 }
 
-func (d *Device) AddControl(password string, sendChan chan interface{}) *ControlConnection {
-	passwordHash := idHash(password)
-	if subtle.ConstantTimeCompare(passwordHash[:], d.passwordHash[:]) != 1 {
-		// Maybe a constant-time compare is unnecessary, but let's do it anyway
-		// to be sure.
-		return nil
+// allDevices returns all loaded devices.
+func (ds *DeviceSet) allDevices() []*Device {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	devices := make([]*Device, 0, len(ds.devices))
+	for _, device := range ds.devices {
+		devices = append(devices, device)
 	}
+	return devices
+}
+
+// deviceById returns the loaded device with the given database ID, or nil.
+func (ds *DeviceSet) deviceById(id int64) *Device {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for _, device := range ds.devices {
+		if device.dbId == id {
+			return device
+		}
+	}
+	return nil
+}
 
+// AddControl adds a control connection for an authenticated user. If the user
+// logged in with a token, tokenHash is the hash of that token. Sensor values
+// are sent in the given unit system.
+func (d *Device) AddControl(user *User, permissions *Permissions, tokenHash, units string, sendChan chan interface{}) *ControlConnection {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	control := &ControlConnection{
-		Device:   d,
-		id:       d.nextControlId,
-		sendChan: sendChan,
+		Device:      d,
+		id:          d.nextControlId,
+		user:        user,
+		permissions: permissions,
+		tokenHash:   tokenHash,
+		units:       units,
+		sendChan:    sendChan,
+		revoked:     make(chan struct{}),
 	}
 	d.controls[control.id] = control
 	d.nextControlId++
@@ -256,16 +347,34 @@ func (d *ControlConnection) SetActuator(name string, value interface{}) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	d.actuators[name] = value
+	d.broadcastActuator(name, value, controlSource(d), d)
+}
+
+// SetActuator changes an actuator on behalf of something that is not a
+// control, like the REST API. The source is recorded in the audit log.
+func (d *Device) SetActuator(name string, value interface{}, source string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.broadcastActuator(name, value, source, nil)
+}
+
+// broadcastActuator stores the new actuator value and sends it to all
+// connected devices and to all controls except the given control (which may be
+// nil). The lock must be held.
+func (d *Device) broadcastActuator(name string, value interface{}, source string, except *ControlConnection) {
+	d.storeActuator(name, value, source)
 
 	deviceMsg := MessageValue{
 		Message: "actuator",
 		Name:    name,
 		Value:   value,
 	}
+	d.sendLock.Lock()
 	for _, connection := range d.connections {
 		connection.SendChan <- deviceMsg
 	}
+	d.sendLock.Unlock()
 
 	controlMsg := MessageValue{
 		Message: "actuator",
@@ -273,7 +382,7 @@ func (d *ControlConnection) SetActuator(name string, value interface{}) {
 		Value:   value,
 	}
 	for _, control := range d.controls {
-		if control == d {
+		if control == except {
 			// what we are
 			continue
 		}
@@ -281,6 +390,79 @@ func (d *ControlConnection) SetActuator(name string, value interface{}) {
 	}
 }
 
+// storeActuator updates the actuator value in memory and in the database, so
+// it survives a restart, and records the change in the audit log. The lock
+// must be held.
+func (d *Device) storeActuator(name string, value interface{}, source string) {
+	previous, ok := d.actuators[name]
+	if ok && reflect.DeepEqual(previous, value) {
+		// Not a change. This happens for example when the device echoes a
+		// value that was just sent to it.
+		return
+	}
+
+	d.actuators[name] = value
+	err := store.SetActuator(d.dbId, name, value)
+	if err != nil {
+		log.Printf("could not store value of actuator %s: %s", name, err)
+	}
+
+	err = store.AddActuatorChange(d.dbId, &ActuatorChange{
+		Name:     name,
+		Time:     time.Now().Unix(),
+		Value:    value,
+		Previous: previous,
+		Source:   source,
+	})
+	if err != nil {
+		log.Printf("could not log change of actuator %s: %s", name, err)
+	}
+}
+
+// Actuators returns a copy of the current actuator values.
+func (d *Device) Actuators() map[string]interface{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	actuators := make(map[string]interface{}, len(d.actuators))
+	for name, value := range d.actuators {
+		actuators[name] = value
+	}
+	return actuators
+}
+
+// disconnectRevoked removes the controls that logged in with one of the
+// given (revoked) tokens, so they get no more updates, and tells their
+// connections to close.
+func (d *Device) disconnectRevoked(revoked map[string]bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for id, control := range d.controls {
+		if control.tokenHash == "" || !revoked[control.tokenHash] {
+			continue
+		}
+		log.Printf("Disconnecting control %d of user %s: token has been revoked", id, control.user.name)
+		delete(d.controls, id)
+		close(control.revoked)
+	}
+}
+
+// tokenHashes returns the hashes of the tokens connected controls logged in
+// with.
+func (d *Device) tokenHashes() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	hashes := make([]string, 0)
+	for _, control := range d.controls {
+		if control.tokenHash != "" {
+			hashes = append(hashes, control.tokenHash)
+		}
+	}
+	return hashes
+}
+
 func (d *ControlConnection) Logs(lastValueTimes map[string]int64) map[string]*LogReply {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -290,11 +472,110 @@ func (d *ControlConnection) Logs(lastValueTimes map[string]int64) map[string]*Lo
 	sensorReplies := make(map[string]*LogReply, len(sensors))
 	now := time.Now()
 	for _, sensor := range sensors {
+		if !d.permissions.CanReadSensor(sensor.name) {
+			continue
+		}
 		lastValueTime := lastValueTimes[sensor.name] // rely on the nil value
 		if lastValueTime < now.Unix()-GRAPH_TIME {
 			lastValueTime = now.Unix() - GRAPH_TIME
 		}
-		sensorReplies[sensor.name] = sensor.FetchLogs(lastValueTime)
+		reply := sensor.FetchLogs(lastValueTime, d.units)
+		if reply != nil {
+			reply.Stale = d.staleSensors[sensor.name]
+		}
+		sensorReplies[sensor.name] = reply
 	}
 	return sensorReplies
 }
+
+// UpdateSensor changes the metadata of a sensor, and sends the new metadata to
+// all controls. The desired value in the update, and the returned metadata, are
+// in the given unit system. It returns errNotFound if there is no such sensor.
+func (d *Device) UpdateSensor(name string, update SensorUpdate, units string) (*SensorInfo, error) {
+	// Read, change and write the sensor under the lock, so that concurrent
+	// updates of different fields don't overwrite each other.
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sensor, err := store.GetSensor(d.dbId, name)
+	if err == errNotFound {
+		return nil, err
+	} else if err != nil {
+		log.Printf("could not query sensor '%s': %s", name, err)
+		return nil, errors.New("could not read sensor")
+	}
+	err = sensor.apply(update, units)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.UpdateSensor(sensor.dbId, sensor.humanName, sensor.unit, sensor.desiredValue, sensor.alarmMin, sensor.alarmMax, sensor.alarmHysteresis)
+	if err != nil {
+		log.Printf("could not update sensor '%s': %s", name, err)
+		return nil, errors.New("could not save sensor")
+	}
+
+	d.sendSensor(sensor)
+
+	// The thermostat may need to react to the new desired value.
+	if d.thermostats == nil {
+		d.loadThermostats()
+	}
+	for _, thermostat := range d.thermostats {
+		if thermostat.Sensor == name && thermostat.known {
+			d.runThermostat(thermostat, sensor.desiredValue, time.Now())
+		}
+	}
+
+	return sensor.Info(units), nil
+}
+
+// setSensorUnit sets the unit of a sensor that doesn't have one yet, and sends
+// the sensor to all controls. Unlike UpdateSensor it doesn't run the
+// thermostats, which may wait for the device: it is called while handling a
+// message from the device.
+func (d *Device) setSensorUnit(name, unit string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	sensor, err := store.GetSensor(d.dbId, name)
+	if err != nil {
+		return err
+	}
+	if sensor.unit != "" {
+		return fmt.Errorf("sensor already has unit '%s'", sensor.unit)
+	}
+	sensor.unit = unit
+	err = store.UpdateSensor(sensor.dbId, sensor.humanName, sensor.unit, sensor.desiredValue, sensor.alarmMin, sensor.alarmMax, sensor.alarmHysteresis)
+	if err != nil {
+		return err
+	}
+	d.sendSensor(sensor)
+	return nil
+}
+
+// sendSensor sends the metadata of a sensor to all controls that may read it.
+// The lock must be held.
+func (d *Device) sendSensor(sensor *Sensor) {
+	for _, control := range d.controls {
+		if control.permissions.CanReadSensor(sensor.name) {
+			control.sendChan <- ControlMessageSensor{
+				Message: "sensor",
+				Sensor:  sensor.Info(control.units),
+			}
+		}
+	}
+}
+
+// History returns the downsampled log of one sensor, or nil if there is no
+// such sensor.
+func (d *ControlConnection) History(sensorName string, start, end, bucket int64) *HistoryReply {
+	if !d.permissions.CanReadSensor(sensorName) {
+		return nil
+	}
+	sensor := GetSensor(d.dbId, sensorName)
+	if sensor == nil {
+		return nil
+	}
+	return sensor.History(start, end, bucket, d.units)
+}
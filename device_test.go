@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// checkSensorInfo checks the converted values of a sensor.
+func checkSensorInfo(t *testing.T, what string, info *SensorInfo, unit string, desired, alarmMin, alarmMax, hysteresis float64) {
+	t.Helper()
+	values := []struct {
+		name     string
+		value    interface{}
+		expected float64
+	}{
+		{"desired value", info.DesiredValue, desired},
+		{"alarm minimum", info.AlarmMin, alarmMin},
+		{"alarm maximum", info.AlarmMax, alarmMax},
+		{"alarm hysteresis", info.AlarmHysteresis, hysteresis},
+	}
+	if info.Unit != unit {
+		t.Errorf("%s: got unit %q, expected %q", what, info.Unit, unit)
+	}
+	for _, v := range values {
+		if value, ok := v.value.(float64); !ok || !closeTo(value, v.expected) {
+			t.Errorf("%s: got %s %v, expected %v", what, v.name, v.value, v.expected)
+		}
+	}
+}
+
+func TestUpdateSensor(t *testing.T) {
+	d, _ := newTestDevice(t)
+	sensor, err := store.AddSensor(d.dbId, "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	if err := store.UpdateSensor(sensor.dbId, "", "°C", nil, nil, nil, 0); err != nil {
+		t.Fatal("could not set unit:", err)
+	}
+	imperialChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", UnitsImperial, imperialChan)
+	metricChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "bob"}, &Permissions{Role: RoleViewer}, "", UnitsMetric, metricChan)
+	otherChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "carol"}, &Permissions{Role: RoleViewer, Sensors: map[string]bool{"humidity": true}}, "", "", otherChan)
+
+	// Values from an imperial client are stored in °C.
+	hysteresis := 1.8
+	info, err := d.UpdateSensor("temp", SensorUpdate{
+		DesiredValue:    json.RawMessage("68"),
+		AlarmMin:        json.RawMessage("50"),
+		AlarmMax:        json.RawMessage("86"),
+		AlarmHysteresis: &hysteresis,
+	}, UnitsImperial)
+	if err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	checkSensorInfo(t, "reply", info, "°F", 68, 50, 86, 1.8)
+	stored, err := store.GetSensor(d.dbId, "temp")
+	if err != nil {
+		t.Fatal("could not get sensor:", err)
+	}
+	checkSensorInfo(t, "stored", stored.Info(""), "°C", 20, 10, 30, 1)
+
+	// Every control that may read the sensor gets it in its own units.
+	for _, control := range []struct {
+		name        string
+		sendChan    chan interface{}
+		unit        string
+		desired     float64
+		min, max, h float64
+	}{
+		{"imperial control", imperialChan, "°F", 68, 50, 86, 1.8},
+		{"metric control", metricChan, "°C", 20, 10, 30, 1},
+	} {
+		if len(control.sendChan) != 1 {
+			t.Errorf("%s got %d messages, expected 1", control.name, len(control.sendChan))
+			continue
+		}
+		msg, ok := (<-control.sendChan).(ControlMessageSensor)
+		if !ok || msg.Message != "sensor" || msg.Sensor.Name != "temp" {
+			t.Errorf("%s got message %#v", control.name, msg)
+			continue
+		}
+		checkSensorInfo(t, control.name, msg.Sensor, control.unit, control.desired, control.min, control.max, control.h)
+	}
+	if len(otherChan) != 0 {
+		t.Errorf("control that may not read the sensor got %d messages", len(otherChan))
+	}
+
+	// Null unsets a value, fields that are left out don't change.
+	info, err = d.UpdateSensor("temp", SensorUpdate{DesiredValue: json.RawMessage("null")}, "")
+	if err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	if info.DesiredValue != nil || info.AlarmMin != 10.0 || info.AlarmMax != 30.0 {
+		t.Errorf("after unsetting the desired value: got %+v", info)
+	}
+	<-imperialChan
+	<-metricChan
+
+	// Invalid updates change nothing and aren't sent to the controls.
+	negative := -1.0
+	longName := string(make([]byte, MAX_HUMAN_NAME+1))
+	for _, update := range []SensorUpdate{
+		{AlarmMin: json.RawMessage("90")}, // above the maximum in °F
+		{AlarmMax: json.RawMessage("40")}, // below the minimum in °F
+		{AlarmHysteresis: &negative},
+		{DesiredValue: json.RawMessage(`"warm"`)},
+		{HumanName: &longName},
+	} {
+		if _, err := d.UpdateSensor("temp", update, UnitsImperial); err == nil {
+			t.Errorf("update %+v: no error", update)
+		}
+	}
+	if len(imperialChan) != 0 || len(metricChan) != 0 {
+		t.Errorf("invalid updates sent %d and %d messages", len(imperialChan), len(metricChan))
+	}
+	stored, err = store.GetSensor(d.dbId, "temp")
+	if err != nil {
+		t.Fatal("could not get sensor:", err)
+	}
+	if stored.desiredValue != nil || stored.alarmMin != 10.0 || stored.alarmMax != 30.0 || stored.humanName != "" {
+		t.Errorf("invalid updates changed the sensor: %+v", stored.Info(""))
+	}
+
+	if _, err := d.UpdateSensor("unknown", SensorUpdate{}, ""); err != errNotFound {
+		t.Errorf("unknown sensor: got error %v, expected errNotFound", err)
+	}
+}
+
+func TestGetDeviceName(t *testing.T) {
+	oldStore := store
+	defer func() { store = oldStore }()
+	store = newMemoryStore()
+
+	// New devices get the given name, existing devices keep theirs.
+	device := NewDeviceSet().getDevice("secret", "home", true)
+	if device == nil || device.name != "home" {
+		t.Fatalf("got device %+v, expected one named home", device)
+	}
+	if err := store.SetDeviceName(device.dbId, "House"); err != nil {
+		t.Fatal("could not rename device:", err)
+	}
+	device = NewDeviceSet().getDevice("secret", "home", true)
+	if device == nil || device.name != "House" {
+		t.Errorf("got device %+v after a restart, expected the name House", device)
+	}
+	if NewDeviceSet().getDevice("other", "attic", false) != nil {
+		t.Error("got a device that doesn't exist")
+	}
+}
+
+func TestGetDeviceSerial(t *testing.T) {
+	oldStore := store
+	defer func() { store = oldStore }()
+	store = newMemoryStore()
+
+	// Only a hash of the password is stored.
+	device := NewDeviceSet().getDevice("secret", "home", true)
+	if device == nil {
+		t.Fatal("could not add device")
+	}
+	if _, _, err := store.GetDevice("secret"); err != errNotFound {
+		t.Errorf("found device by its password: %v", err)
+	}
+	if id, _, err := store.GetDevice(deviceSerial("secret")); err != nil || id != device.dbId {
+		t.Errorf("got device %d (%v) by serial, expected %d", id, err, device.dbId)
+	}
+
+	// Devices stored with their password are found, and then hashed.
+	id := addTestDevice(t, store, "legacy")
+	device = NewDeviceSet().getDevice("legacy", "", false)
+	if device == nil || device.dbId != id || device.name != "legacy name" {
+		t.Fatalf("got device %+v, expected %d", device, id)
+	}
+	if _, _, err := store.GetDevice("legacy"); err != errNotFound {
+		t.Errorf("password still stored: %v", err)
+	}
+	if found, _, err := store.GetDevice(deviceSerial("legacy")); err != nil || found != id {
+		t.Errorf("got device %d (%v) by serial, expected %d", found, err, id)
+	}
+}
+
+func TestSetSensorUnit(t *testing.T) {
+	d, sendChan := newTestDevice(t)
+	if _, err := store.AddSensor(d.dbId, "temp", "temp", ValueNumber); err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	controlChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", "", controlChan)
+	// A thermostat that switches as soon as it runs.
+	d.thermostats = []*thermostatState{{
+		Thermostat: &Thermostat{Sensor: "temp", Actuator: "heater", OnValue: true, OffValue: false, Enabled: true},
+		known:      true,
+		fallback:   true,
+	}}
+
+	if err := d.setSensorUnit("temp", "°C"); err != nil {
+		t.Fatal("could not set unit:", err)
+	}
+	if sensor, err := store.GetSensor(d.dbId, "temp"); err != nil || sensor.unit != "°C" {
+		t.Errorf("got sensor %+v (%v), expected unit °C", sensor, err)
+	}
+	if msg, ok := (<-controlChan).(ControlMessageSensor); !ok || msg.Sensor.Unit != "°C" {
+		t.Errorf("got control message %#v, expected the new unit", msg)
+	}
+	if len(sendChan) != 0 {
+		t.Errorf("setting the unit ran the thermostat: %d values sent to the device", len(sendChan))
+	}
+
+	// A unit that is already set is kept.
+	if err := d.setSensorUnit("temp", "°F"); err == nil {
+		t.Error("changed the unit of the sensor")
+	}
+	if sensor, err := store.GetSensor(d.dbId, "temp"); err != nil || sensor.unit != "°C" {
+		t.Errorf("got sensor %+v (%v), expected unit °C", sensor, err)
+	}
+	if err := d.setSensorUnit("humidity", "%"); err != errNotFound {
+		t.Errorf("unknown sensor: got error %v, expected errNotFound", err)
+	}
+}
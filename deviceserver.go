@@ -1,15 +1,24 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+var flagMQTTStatusTopic = flag.String("mqtt-status-topic", "domos/status", "MQTT topic for the online/offline status of this server (empty to disable)")
+
+const SAMPLE_QUEUE = 64 // sensor values waiting for the rules and thermostats before new ones are dropped
+const MAX_ECHOES = 8    // payloads per topic that may still be echoed by the broker
+
 type DeviceMessage struct {
 	Message  string      `json:"message"`  // message type: 'connect', 'sensorLog'
 	Name     string      `json:"name"`     // device human name / sensor name / actuator name
@@ -18,6 +27,12 @@ type DeviceMessage struct {
 	Type     string      `json:"type"`     // log type
 	Interval int64       `json:"interval"` // log interval
 	Value    interface{} `json:"value"`    // log value, actuator data type
+	Unit     string      `json:"unit"`     // unit of the log value (optional)
+
+	// Several readings with a shared time and interval, instead of Value and
+	// Unit. The key is the name of the reading.
+	Values map[string]interface{} `json:"values"`
+	Units  map[string]string      `json:"units"`
 }
 
 func (m DeviceMessage) Integer() int64 {
@@ -47,19 +62,28 @@ func (m DeviceMessage) IntervalNs() time.Duration {
 }
 
 type MQTTServer struct {
-	topicPrefix      string
-	deviceConnection *DeviceConnection
-	client           mqtt.Client
+	devices map[string]*DeviceConnection // key is the topic prefix
+	client  mqtt.Client
+	lock    sync.Mutex
+	sent    map[string][]string // payloads sent per topic that weren't echoed yet, oldest first
+	bridges []*haBridge         // Home Assistant bridges, if enabled
 }
 
-func serveMQTT(address, mqttID, mqttUser, mqttPass, mqttTopicPrefix string, device *Device) {
-	if mqttTopicPrefix[len(mqttTopicPrefix)-1] != '/' {
-		mqttTopicPrefix += "/"
-	}
+// mqttServer is the running MQTT server, used to publish notifications.
+var mqttServer *MQTTServer
+var mqttServerLock sync.Mutex
+
+func serveMQTT(address, mqttID, mqttUser, mqttPass string, devices map[string]*Device) {
 	ms := &MQTTServer{
-		topicPrefix:      mqttTopicPrefix,
-		deviceConnection: device.Connect(),
+		devices: make(map[string]*DeviceConnection, len(devices)),
+		sent:    make(map[string][]string),
+	}
+	for topicPrefix, device := range devices {
+		ms.devices[topicPrefix] = device.Connect()
 	}
+	mqttServerLock.Lock()
+	mqttServer = ms
+	mqttServerLock.Unlock()
 
 	opts := mqtt.NewClientOptions().AddBroker(address)
 	opts.ClientID = mqttID
@@ -67,31 +91,68 @@ func serveMQTT(address, mqttID, mqttUser, mqttPass, mqttTopicPrefix string, devi
 	opts.Username = mqttUser
 	opts.Password = mqttPass
 	opts.DefaultPublishHander = ms.publishHandler
+	if *flagMQTTStatusTopic != "" {
+		// Let devices know when the server is gone.
+		opts.SetWill(*flagMQTTStatusTopic, "offline", 1, true)
+	}
 
-	go ms.deviceSendServer()
+	for topicPrefix, deviceConnection := range ms.devices {
+		go ms.deviceSendServer(topicPrefix, deviceConnection)
+		go ms.sampleServer(deviceConnection)
+	}
+
+	if *flagHADiscovery != "" {
+		for _, device := range devices {
+			ms.bridges = append(ms.bridges, newHABridge(ms, device))
+		}
+	}
 
 	for {
-		ms.client = mqtt.NewClient(opts)
-		if token := ms.client.Connect(); token.Wait() && token.Error() != nil {
+		// Other goroutines publish through ms.client, so it may only be
+		// changed with the lock held.
+		client := mqtt.NewClient(opts)
+		ms.lock.Lock()
+		ms.client = client
+		ms.lock.Unlock()
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
 			log.Println("MQTT connection failed (will wait 1min): ", token.Error())
 			time.Sleep(1 * time.Minute)
 			continue
 		}
 
-		for _, suffix := range []string{"s/+", "a/+"} {
-			topic := ms.topicPrefix + suffix
-			if token := ms.client.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
-				log.Fatal("Could not subscribe to topic: ", topic)
+		for topicPrefix := range ms.devices {
+			for _, suffix := range []string{"s/+", "a/+", "t/+", "status"} {
+				topic := topicPrefix + suffix
+				if token := client.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
+					log.Fatal("Could not subscribe to topic: ", topic)
+				}
+			}
+		}
+		for _, bridge := range ms.bridges {
+			for _, topic := range bridge.commandTopics() {
+				if token := client.Subscribe(topic, 1, nil); token.Wait() && token.Error() != nil {
+					log.Fatal("Could not subscribe to topic: ", topic)
+				}
 			}
 		}
 
+		if *flagMQTTStatusTopic != "" {
+			if token := client.Publish(*flagMQTTStatusTopic, 1, true, "online"); token.Wait() && token.Error() != nil {
+				log.Println("Could not publish server status:", token.Error())
+			}
+		}
+
+		for _, bridge := range ms.bridges {
+			bridge.publishDiscovery()
+		}
+
 		if *flagVerbose {
 			log.Println("Established MQTT connection to", address)
 		}
 
 		// TODO: find a more elegant way to handle this (the library isn't very
 		// helpful here).
-		for ms.client.IsConnected() {
+		for client.IsConnected() {
 			time.Sleep(1 * time.Second)
 		}
 		log.Println("Closed connection with device.")
@@ -105,22 +166,140 @@ func (ms *MQTTServer) publishHandler(client mqtt.Client, msg mqtt.Message) {
 		log.Printf("MQTT: %s: %s", msg.Topic(), string(msg.Payload()))
 	}
 
-	topic := msg.Topic()[len(ms.topicPrefix):]
+	for _, bridge := range ms.bridges {
+		if strings.HasPrefix(msg.Topic(), bridge.topic) {
+			bridge.queueCommand(msg.Topic(), msg.Payload())
+			return
+		}
+	}
+
+	for topicPrefix, deviceConnection := range ms.devices {
+		if !strings.HasPrefix(msg.Topic(), topicPrefix) {
+			continue
+		}
+		topic := msg.Topic()[len(topicPrefix):]
+		// Retained messages were sent some time ago, so they don't tell
+		// whether the device is alive.
+		live := !msg.Retained()
 
-	parts := strings.Split(topic, "/")
-	if parts[0] == "s" {
-		ms.handleSensor(parts[1], msg.Payload())
-	} else if parts[0] == "a" {
-		ms.handleActuator(parts[1], msg.Payload())
+		if topic == "status" {
+			ms.handleStatus(deviceConnection, msg.Payload(), live)
+			return
+		}
+
+		// Topic prefixes don't overlap (see deviceList.Set), so no other
+		// device can match.
+		parts := strings.Split(topic, "/")
+		if len(parts) != 2 {
+			break
+		}
+		if parts[0] == "s" {
+			ms.handleSensor(deviceConnection, parts[1], msg.Payload(), live)
+		} else if parts[0] == "a" {
+			if ms.isEcho(msg.Topic(), msg.Payload()) {
+				// Not from the device, and an older echo would undo
+				// newer changes.
+				return
+			}
+			if live {
+				deviceConnection.markSeen("", time.Now())
+			}
+			ms.handleActuator(deviceConnection, parts[1], msg.Payload())
+		} else if parts[0] == "t" {
+			ms.handleActuatorType(deviceConnection, parts[1], msg.Payload())
+		} else {
+			break
+		}
+		return
+	}
+	log.Println("unrecognized topic:", msg.Topic())
+}
+
+// mqttPublish publishes a message (not retained) over the MQTT connection. It
+// gives up when the deadline of the context passes.
+func mqttPublish(ctx context.Context, topic string, payload []byte) error {
+	mqttServerLock.Lock()
+	ms := mqttServer
+	mqttServerLock.Unlock()
+	if ms == nil {
+		return errors.New("MQTT is not running")
+	}
+	return ms.publish(ctx, topic, 1, false, payload)
+}
+
+// publish publishes a message and waits until it has been sent, or until the
+// deadline of the context passes.
+func (ms *MQTTServer) publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	ms.lock.Lock()
+	client := ms.client
+	ms.lock.Unlock()
+	if client == nil || !client.IsConnected() {
+		return errors.New("not connected to MQTT broker")
+	}
+	token := client.Publish(topic, qos, retained, payload)
+	// The MQTT library doesn't support contexts, so only the deadline of the
+	// context is used.
+	if deadline, ok := ctx.Deadline(); ok {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			return errors.New("timeout while publishing to MQTT broker")
+		}
 	} else {
-		log.Println("unrecognized topic:", topic)
+		token.Wait()
+	}
+	return token.Error()
+}
+
+// handleStatus handles the status topic of a device, which the device should
+// set to "online" when it connects and use as last will with "offline".
+func (ms *MQTTServer) handleStatus(deviceConnection *DeviceConnection, payload []byte, live bool) {
+	switch string(payload) {
+	case "online":
+		if live {
+			deviceConnection.markSeen("", time.Now())
+		}
+	case "offline":
+		deviceConnection.markOffline()
+	default:
+		log.Printf("Device sent unknown status: %q", payload)
 	}
 }
 
-func (ms *MQTTServer) handleSensor(sensor string, payload []byte) {
-	msgSensorName := sensor
-	msgSensorType := sensor
+// markSent remembers a payload published by this server, so the echo from the
+// broker can be recognized.
+func (ms *MQTTServer) markSent(topic string, payload []byte) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	sent := append(ms.sent[topic], string(payload))
+	if len(sent) > MAX_ECHOES {
+		sent = sent[len(sent)-MAX_ECHOES:]
+	}
+	ms.sent[topic] = sent
+}
+
+// isEcho returns true if the message is the broker sending back a message that
+// was published by this server.
+func (ms *MQTTServer) isEcho(topic string, payload []byte) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	sent := ms.sent[topic]
+	for i, p := range sent {
+		if p != string(payload) {
+			continue
+		}
+		// Echoes arrive in order, so older payloads won't be echoed anymore.
+		if i == len(sent)-1 {
+			delete(ms.sent, topic)
+		} else {
+			ms.sent[topic] = sent[i+1:]
+		}
+		return true
+	}
+	return false
+}
 
+func (ms *MQTTServer) handleSensor(deviceConnection *DeviceConnection, name string, payload []byte, live bool) {
 	message := DeviceMessage{}
 	err := json.Unmarshal(payload, &message)
 	if err != nil {
@@ -128,47 +307,149 @@ func (ms *MQTTServer) handleSensor(sensor string, payload []byte) {
 		return
 	}
 
-	// Fetch sensorId
-	var sensorId int64
-	var sensorType string
-	err = db.QueryRow("SELECT id, type FROM sensors WHERE deviceId=? AND name=?", ms.deviceConnection.dbId, msgSensorName).Scan(&sensorId, &sensorType)
-	if err == sql.ErrNoRows {
+	if message.Values != nil {
+		ms.handleSensorValues(deviceConnection, name, message, live)
+		return
+	}
+
+	sensor := ms.storeSample(deviceConnection, name, name, message.Value, message.Unit, message.TimeNs(), message.IntervalNs())
+	if sensor == nil {
+		return
+	}
+	if live {
+		deviceConnection.markSeen(sensor.name, time.Now())
+	}
+	deviceConnection.markSampled(sensor.name, message.TimeNs(), message.IntervalNs())
+	deviceConnection.SendLogItem(sensor, message.Value, message.TimeNs(), message.IntervalNs())
+	deviceConnection.checkAlarm(sensor, message.Value)
+	ms.queueSample(deviceConnection, sensor, message.Value)
+}
+
+// handleSensorValues handles a message with several readings that share a
+// timestamp, like temperature, humidity and pressure from one chip. Every
+// reading is stored as its own sensor named <topic>.<key>, with the topic as
+// sensor type, and controls get all readings in one message.
+func (ms *MQTTServer) handleSensorValues(deviceConnection *DeviceConnection, name string, message DeviceMessage, live bool) {
+	keys := make([]string, 0, len(message.Values))
+	for key := range message.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	readings := make([]sensorReading, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			log.Printf("could not save log row: empty reading name for sensor '%s'", name)
+			continue
+		}
+		value := message.Values[key]
+		sensor := ms.storeSample(deviceConnection, name+"."+key, name, value, message.Units[key], message.TimeNs(), message.IntervalNs())
+		if sensor == nil {
+			continue
+		}
+		readings = append(readings, sensorReading{sensor, value})
+		if live {
+			deviceConnection.markSeen(sensor.name, time.Now())
+		}
+		deviceConnection.markSampled(sensor.name, message.TimeNs(), message.IntervalNs())
+	}
+	if len(readings) == 0 {
+		return
+	}
+
+	deviceConnection.SendLogBatch(readings, message.TimeNs(), message.IntervalNs())
+	for _, reading := range readings {
+		deviceConnection.checkAlarm(reading.sensor, reading.value)
+		ms.queueSample(deviceConnection, reading.sensor, reading.value)
+	}
+}
+
+// receivedSample is a sensor value waiting for the rules and thermostats.
+type receivedSample struct {
+	sensor   *Sensor
+	value    interface{}
+	received time.Time
+}
+
+// queueSample queues a sensor value for the rules and thermostats. It never
+// blocks: they set actuators, which may wait for the device send queue, and
+// that queue is only drained when the broker acknowledgements are delivered
+// by the goroutine that calls the MQTT message handler.
+func (ms *MQTTServer) queueSample(deviceConnection *DeviceConnection, sensor *Sensor, value interface{}) {
+	select {
+	case deviceConnection.samples <- receivedSample{sensor, value, time.Now()}:
+	default:
+		log.Printf("sample queue of device %s is full, not running rules and thermostats for %s", deviceConnection.name, sensor.name)
+	}
+}
+
+// sampleServer runs the rules and thermostats for queued sensor values.
+func (ms *MQTTServer) sampleServer(deviceConnection *DeviceConnection) {
+	for sample := range deviceConnection.samples {
+		deviceConnection.evaluateRules(sample.sensor, sample.value, sample.received)
+		deviceConnection.updateThermostats(sample.sensor, sample.value, sample.received)
+	}
+}
+
+// storeSample stores one sensor value, adding the sensor if it doesn't exist
+// yet. It returns the sensor, or nil if the value could not be stored.
+func (ms *MQTTServer) storeSample(deviceConnection *DeviceConnection, sensorName, sensorType string, value interface{}, unit string, logtime, interval time.Duration) *Sensor {
+	valueType, ok := valueTypeOf(value)
+	if !ok {
+		log.Printf("could not save log row: unsupported value for sensor '%s': %#v", sensorName, value)
+		return nil
+	}
+
+	// Fetch sensor
+	sensor, err := store.GetSensor(deviceConnection.dbId, sensorName)
+	if err == errNotFound {
 		// Sensor doesn't exist, insert it now.
 		if *flagVerbose {
-			log.Printf("Adding sensor %s (type %s)", msgSensorName, msgSensorType)
+			log.Printf("Adding sensor %s (type %s, %s values)", sensorName, sensorType, valueType)
 		}
-		result, err := db.Exec("INSERT INTO sensors (deviceId, name, type) VALUES (?, ?, ?)", ms.deviceConnection.dbId, msgSensorName, msgSensorType)
+		sensor, err = store.AddSensor(deviceConnection.dbId, sensorName, sensorType, valueType)
 		if err != nil {
 			log.Println("could not add sensor:", err)
-			return
-		}
-		sensorId, err = result.LastInsertId()
-		if err != nil {
-			log.Println("could not get ID of just inserted sensor:", err)
-			return
+			return nil
 		}
 	} else if err != nil {
-		log.Printf("could not query sensor ID for sensor '%s': %s", msgSensorName, err)
-		return
-	} else if msgSensorType != sensorType {
-		log.Printf("could not save log row: incompatible type '%s' (expected '%s'): %#v", msgSensorType, sensorType, message)
-		return
+		log.Printf("could not query sensor ID for sensor '%s': %s", sensorName, err)
+		return nil
+	} else if sensorType != sensor.sensorType {
+		log.Printf("could not save log row: incompatible type '%s' for sensor '%s' (expected '%s'): %#v", sensorType, sensorName, sensor.sensorType, value)
+		return nil
+	} else if valueType != sensor.valueType {
+		log.Printf("could not save log row: incompatible %s value for sensor '%s' (expected %s): %#v", valueType, sensorName, sensor.valueType, value)
+		return nil
+	}
+	if unit != "" && unit != sensor.unit {
+		if sensor.unit != "" {
+			// Keep the unit: it may have been corrected by a user, and
+			// existing values would be converted wrongly otherwise.
+			log.Printf("Device sent unit '%s' for sensor '%s', expected '%s'", unit, sensorName, sensor.unit)
+		} else {
+			err := deviceConnection.setSensorUnit(sensorName, unit)
+			if err != nil {
+				log.Printf("could not set unit of sensor '%s': %s", sensorName, err)
+			} else {
+				sensor.unit = unit
+			}
+		}
 	}
 
 	// Store sensor data
-	_, err = db.Exec("INSERT INTO sensorData (sensorId, time, value, interval) VALUES (?, ?, ?, ?)", sensorId, message.TimeNs(), message.Value, message.IntervalNs())
+	err = store.InsertSample(sensor.dbId, logtime, interval, value)
 	if err != nil {
 		log.Println("could not insert sensor data:", err)
-		return
-	} else {
-		if *flagVerbose {
-			log.Printf("INSERT: sensor=%v timestamp=%v value=%v interval=%v", sensorId, int64(message.TimeNs()/time.Second), message.Value, message.IntervalNs())
-		}
+		return nil
+	}
+	if *flagVerbose {
+		log.Printf("INSERT: sensor=%v timestamp=%v value=%v interval=%v", sensor.dbId, int64(logtime/time.Second), value, interval)
 	}
-	ms.deviceConnection.SendLogItem(msgSensorName, message.Value, message.TimeNs(), message.IntervalNs())
+	return sensor
 }
 
-func (ms *MQTTServer) handleActuator(actuator string, payload []byte) {
+func (ms *MQTTServer) handleActuator(deviceConnection *DeviceConnection, actuator string, payload []byte) {
 	message := DeviceMessage{}
 	err := json.Unmarshal(payload, &message)
 	if err != nil {
@@ -176,12 +457,31 @@ func (ms *MQTTServer) handleActuator(actuator string, payload []byte) {
 		return
 	}
 
-	ms.deviceConnection.SetActuator(actuator, message.Value)
+	deviceConnection.SetActuator(actuator, message.Value)
+}
+
+// handleActuatorType stores the type a device declares for one of its
+// actuators. An empty payload (a cleared retained message) removes the type.
+func (ms *MQTTServer) handleActuatorType(deviceConnection *DeviceConnection, actuator string, payload []byte) {
+	var actuatorType *ActuatorType
+	if len(payload) != 0 {
+		actuatorType = &ActuatorType{}
+		err := json.Unmarshal(payload, actuatorType)
+		if err != nil {
+			log.Printf("Could not parse type of actuator %s: %s", actuator, err)
+			return
+		}
+	}
+
+	err := deviceConnection.SetActuatorType(actuator, actuatorType)
+	if err != nil {
+		log.Printf("Device sent invalid type for actuator %s: %s", actuator, err)
+	}
 }
 
 // Write goroutine
-func (ms *MQTTServer) deviceSendServer() {
-	for msg := range ms.deviceConnection.SendChan {
+func (ms *MQTTServer) deviceSendServer(topicPrefix string, deviceConnection *DeviceConnection) {
+	for msg := range deviceConnection.SendChan {
 		// Only send the 'value' field.
 		msg2 := MessageActuator{Value: msg.Value}
 
@@ -191,8 +491,11 @@ func (ms *MQTTServer) deviceSendServer() {
 			log.Fatal("failed to marshal: ", err)
 		}
 
-		if token := ms.client.Publish(ms.topicPrefix+"a/"+msg.Name, 1, true, b); token.Wait() && token.Error() != nil {
-			log.Println("Could not send message to device:", token.Error())
+		topic := topicPrefix + "a/" + msg.Name
+		ms.markSent(topic, b)
+
+		if err := ms.publish(context.Background(), topic, 1, true, b); err != nil {
+			log.Println("Could not send message to device:", err)
 		}
 	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandleSensorValues(t *testing.T) {
+	d, _ := newTestDevice(t)
+	ms := &MQTTServer{}
+	connection := d.connections[0]
+	connection.samples = make(chan receivedSample, 10)
+	controlChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", "", controlChan)
+	viewerChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "bob"}, &Permissions{Role: RoleViewer, Sensors: map[string]bool{"bme.humidity": true}}, "", "", viewerChan)
+
+	// An existing sensor that expects numbers.
+	if _, err := store.AddSensor(d.dbId, "bme.gas", "bme", ValueNumber); err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+
+	ms.handleSensorValues(connection, "bme", DeviceMessage{
+		Message:  "sensorLog",
+		Name:     "bme",
+		Time:     1000,
+		Interval: 60,
+		Values: map[string]interface{}{
+			"temp":     21.5,
+			"humidity": 40.0,
+			"":         1.0,   // no name
+			"pressure": nil,   // no value
+			"gas":      "low", // not a number
+		},
+		Units: map[string]string{"temp": "°C"},
+	}, false)
+
+	// The valid readings are stored as sensors named <topic>.<key>, with the
+	// topic as type and the shared time and interval.
+	for name, expected := range map[string]float64{"bme.temp": 21.5, "bme.humidity": 40.0} {
+		sensor, err := store.GetSensor(d.dbId, name)
+		if err != nil {
+			t.Errorf("sensor %s was not added: %s", name, err)
+			continue
+		}
+		if sensor.sensorType != "bme" || sensor.valueType != ValueNumber {
+			t.Errorf("sensor %s: got type %s with %s values, expected bme with %s values", name, sensor.sensorType, sensor.valueType, ValueNumber)
+		}
+		rows, err := store.FetchSamples(sensor.dbId, 0)
+		if err != nil {
+			t.Fatal("could not fetch samples:", err)
+		}
+		if len(rows) != 1 || rows[0].Time != 1000 || rows[0].Interval != 60 || rows[0].Value != expected {
+			t.Errorf("sensor %s: got samples %+v, expected %v at 1000", name, rows, expected)
+		}
+	}
+	if sensor, err := store.GetSensor(d.dbId, "bme.temp"); err == nil && sensor.unit != "°C" {
+		t.Errorf("got unit %q for bme.temp, expected °C", sensor.unit)
+	}
+	for _, name := range []string{"bme.", "bme.pressure"} {
+		if _, err := store.GetSensor(d.dbId, name); err != errNotFound {
+			t.Errorf("sensor %s: got error %v, expected errNotFound", name, err)
+		}
+	}
+	if sensor, err := store.GetSensor(d.dbId, "bme.gas"); err == nil {
+		if rows, _ := store.FetchSamples(sensor.dbId, 0); len(rows) != 0 {
+			t.Errorf("stored %+v for bme.gas, which expects numbers", rows)
+		}
+	}
+
+	// Setting the unit of the new sensor is sent to the controls first.
+	msg := <-controlChan
+	if sensorMsg, ok := msg.(ControlMessageSensor); !ok || sensorMsg.Sensor.Name != "bme.temp" {
+		t.Errorf("got control message %#v, expected the unit of bme.temp", msg)
+	}
+
+	// Controls get one message with all readings they may read.
+	msg = <-controlChan
+	expected := ControlMessageNewLog{
+		Message: "log",
+		Batch: map[string][]*LogReplyRow{
+			"bme.humidity": {{Time: 1000, Interval: 60, Value: 40.0}},
+			"bme.temp":     {{Time: 1000, Interval: 60, Value: 21.5}},
+		},
+	}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("got control message %#v, expected %#v", msg, expected)
+	}
+	msg = <-viewerChan
+	delete(expected.Batch, "bme.temp")
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("got control message %#v for viewer, expected %#v", msg, expected)
+	}
+	if len(controlChan) != 0 || len(viewerChan) != 0 {
+		t.Errorf("%d and %d more messages sent to the controls", len(controlChan), len(viewerChan))
+	}
+
+	// Every reading is queued for the rules and thermostats.
+	queued := make(map[string]interface{})
+	for len(connection.samples) != 0 {
+		sample := <-connection.samples
+		queued[sample.sensor.name] = sample.value
+	}
+	if !reflect.DeepEqual(queued, map[string]interface{}{"bme.temp": 21.5, "bme.humidity": 40.0}) {
+		t.Errorf("got queued samples %v", queued)
+	}
+
+	// Old (not live) values don't mark the sensors as seen.
+	if len(d.sensorsSeen) != 0 {
+		t.Errorf("sensors marked as seen: %v", d.sensorsSeen)
+	}
+	ms.handleSensorValues(connection, "bme", DeviceMessage{
+		Time:   time.Now().Unix(),
+		Values: map[string]interface{}{"temp": 22.0},
+	}, true)
+	if _, ok := d.sensorsSeen["bme.temp"]; !ok || len(d.sensorsSeen) != 1 {
+		t.Errorf("got sensors seen %v, expected only bme.temp", d.sensorsSeen)
+	}
+}
+
+func TestPublishHandlerRouting(t *testing.T) {
+	house, _ := newTestDevice(t)
+	garage, _ := addDevice(t, "garage", "garage")
+	ms := &MQTTServer{devices: make(map[string]*DeviceConnection)}
+	for prefix, d := range map[string]*Device{"home/": house, "home-garage/": garage} {
+		connection := d.connections[0]
+		connection.samples = make(chan receivedSample, 10)
+		ms.devices[prefix] = connection
+	}
+
+	for _, topic := range []string{"home/s/temp", "home-garage/s/door", "home/s/temp/extra", "home/x/temp", "attic/s/temp"} {
+		ms.publishHandler(nil, fakeMessage{topic: topic, payload: []byte(`{"time": 1000, "value": 20}`)})
+	}
+	expected := map[*Device][]string{house: {"temp"}, garage: {"door"}}
+	for d, names := range expected {
+		sensors, err := store.GetSensors(d.dbId)
+		if err != nil {
+			t.Fatal("could not get sensors:", err)
+		}
+		got := make([]string, len(sensors))
+		for i, sensor := range sensors {
+			got[i] = sensor.name
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("device %s: got sensors %v, expected %v", d.name, got, names)
+		}
+	}
+}
+
+func TestActuatorEcho(t *testing.T) {
+	d, sendChan := newTestDevice(t)
+	ms := &MQTTServer{
+		devices: map[string]*DeviceConnection{"home/": d.connections[0]},
+		sent:    make(map[string][]string),
+	}
+
+	// Two values are published before the broker echoes the first.
+	ms.markSent("home/a/led", []byte(`{"value":"#100000"}`))
+	ms.markSent("home/a/led", []byte(`{"value":"#200000"}`))
+	d.SetActuator("led", "#200000", "user alice")
+	<-sendChan
+	for _, value := range []string{"#100000", "#200000"} {
+		ms.publishHandler(nil, fakeMessage{topic: "home/a/led", payload: []byte(`{"value":"` + value + `"}`)})
+		if actuators := d.Actuators(); actuators["led"] != "#200000" {
+			t.Errorf("echo of %s: got led=%v, expected #200000", value, actuators["led"])
+		}
+	}
+	if len(sendChan) != 0 || len(ms.sent) != 0 {
+		t.Errorf("after the echoes: %d values sent to the device, still waiting for %v", len(sendChan), ms.sent)
+	}
+	if status := d.Status(&Permissions{Role: RoleAdmin}); status.Online {
+		t.Error("echoes marked the device as online")
+	}
+
+	// A value from the device itself.
+	ms.publishHandler(nil, fakeMessage{topic: "home/a/led", payload: []byte(`{"value":"#100000"}`)})
+	if actuators := d.Actuators(); actuators["led"] != "#100000" {
+		t.Errorf("got led=%v from the device, expected #100000", actuators["led"])
+	}
+	if status := d.Status(&Permissions{Role: RoleAdmin}); !status.Online {
+		t.Error("value from the device didn't mark it as online")
+	}
+
+	// Only the last few payloads are remembered.
+	for i := 0; i < MAX_ECHOES+2; i++ {
+		ms.markSent("home/a/fan", []byte{byte('0' + i)})
+	}
+	if sent := ms.sent["home/a/fan"]; len(sent) != MAX_ECHOES || sent[0] != "2" {
+		t.Errorf("got payloads %v waiting for an echo", sent)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var flagHADiscovery = flag.String("homeassistant-discovery", "", "publish Home Assistant MQTT discovery config under this prefix, usually 'homeassistant' (empty to disable)")
+var flagHATopic = flag.String("homeassistant-topic", "domos", "base topic for the states and commands of Home Assistant entities")
+
+const HA_COMMAND_QUEUE = 16 // commands waiting per bridge before new ones are dropped
+
+// homeAssistantUser is the internal user of the Home Assistant bridge. Changes
+// made from Home Assistant appear under this name in the audit log.
+var homeAssistantUser = &User{name: "homeassistant"}
+
+// haBridge makes one device visible in Home Assistant. It is registered as an
+// internal admin control of the device, so it gets the same updates as a
+// browser would, and publishes them on MQTT. Commands from Home Assistant are
+// handled like actuator changes from a control.
+//
+// All messages are published with QoS 0: the bridge receives updates while
+// the device lock is held, so it must never wait for an acknowledgement from
+// the broker. Commands arrive in the MQTT message handler, which must not block
+// either (the broker acknowledgements for the device are delivered by the same
+// goroutine), so they are queued and handled by a separate goroutine.
+type haBridge struct {
+	ms       *MQTTServer
+	control  *ControlConnection
+	topic    string // prefix of state and command topics: <base>/<device ID>/
+	nodeId   string // node ID in discovery topics
+	commands chan haCommand
+
+	lock       sync.Mutex
+	actuators  map[string]interface{} // last actuator values, to pick a component for actuators without a type
+	components map[string]string      // entity key -> component of the published config
+}
+
+// haEntity is the discovery config of one Home Assistant entity.
+type haEntity struct {
+	Name              string           `json:"name"`
+	UniqueId          string           `json:"unique_id"`
+	ObjectId          string           `json:"object_id"`
+	StateTopic        string           `json:"state_topic"`
+	CommandTopic      string           `json:"command_topic,omitempty"`
+	ValueTemplate     string           `json:"value_template,omitempty"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	StateClass        string           `json:"state_class,omitempty"`
+	PayloadOn         string           `json:"payload_on,omitempty"`
+	PayloadOff        string           `json:"payload_off,omitempty"`
+	StateOn           string           `json:"state_on,omitempty"`
+	StateOff          string           `json:"state_off,omitempty"`
+	Min               *int64           `json:"min,omitempty"` // number: lowest value
+	Max               *int64           `json:"max,omitempty"` // number: highest value, text: longest length
+	Options           []string         `json:"options,omitempty"`
+	Pattern           string           `json:"pattern,omitempty"`
+	Availability      []haAvailability `json:"availability"`
+	AvailabilityMode  string           `json:"availability_mode"`
+	Device            haDevice         `json:"device"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// haCommand is a message received on a command topic.
+type haCommand struct {
+	topic   string
+	payload []byte
+}
+
+func newHABridge(ms *MQTTServer, device *Device) *haBridge {
+	b := &haBridge{
+		ms:         ms,
+		topic:      *flagHATopic + "/" + strconv.FormatInt(device.dbId, 10) + "/",
+		nodeId:     "domos_" + strconv.FormatInt(device.dbId, 10),
+		actuators:  make(map[string]interface{}),
+		components: make(map[string]string),
+		commands:   make(chan haCommand, HA_COMMAND_QUEUE),
+	}
+	sendChan := make(chan interface{}, 16)
+	b.control = device.AddControl(homeAssistantUser, &Permissions{Role: RoleAdmin}, "", "", sendChan)
+	go b.run(sendChan)
+	go b.runCommands()
+	return b
+}
+
+// commandTopics returns the topics to subscribe to for commands.
+func (b *haBridge) commandTopics() []string {
+	return []string{b.topic + "actuator/+/set"}
+}
+
+// run publishes the updates the bridge gets as a control. It doesn't take the
+// device lock, as the sender may hold it.
+func (b *haBridge) run(sendChan chan interface{}) {
+	for msg := range sendChan {
+		switch msg := msg.(type) {
+		case MessageValue:
+			if msg.Message == "actuator" {
+				b.publishActuator(msg.Name, msg.Value)
+			}
+		case ControlMessageActuators:
+			for name, value := range msg.Actuators {
+				b.publishActuator(name, value)
+			}
+		case ControlMessageActuatorType:
+			b.lock.Lock()
+			value := b.actuators[msg.Name]
+			b.lock.Unlock()
+			b.publishActuatorConfig(msg.Name, msg.Type, value)
+		case ControlMessageNewLog:
+			if msg.Sensor != "" && len(msg.Log) != 0 {
+				b.publishState("sensor/"+msg.Sensor, msg.Log[len(msg.Log)-1].Value)
+			}
+			for name, rows := range msg.Batch {
+				if len(rows) != 0 {
+					b.publishState("sensor/"+name, rows[len(rows)-1].Value)
+				}
+			}
+		case ControlMessageSensor:
+			b.publishSensorConfig(msg.Sensor)
+		case ControlMessageStatus:
+			if msg.Sensor == "" && (msg.Message == "online" || msg.Message == "offline") {
+				b.publish(b.topic+"availability", []byte(msg.Message))
+			}
+		}
+	}
+}
+
+// publishDiscovery publishes the config of all entities of the device and
+// their current states. It is called every time the MQTT connection is
+// (re)established.
+func (b *haBridge) publishDiscovery() {
+	device := b.control.Device
+	actuators := device.Actuators()
+	actuatorTypes := device.ActuatorTypes()
+	status := device.Status(b.control.permissions)
+
+	if status.Online {
+		b.publish(b.topic+"availability", []byte("online"))
+	} else {
+		b.publish(b.topic+"availability", []byte("offline"))
+	}
+
+	// Only the newest value of every sensor is needed, so fetch just that
+	// instead of a whole log.
+	lastSamples, err := store.GetLastSamples(device.dbId)
+	if err != nil {
+		log.Printf("could not load last samples of device %d: %s", device.dbId, err)
+	}
+	for _, sensor := range device.getSensors() {
+		b.publishSensorConfig(sensor.Info(""))
+		timing, ok := lastSamples[sensor.name]
+		if !ok {
+			continue
+		}
+		rows, err := store.FetchSamples(sensor.dbId, timing.last-1)
+		if err != nil {
+			log.Printf("could not fetch last value of sensor %s: %s", sensor.name, err)
+			continue
+		}
+		if len(rows) != 0 {
+			b.publishState("sensor/"+sensor.name, rows[len(rows)-1].Value)
+		}
+	}
+
+	for name, value := range actuators {
+		b.publishActuatorConfig(name, actuatorTypes[name], value)
+		b.publishActuator(name, value)
+	}
+}
+
+// publishSensorConfig publishes the discovery config of a sensor.
+func (b *haBridge) publishSensorConfig(sensor *SensorInfo) {
+	entity := b.entity("sensor", sensor.Name, sensor.HumanName)
+	component := "sensor"
+	switch sensor.ValueType {
+	case ValueNumber:
+		entity.UnitOfMeasurement = sensor.Unit
+		entity.StateClass = "measurement"
+	case ValueBoolean:
+		component = "binary_sensor"
+		entity.PayloadOn = "true"
+		entity.PayloadOff = "false"
+	case ValueString:
+		entity.ValueTemplate = "{{ value_json }}"
+	case ValueJSON:
+		entity.ValueTemplate = "{{ value_json | tojson }}"
+	}
+	b.publishConfig("sensor/"+sensor.Name, component, entity)
+}
+
+// publishActuatorConfig publishes the discovery config of an actuator. The
+// component follows from the actuator type, or from the current value if the
+// actuator has no type.
+func (b *haBridge) publishActuatorConfig(name string, actuatorType *ActuatorType, value interface{}) {
+	entity := b.entity("actuator", name, "")
+	entity.CommandTopic = b.topic + "actuator/" + name + "/set"
+
+	kind := ""
+	if actuatorType != nil {
+		kind = actuatorType.Type
+	} else {
+		switch value.(type) {
+		case bool:
+			kind = ActuatorBoolean
+		case float64:
+			kind = ActuatorInteger
+		case string:
+			kind = ActuatorString
+		}
+	}
+
+	component := ""
+	switch kind {
+	case ActuatorBoolean:
+		component = "switch"
+		entity.PayloadOn = "true"
+		entity.PayloadOff = "false"
+		entity.StateOn = "true"
+		entity.StateOff = "false"
+	case ActuatorInteger:
+		component = "number"
+		if actuatorType != nil {
+			entity.Min = actuatorType.Min
+			entity.Max = actuatorType.Max
+		}
+	case ActuatorEnum:
+		component = "select"
+		entity.ValueTemplate = "{{ value_json }}"
+		entity.Options = actuatorType.Values
+	case ActuatorColor:
+		component = "text"
+		entity.ValueTemplate = "{{ value_json }}"
+		entity.Pattern = colorPattern.String()
+	case ActuatorString:
+		component = "text"
+		entity.ValueTemplate = "{{ value_json }}"
+		if actuatorType != nil && actuatorType.MaxLength != 0 {
+			maxLength := int64(actuatorType.MaxLength)
+			entity.Max = &maxLength
+		}
+	default:
+		// Nothing Home Assistant could show, like a JSON object.
+		b.removeConfig("actuator/" + name)
+		return
+	}
+	b.publishConfig("actuator/"+name, component, entity)
+}
+
+// entity returns the common part of the discovery config of a sensor or
+// actuator.
+func (b *haBridge) entity(kind, name, humanName string) *haEntity {
+	if humanName == "" {
+		humanName = name
+	}
+	objectId := haObjectId(kind + "_" + name)
+	entity := &haEntity{
+		Name:             humanName,
+		UniqueId:         b.nodeId + "_" + objectId,
+		ObjectId:         b.nodeId + "_" + objectId,
+		StateTopic:       b.topic + kind + "/" + name,
+		Availability:     []haAvailability{{b.topic + "availability"}},
+		AvailabilityMode: "all",
+		Device: haDevice{
+			Identifiers:  []string{b.nodeId},
+			Name:         b.control.name,
+			Manufacturer: "domos",
+		},
+	}
+	if *flagMQTTStatusTopic != "" {
+		// Entities are unavailable when domos itself is gone.
+		entity.Availability = append(entity.Availability, haAvailability{*flagMQTTStatusTopic})
+	}
+	return entity
+}
+
+// publishConfig publishes the discovery config of an entity, removing the
+// config under the old component if the component changed.
+func (b *haBridge) publishConfig(key, component string, entity *haEntity) {
+	b.lock.Lock()
+	oldComponent := b.components[key]
+	b.components[key] = component
+	b.lock.Unlock()
+	if oldComponent != "" && oldComponent != component {
+		b.publish(b.configTopic(oldComponent, key), nil)
+	}
+
+	payload, err := json.Marshal(entity)
+	if err != nil {
+		log.Println("could not encode Home Assistant config:", err)
+		return
+	}
+	b.publish(b.configTopic(component, key), payload)
+}
+
+// removeConfig removes the discovery config of an entity, if it was
+// published.
+func (b *haBridge) removeConfig(key string) {
+	b.lock.Lock()
+	component := b.components[key]
+	delete(b.components, key)
+	b.lock.Unlock()
+	if component != "" {
+		b.publish(b.configTopic(component, key), nil)
+	}
+}
+
+func (b *haBridge) configTopic(component, key string) string {
+	return *flagHADiscovery + "/" + component + "/" + b.nodeId + "/" + haObjectId(key) + "/config"
+}
+
+// publishActuator publishes the state of an actuator.
+func (b *haBridge) publishActuator(name string, value interface{}) {
+	b.lock.Lock()
+	b.actuators[name] = value
+	b.lock.Unlock()
+	b.publishState("actuator/"+name, value)
+}
+
+// publishState publishes the value of a sensor or actuator as JSON.
+func (b *haBridge) publishState(key string, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("could not encode state of %s: %s", key, err)
+		return
+	}
+	b.publish(b.topic+key, payload)
+}
+
+func (b *haBridge) publish(topic string, payload []byte) {
+	err := b.ms.publish(context.Background(), topic, 0, true, payload)
+	if err != nil && *flagVerbose {
+		log.Printf("Could not publish %s: %s", topic, err)
+	}
+}
+
+// queueCommand queues a message on a command topic. It never blocks, so it can
+// be called from the MQTT message handler.
+func (b *haBridge) queueCommand(topic string, payload []byte) {
+	select {
+	case b.commands <- haCommand{topic, payload}:
+	default:
+		log.Println("Home Assistant command queue is full, dropping:", topic)
+	}
+}
+
+// runCommands handles queued commands.
+func (b *haBridge) runCommands() {
+	for command := range b.commands {
+		b.handleCommand(command.topic, command.payload)
+	}
+}
+
+// handleCommand handles a message on a command topic, which is the topic of the
+// actuator state followed by /set.
+func (b *haBridge) handleCommand(topic string, payload []byte) {
+	parts := strings.Split(topic[len(b.topic):], "/")
+	if len(parts) != 3 || parts[0] != "actuator" || parts[2] != "set" {
+		log.Println("unrecognized Home Assistant topic:", topic)
+		return
+	}
+	name := parts[1]
+
+	value := b.parseCommand(name, payload)
+	if err := b.control.CheckActuator(name, value); err != nil {
+		log.Printf("Home Assistant sent invalid value for actuator %s: %s", name, err)
+		// Restore the state in Home Assistant.
+		b.lock.Lock()
+		value, ok := b.actuators[name]
+		b.lock.Unlock()
+		if ok {
+			b.publishState("actuator/"+name, value)
+		}
+		return
+	}
+	// The bridge doesn't get its own change back.
+	b.control.SetActuator(name, value)
+	b.publishActuator(name, value)
+}
+
+// parseCommand converts the payload of a command to an actuator value. Home
+// Assistant sends text and select options as plain strings, everything else is
+// JSON.
+func (b *haBridge) parseCommand(name string, payload []byte) interface{} {
+	actuatorType := b.control.ActuatorTypes()[name]
+	b.lock.Lock()
+	current := b.actuators[name]
+	b.lock.Unlock()
+
+	isString := false
+	if actuatorType != nil {
+		isString = actuatorType.Type == ActuatorEnum || actuatorType.Type == ActuatorColor || actuatorType.Type == ActuatorString
+	} else {
+		_, isString = current.(string)
+	}
+	if isString {
+		return string(payload)
+	}
+	var value interface{}
+	err := json.Unmarshal(payload, &value)
+	if err != nil {
+		return string(payload)
+	}
+	return value
+}
+
+// haObjectId replaces all characters that are not allowed in a discovery
+// topic or object ID.
+func haObjectId(s string) string {
+	return strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' {
+			return c
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTTClient is a connected MQTT client that records the messages
+// published through it.
+type fakeMQTTClient struct {
+	lock      sync.Mutex
+	published map[string][]byte // last payload per topic
+	stalled   bool              // publishing never completes, like with a stalled broker
+}
+
+func newFakeMQTTClient() *fakeMQTTClient {
+	return &fakeMQTTClient{published: make(map[string][]byte)}
+}
+
+func (c *fakeMQTTClient) IsConnected() bool   { return true }
+func (c *fakeMQTTClient) Connect() mqtt.Token { return fakeToken{} }
+func (c *fakeMQTTClient) Disconnect(uint)     {}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch payload := payload.(type) {
+	case []byte:
+		c.published[topic] = payload
+	case string:
+		c.published[topic] = []byte(payload)
+	}
+	if c.stalled {
+		return stalledToken{}
+	}
+	return fakeToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return fakeToken{}
+}
+
+func (c *fakeMQTTClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return fakeToken{}
+}
+
+func (c *fakeMQTTClient) Unsubscribe(...string) mqtt.Token { return fakeToken{} }
+
+// take returns the messages published since the last call.
+func (c *fakeMQTTClient) take() map[string][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	published := c.published
+	c.published = make(map[string][]byte)
+	return published
+}
+
+// fakeToken is a token that has already completed. The embedded (nil) token
+// only provides the unexported method of the interface.
+type fakeToken struct {
+	mqtt.Token
+}
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Error() error                   { return nil }
+
+// stalledToken is a token that never completes.
+type stalledToken struct {
+	mqtt.Token
+}
+
+func (stalledToken) Wait() bool                       { select {} }
+func (stalledToken) WaitTimeout(d time.Duration) bool { time.Sleep(d); return false }
+func (stalledToken) Error() error                     { return nil }
+
+// newTestBridge returns a Home Assistant bridge for a new test device, which
+// publishes to the returned client.
+func newTestBridge(t *testing.T) (*haBridge, *fakeMQTTClient, chan MessageValue) {
+	t.Helper()
+	oldDiscovery := *flagHADiscovery
+	*flagHADiscovery = "homeassistant"
+	t.Cleanup(func() { *flagHADiscovery = oldDiscovery })
+
+	d, sendChan := newTestDevice(t)
+	client := newFakeMQTTClient()
+	b := newHABridge(&MQTTServer{client: client}, d)
+	return b, client, sendChan
+}
+
+func TestHACommandTopics(t *testing.T) {
+	b, _, _ := newTestBridge(t)
+	topics := b.commandTopics()
+	expected := []string{"domos/" + strconv.FormatInt(b.control.dbId, 10) + "/actuator/+/set"}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("got command topics %v, expected %v", topics, expected)
+	}
+}
+
+func TestHAParseCommand(t *testing.T) {
+	b, _, _ := newTestBridge(t)
+	b.control.actuatorTypes["switch"] = &ActuatorType{Type: ActuatorBoolean}
+	b.control.actuatorTypes["dim"] = &ActuatorType{Type: ActuatorInteger}
+	b.control.actuatorTypes["mode"] = &ActuatorType{Type: ActuatorEnum, Values: []string{"auto", "true"}}
+	b.control.actuatorTypes["led"] = &ActuatorType{Type: ActuatorColor}
+	b.control.actuatorTypes["text"] = &ActuatorType{Type: ActuatorString}
+	b.publishActuator("label", "hello")
+	b.publishActuator("level", 3.0)
+
+	tests := []struct {
+		name     string
+		payload  string
+		expected interface{}
+	}{
+		{"switch", "true", true},
+		{"dim", "42", 42.0},
+		{"mode", "true", "true"}, // options are plain strings
+		{"led", "#ff0000", "#ff0000"},
+		{"text", `"quoted"`, `"quoted"`},
+		{"label", "5", "5"}, // no type, but the current value is a string
+		{"level", "5", 5.0},
+		{"level", "five", "five"}, // not JSON
+		{"unknown", `{"a":1}`, map[string]interface{}{"a": 1.0}},
+	}
+	for _, tc := range tests {
+		value := b.parseCommand(tc.name, []byte(tc.payload))
+		if !reflect.DeepEqual(value, tc.expected) {
+			t.Errorf("%s: payload %s parsed as %#v, expected %#v", tc.name, tc.payload, value, tc.expected)
+		}
+	}
+}
+
+func TestHADiscovery(t *testing.T) {
+	b, client, _ := newTestBridge(t)
+	d := b.control.Device
+	temp, err := store.AddSensor(d.dbId, "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	if err := store.UpdateSensor(temp.dbId, "Living room", "°C", nil, nil, nil, 0); err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	for i, value := range []float64{20, 21.5} {
+		if err := store.InsertSample(temp.dbId, time.Duration(100+60*i)*time.Second, 60*time.Second, value); err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+	}
+	if _, err := store.AddSensor(d.dbId, "door", "door", ValueBoolean); err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	max := int64(10)
+	d.actuatorTypes["mode"] = &ActuatorType{Type: ActuatorEnum, Values: []string{"auto", "off"}}
+	d.actuatorTypes["dim"] = &ActuatorType{Type: ActuatorInteger, Max: &max}
+	d.actuators["mode"] = "auto"
+	d.actuators["dim"] = 5.0
+	d.actuators["heater"] = true
+	d.actuators["raw"] = map[string]interface{}{"a": 1.0}
+
+	b.publishDiscovery()
+	published := client.take()
+
+	prefix := "domos/" + strconv.FormatInt(d.dbId, 10) + "/"
+	states := map[string]string{
+		prefix + "availability":    "offline",
+		prefix + "sensor/temp":     "21.5",
+		prefix + "actuator/mode":   `"auto"`,
+		prefix + "actuator/dim":    "5",
+		prefix + "actuator/heater": "true",
+		prefix + "actuator/raw":    `{"a":1}`,
+	}
+	for topic, expected := range states {
+		if payload := string(published[topic]); payload != expected {
+			t.Errorf("%s: got %q, expected %q", topic, payload, expected)
+		}
+	}
+	if _, ok := published[prefix+"sensor/door"]; ok {
+		t.Error("published the state of a sensor without values")
+	}
+
+	configs := map[string]haEntity{
+		"sensor/" + b.nodeId + "/sensor_temp": {
+			Name:              "Living room",
+			StateTopic:        prefix + "sensor/temp",
+			UnitOfMeasurement: "°C",
+			StateClass:        "measurement",
+		},
+		"binary_sensor/" + b.nodeId + "/sensor_door": {
+			Name:       "door",
+			StateTopic: prefix + "sensor/door",
+			PayloadOn:  "true",
+			PayloadOff: "false",
+		},
+		"select/" + b.nodeId + "/actuator_mode": {
+			Name:          "mode",
+			StateTopic:    prefix + "actuator/mode",
+			CommandTopic:  prefix + "actuator/mode/set",
+			ValueTemplate: "{{ value_json }}",
+			Options:       []string{"auto", "off"},
+		},
+		"number/" + b.nodeId + "/actuator_dim": {
+			Name:         "dim",
+			StateTopic:   prefix + "actuator/dim",
+			CommandTopic: prefix + "actuator/dim/set",
+			Max:          &max,
+		},
+		"switch/" + b.nodeId + "/actuator_heater": {
+			Name:         "heater",
+			StateTopic:   prefix + "actuator/heater",
+			CommandTopic: prefix + "actuator/heater/set",
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+			StateOn:      "true",
+			StateOff:     "false",
+		},
+	}
+	for key, expected := range configs {
+		topic := "homeassistant/" + key + "/config"
+		payload, ok := published[topic]
+		if !ok {
+			t.Errorf("%s: no config published", topic)
+			continue
+		}
+		var entity haEntity
+		if err := json.Unmarshal(payload, &entity); err != nil {
+			t.Errorf("%s: could not parse config: %s", topic, err)
+			continue
+		}
+		if entity.UniqueId != entity.ObjectId || !strings.HasPrefix(entity.UniqueId, b.nodeId+"_") {
+			t.Errorf("%s: got unique ID %q and object ID %q", topic, entity.UniqueId, entity.ObjectId)
+		}
+		expectedAvailability := []haAvailability{{prefix + "availability"}, {*flagMQTTStatusTopic}}
+		if !reflect.DeepEqual(entity.Availability, expectedAvailability) || entity.AvailabilityMode != "all" {
+			t.Errorf("%s: got availability %v (%s)", topic, entity.Availability, entity.AvailabilityMode)
+		}
+		if entity.Device.Identifiers[0] != b.nodeId || entity.Device.Name != d.name {
+			t.Errorf("%s: got device %+v", topic, entity.Device)
+		}
+		entity.UniqueId = ""
+		entity.ObjectId = ""
+		entity.Availability = nil
+		entity.AvailabilityMode = ""
+		entity.Device = haDevice{}
+		if !reflect.DeepEqual(entity, expected) {
+			t.Errorf("%s: got config %+v, expected %+v", topic, entity, expected)
+		}
+	}
+	for topic := range published {
+		if strings.HasSuffix(topic, "/actuator_raw/config") {
+			t.Errorf("published config for an actuator with a JSON value: %s", topic)
+		}
+	}
+}
+
+func TestHACommand(t *testing.T) {
+	b, client, sendChan := newTestBridge(t)
+	d := b.control.Device
+	max := int64(10)
+	d.actuatorTypes["dim"] = &ActuatorType{Type: ActuatorInteger, Max: &max}
+	b.publishActuator("dim", 5.0)
+	client.take()
+	stateTopic := b.topic + "actuator/dim"
+
+	// An invalid value isn't sent to the device, and Home Assistant gets the
+	// current state back.
+	b.handleCommand(stateTopic+"/set", []byte("20"))
+	if value := sentActuator(t, sendChan, "dim"); value != nil {
+		t.Errorf("invalid value sent to the device: %v", value)
+	}
+	if payload := string(client.take()[stateTopic]); payload != "5" {
+		t.Errorf("got restored state %q, expected 5", payload)
+	}
+
+	b.handleCommand(stateTopic+"/set", []byte("7"))
+	if value := sentActuator(t, sendChan, "dim"); value != 7.0 {
+		t.Errorf("got value %v sent to the device, expected 7", value)
+	}
+	if payload := string(client.take()[stateTopic]); payload != "7" {
+		t.Errorf("got state %q, expected 7", payload)
+	}
+	if value := d.Actuators()["dim"]; value != 7.0 {
+		t.Errorf("actuator has value %v, expected 7", value)
+	}
+
+	b.handleCommand(b.topic+"actuator/dim", []byte("8"))
+	if value := sentActuator(t, sendChan, "dim"); value != nil {
+		t.Errorf("value from a state topic sent to the device: %v", value)
+	}
+}
+
+func TestHAQueueCommand(t *testing.T) {
+	b := &haBridge{commands: make(chan haCommand, 1)}
+	// Queueing must not block, even when the queue is full.
+	b.queueCommand("domos/1/actuator/dim/set", []byte("1"))
+	b.queueCommand("domos/1/actuator/dim/set", []byte("2"))
+	command := <-b.commands
+	if string(command.payload) != "1" {
+		t.Errorf("got command %s, expected the first one", command.payload)
+	}
+	if len(b.commands) != 0 {
+		t.Errorf("%d commands left in the queue", len(b.commands))
+	}
+}
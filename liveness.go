@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"time"
+)
+
+var flagOfflineAfter = flag.Duration("offline-after", 5*time.Minute, "mark a device or sensor offline after it has sent nothing for this long (0 to disable)")
+
+const LIVENESS_INTERVAL = 10 * time.Second // how often to check for devices that went offline
+
+// DeviceStatus tells whether a device and its sensors are alive. It is only
+// tracked while the server runs, so after a restart every device is offline
+// until it sends something.
+type DeviceStatus struct {
+	Online         bool     `json:"online"`
+	LastSeen       int64    `json:"lastSeen"`       // UNIX time, 0 if not seen yet
+	OfflineSensors []string `json:"offlineSensors"` // sensors that stopped reporting
+}
+
+// markSeen records that the device (and the given sensor, if not empty) is
+// alive, and tells controls when it comes back online.
+func (d *Device) markSeen(sensorName string, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.lastSeen = now
+	if !d.online {
+		if *flagVerbose {
+			log.Printf("Device %s is online", d.name)
+		}
+		d.online = true
+		d.sendStatus("online", "", now)
+		d.notify("online", "Device "+d.name+" is online", "The device is sending messages again.")
+	}
+	if sensorName == "" {
+		return
+	}
+	d.sensorsSeen[sensorName] = now
+	if d.offlineSensors[sensorName] {
+		delete(d.offlineSensors, sensorName)
+		d.sendStatus("online", sensorName, now)
+	}
+}
+
+// markOffline marks the device offline right away, for example when the
+// broker publishes its last will.
+func (d *Device) markOffline() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.online {
+		log.Printf("Device %s went offline", d.name)
+		d.online = false
+		d.sendStatus("offline", "", d.lastSeen)
+		d.notify("offline", "Device "+d.name+" went offline", "The device disconnected from the MQTT broker.")
+	}
+}
+
+// checkLiveness marks the device and its sensors offline when they haven't
+// sent anything for too long.
+func (d *Device) checkLiveness(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.online && now.Sub(d.lastSeen) > *flagOfflineAfter {
+		log.Printf("Device %s went offline: nothing received since %s", d.name, d.lastSeen.Format(time.RFC3339))
+		d.online = false
+		d.sendStatus("offline", "", d.lastSeen)
+		d.notify("offline", "Device "+d.name+" went offline", "Nothing received since "+d.lastSeen.Format(time.RFC1123)+".")
+	}
+	for name, lastSeen := range d.sensorsSeen {
+		if !d.offlineSensors[name] && now.Sub(lastSeen) > *flagOfflineAfter {
+			d.offlineSensors[name] = true
+			d.sendStatus("offline", name, lastSeen)
+		}
+	}
+}
+
+// sendStatus sends a status message (see ControlMessageStatus) to all
+// controls. The lock must be held.
+func (d *Device) sendStatus(message, sensorName string, lastSeen time.Time) {
+	msg := ControlMessageStatus{
+		Message:  message,
+		Sensor:   sensorName,
+		LastSeen: lastSeen.Unix(),
+	}
+	for _, control := range d.controls {
+		if sensorName != "" && !control.permissions.CanReadSensor(sensorName) {
+			continue
+		}
+		control.sendChan <- msg
+	}
+}
+
+// Status returns the liveness of the device and its sensors, leaving out
+// sensors the permissions don't allow to read.
+func (d *Device) Status(permissions *Permissions) *DeviceStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	status := &DeviceStatus{
+		Online:         d.online,
+		OfflineSensors: make([]string, 0, len(d.offlineSensors)),
+	}
+	if !d.lastSeen.IsZero() {
+		status.LastSeen = d.lastSeen.Unix()
+	}
+	for name := range d.offlineSensors {
+		if permissions.CanReadSensor(name) {
+			status.OfflineSensors = append(status.OfflineSensors, name)
+		}
+	}
+	sort.Strings(status.OfflineSensors)
+	return status
+}
+
+// runLiveness periodically checks whether devices are still alive.
+func runLiveness(ds *DeviceSet) {
+	if *flagOfflineAfter <= 0 {
+		return
+	}
+	for {
+		time.Sleep(LIVENESS_INTERVAL)
+		now := time.Now()
+		for _, device := range ds.allDevices() {
+			device.checkLiveness(now)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMessage is a message received from the MQTT broker.
+type fakeMessage struct {
+	mqtt.Message
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return m.payload }
+func (m fakeMessage) Retained() bool  { return m.retained }
+
+// useNotificationSink makes a sink without rate limiting and deduplication the
+// only notification sink for the duration of the test. Nothing delivers the
+// notifications: they stay in the queue.
+func useNotificationSink(t *testing.T) *limitedSink {
+	sink := newLimitedSink(&webhookSink{url: "test"}, 0, 0)
+	oldSinks := notificationSinks
+	notificationSinks = []*limitedSink{sink}
+	t.Cleanup(func() { notificationSinks = oldSinks })
+	return sink
+}
+
+// takeNotifications returns the kinds of the queued notifications.
+func takeNotifications(sink *limitedSink) []string {
+	var kinds []string
+	for {
+		select {
+		case n := <-sink.queue:
+			kinds = append(kinds, n.Kind)
+		default:
+			return kinds
+		}
+	}
+}
+
+// takeStatus returns the status messages sent to the control since the last
+// call.
+func takeStatus(controlChan chan interface{}) []ControlMessageStatus {
+	var messages []ControlMessageStatus
+	for {
+		select {
+		case msg := <-controlChan:
+			if status, ok := msg.(ControlMessageStatus); ok {
+				messages = append(messages, status)
+			}
+		default:
+			return messages
+		}
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	oldOfflineAfter := *flagOfflineAfter
+	*flagOfflineAfter = 5 * time.Minute
+	defer func() { *flagOfflineAfter = oldOfflineAfter }()
+	sink := useNotificationSink(t)
+	d, _ := newTestDevice(t)
+	controlChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", "", controlChan)
+
+	seen := time.Unix(1000, 0)
+	d.markSeen("temp", seen)
+	if status := takeStatus(controlChan); !reflect.DeepEqual(status, []ControlMessageStatus{{Message: "online", LastSeen: 1000}}) {
+		t.Errorf("first message: got status messages %+v", status)
+	}
+	if kinds := takeNotifications(sink); !reflect.DeepEqual(kinds, []string{"online"}) {
+		t.Errorf("first message: got notifications %v", kinds)
+	}
+
+	// Still online right at the boundary.
+	d.checkLiveness(seen.Add(*flagOfflineAfter))
+	if status := takeStatus(controlChan); len(status) != 0 {
+		t.Errorf("at the boundary: got status messages %+v", status)
+	}
+	if !d.Status(&Permissions{Role: RoleAdmin}).Online {
+		t.Error("offline at the boundary")
+	}
+
+	// Offline just after it, and only once.
+	for i := 0; i < 3; i++ {
+		d.checkLiveness(seen.Add(*flagOfflineAfter + time.Duration(i+1)*time.Second))
+	}
+	expected := []ControlMessageStatus{
+		{Message: "offline", LastSeen: 1000},
+		{Message: "offline", Sensor: "temp", LastSeen: 1000},
+	}
+	if status := takeStatus(controlChan); !reflect.DeepEqual(status, expected) {
+		t.Errorf("after the boundary: got status messages %+v, expected %+v", status, expected)
+	}
+	if kinds := takeNotifications(sink); !reflect.DeepEqual(kinds, []string{"offline"}) {
+		t.Errorf("after the boundary: got notifications %v", kinds)
+	}
+	status := d.Status(&Permissions{Role: RoleAdmin})
+	if status.Online || status.LastSeen != 1000 || !reflect.DeepEqual(status.OfflineSensors, []string{"temp"}) {
+		t.Errorf("after the boundary: got status %+v", status)
+	}
+	if status := d.Status(&Permissions{Role: RoleViewer, Sensors: map[string]bool{"humidity": true}}); len(status.OfflineSensors) != 0 {
+		t.Errorf("viewer got offline sensors %v", status.OfflineSensors)
+	}
+
+	// Back online with the next message.
+	d.markSeen("temp", seen.Add(time.Hour))
+	expected = []ControlMessageStatus{
+		{Message: "online", LastSeen: 4600},
+		{Message: "online", Sensor: "temp", LastSeen: 4600},
+	}
+	if status := takeStatus(controlChan); !reflect.DeepEqual(status, expected) {
+		t.Errorf("back online: got status messages %+v, expected %+v", status, expected)
+	}
+	if kinds := takeNotifications(sink); !reflect.DeepEqual(kinds, []string{"online"}) {
+		t.Errorf("back online: got notifications %v", kinds)
+	}
+	status = d.Status(&Permissions{Role: RoleAdmin})
+	if !status.Online || status.LastSeen != 4600 || len(status.OfflineSensors) != 0 {
+		t.Errorf("back online: got status %+v", status)
+	}
+}
+
+func TestLivenessRetained(t *testing.T) {
+	useNotificationSink(t)
+	d, _ := newTestDevice(t)
+	connection := d.connections[0]
+	connection.samples = make(chan receivedSample, 10)
+	ms := &MQTTServer{devices: map[string]*DeviceConnection{"house/": connection}}
+
+	// The broker sends retained messages when subscribing, which may be
+	// from long ago.
+	for _, msg := range []fakeMessage{
+		{topic: "house/status", payload: []byte("online"), retained: true},
+		{topic: "house/s/temp", payload: []byte(`{"time": 1000, "value": 21.5}`), retained: true},
+		{topic: "house/s/bme", payload: []byte(`{"time": 1000, "values": {"humidity": 40}}`), retained: true},
+		{topic: "house/a/led", payload: []byte(`{"value": "#000000"}`), retained: true},
+	} {
+		ms.publishHandler(nil, msg)
+		if status := d.Status(&Permissions{Role: RoleAdmin}); status.Online || status.LastSeen != 0 {
+			t.Errorf("retained message on %s: got status %+v", msg.topic, status)
+		}
+	}
+	if len(d.sensorsSeen) != 0 {
+		t.Errorf("retained messages marked sensors as seen: %v", d.sensorsSeen)
+	}
+
+	ms.publishHandler(nil, fakeMessage{topic: "house/s/temp", payload: []byte(`{"time": 2000, "value": 22}`)})
+	if status := d.Status(&Permissions{Role: RoleAdmin}); !status.Online {
+		t.Errorf("live message: got status %+v", status)
+	}
+	if _, ok := d.sensorsSeen["temp"]; !ok || len(d.sensorsSeen) != 1 {
+		t.Errorf("got sensors seen %v, expected only temp", d.sensorsSeen)
+	}
+
+	// The last will of the device.
+	ms.publishHandler(nil, fakeMessage{topic: "house/status", payload: []byte("offline"), retained: true})
+	if status := d.Status(&Permissions{Role: RoleAdmin}); status.Online {
+		t.Errorf("last will: got status %+v", status)
+	}
+}
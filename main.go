@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -12,11 +12,10 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var flagLogType = flag.String("logtype", "sqlite3", "database type for logfile")
-var flagLogPath = flag.String("log", "", "log address")
+var flagLogType = flag.String("logtype", "sqlite3", "database type for logfile (sqlite3, postgres, memory)")
+var flagLogPath = flag.String("log", "", "log address (file name or connection string)")
 var flagServer = flag.String("server", "unix:/run/domos/domos.sock", "server address in the form type:address (e.g. unix:/path)")
 var flagMQTT = flag.String("mqtt", "tcp://localhost:1883", "MQTT URL")
 var flagMQTTID = flag.String("mqtt-id", "domo-server", "MQTT client ID")
@@ -25,59 +24,116 @@ var flagMQTTPass = flag.String("mqtt-pass", "", "MQTT password")
 var flagMQTTTopicPrefix = flag.String("mqtt-topic-prefix", "", "MQTT topic prefix (e.g. /user/location)")
 var flagPassword = flag.String("password", "", "password of the device")
 var flagVerbose = flag.Bool("verbose", false, "verbose logging")
+var flagDevices deviceList
+
+func init() {
+	flag.Var(&flagDevices, "device", "device in the form topicprefix:password (may be repeated)")
+}
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-var db *sql.DB
-
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, commandUsage)
+	}
 	flag.Parse()
 
-	addressParts := strings.SplitN(*flagServer, ":", 2)
-	if *flagLogPath == "" {
+	if *flagLogPath == "" && *flagLogType != "memory" {
 		fmt.Fprintln(os.Stderr, "Empty log path argument.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+
+	// open database
+	var err error
+	store, err = openStore(*flagLogType, *flagLogPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.NArg() != 0 {
+		err := runCommand(flag.Args())
+		store.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	addressParts := strings.SplitN(*flagServer, ":", 2)
 	if len(addressParts) != 2 || addressParts[0] == "" || addressParts[1] == "" {
 		fmt.Fprintln(os.Stderr, "Invalid address argument.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	if len(*flagPassword) == 0 {
-		fmt.Fprintln(os.Stderr, "No password for the device.")
+	if len(*flagPassword) != 0 || len(*flagMQTTTopicPrefix) != 0 {
+		// Single device configured the old way.
+		if len(*flagPassword) == 0 {
+			fmt.Fprintln(os.Stderr, "No password for the device.")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		if len(*flagMQTTTopicPrefix) == 0 {
+			fmt.Fprintln(os.Stderr, "No MQTT topic prefix.")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		err := flagDevices.Set(*flagMQTTTopicPrefix + ":" + *flagPassword)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if len(flagDevices) == 0 {
+		fmt.Fprintln(os.Stderr, "No devices configured.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	if len(*flagMQTTTopicPrefix) == 0 {
-		fmt.Fprintln(os.Stderr, "No MQTT topic prefix.")
+
+	if *flagHADiscovery != "" && *flagHATopic == "" {
+		fmt.Fprintln(os.Stderr, "No base topic for Home Assistant.")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	// open database
-	var err error
-	db, err = sql.Open(*flagLogType, *flagLogPath)
+	err = setupNotifications()
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	device := NewDeviceSet().getDevice(*flagPassword, "", true)
-	if device == nil {
-		log.Fatal("Could not load device, exiting.")
+	go runRollups()
+
+	deviceSet := NewDeviceSet()
+	devices := make(map[string]*Device, len(flagDevices))
+	for _, spec := range flagDevices {
+		device := deviceSet.getDevice(spec.password, strings.TrimSuffix(spec.topicPrefix, "/"), true)
+		if device == nil {
+			log.Fatalf("Could not load device %s, exiting.", spec.topicPrefix)
+		}
+		devices[spec.topicPrefix] = device
 	}
+	go runThermostats(deviceSet)
+	go runSchedules(deviceSet)
+	go runLiveness(deviceSet)
+	go runStaleCheck(deviceSet)
+	go runTokenCheck(deviceSet)
 
 	serverType := addressParts[0]
 	serverAddress := addressParts[1]
 
 	router := mux.NewRouter()
 	router.HandleFunc("/api/ws/control", func(w http.ResponseWriter, r *http.Request) {
-		ControlServer(w, r, device)
+		ControlServer(w, r, deviceSet)
 	})
+	addRESTRoutes(router, deviceSet)
 
-	go serveMQTT(*flagMQTT, *flagMQTTID, *flagMQTTUser, *flagMQTTPass, *flagMQTTTopicPrefix, device)
+	go serveMQTT(*flagMQTT, *flagMQTTID, *flagMQTTUser, *flagMQTTPass, devices)
 
 	if serverType == "unix" {
 		err := os.Remove(serverAddress)
@@ -103,3 +159,45 @@ func main() {
 		log.Fatal("error while serving: ", err)
 	}
 }
+
+type deviceSpec struct {
+	topicPrefix string
+	password    string
+}
+
+// deviceList implements flag.Value for the repeatable -device flag.
+type deviceList []deviceSpec
+
+func (l *deviceList) String() string {
+	prefixes := make([]string, len(*l))
+	for i, spec := range *l {
+		prefixes[i] = spec.topicPrefix
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (l *deviceList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("expected device in the form topicprefix:password")
+	}
+	prefix := parts[0]
+	if prefix[len(prefix)-1] != '/' {
+		prefix += "/"
+	}
+	for _, spec := range *l {
+		if spec.topicPrefix == prefix {
+			return fmt.Errorf("duplicate topic prefix: %s", prefix)
+		}
+		// Messages are routed by prefix, so one device may not receive the
+		// messages of another.
+		if strings.HasPrefix(prefix, spec.topicPrefix) || strings.HasPrefix(spec.topicPrefix, prefix) {
+			return fmt.Errorf("topic prefix %s overlaps with %s", prefix, spec.topicPrefix)
+		}
+		if spec.password == parts[1] {
+			return fmt.Errorf("duplicate password for topic prefix: %s", prefix)
+		}
+	}
+	*l = append(*l, deviceSpec{prefix, parts[1]})
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceList(t *testing.T) {
+	var l deviceList
+	for _, value := range []string{"home:secret1", "garage/:secret2", "homes/:secret3"} {
+		if err := l.Set(value); err != nil {
+			t.Errorf("Set(%q): %s", value, err)
+		}
+	}
+	expected := deviceList{{"home/", "secret1"}, {"garage/", "secret2"}, {"homes/", "secret3"}}
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("got devices %+v, expected %+v", l, expected)
+	}
+	if got := l.String(); got != "home/,garage/,homes/" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, value := range []string{
+		"",
+		"home",
+		":secret",
+		"attic:",
+		"home/:secret4",       // duplicate prefix
+		"attic:secret1",       // duplicate password
+		"home/garage:secret4", // within another prefix
+		"garage/car/:secret4", // within another prefix
+		"homes/x/:secret4",    // within another prefix
+	} {
+		if err := l.Set(value); err == nil {
+			t.Errorf("Set(%q): expected an error", value)
+		}
+	}
+	if len(l) != 3 {
+		t.Errorf("got %d devices after invalid values, expected 3", len(l))
+	}
+}
@@ -0,0 +1,966 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in memory. It is useful for
+// testing and for running without a database, but forgets everything on exit.
+type memoryStore struct {
+	lock             sync.Mutex
+	nextDeviceId     int64
+	nextSensorId     int64
+	devices          map[int64]*memoryDevice
+	actuators        map[int64]map[string]interface{}   // key is the device ID
+	actuatorTypes    map[int64]map[string]*ActuatorType // key is the device ID
+	changes          map[int64][]*ActuatorChange        // key is the device ID
+	nextRuleId       int64
+	rules            map[int64]map[int64]*Rule // device ID -> rule ID -> rule
+	nextThermostatId int64
+	thermostats      map[int64]map[int64]*Thermostat // device ID -> thermostat ID -> thermostat
+	nextScheduleId   int64
+	schedules        map[int64]map[int64]*Schedule // device ID -> schedule ID -> schedule
+	nextSceneId      int64
+	scenes           map[int64]map[int64]*Scene // device ID -> scene ID -> scene
+	nextAlarmId      int64
+	alarms           map[int64]map[int64]*Alarm // device ID -> alarm ID -> alarm
+	sensors          map[int64]*Sensor
+	samples          map[int64][]memorySample                 // key is the sensor ID
+	lastSamples      map[int64]sampleTiming                   // key is the sensor ID, kept when samples are pruned
+	rollups          map[historyTier]map[int64][]memoryRollup // key is the sensor ID
+	nextUserId       int64
+	nextTokenId      int64
+	users            map[int64]*User
+	userDevices      map[int64]map[int64]*Permissions // user ID -> device ID -> permissions
+	tokens           map[int64]*memoryToken
+}
+
+type memoryDevice struct {
+	serial string
+	name   string
+}
+
+type memorySample struct {
+	time     time.Duration
+	interval time.Duration
+	value    interface{}
+}
+
+type memoryToken struct {
+	Token
+	hash string
+}
+
+type memoryRollup struct {
+	time   time.Duration
+	min    float64
+	max    float64
+	sum    float64
+	weight float64
+	count  int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		nextDeviceId:     1,
+		nextSensorId:     1,
+		devices:          make(map[int64]*memoryDevice),
+		actuators:        make(map[int64]map[string]interface{}),
+		actuatorTypes:    make(map[int64]map[string]*ActuatorType),
+		changes:          make(map[int64][]*ActuatorChange),
+		nextRuleId:       1,
+		rules:            make(map[int64]map[int64]*Rule),
+		nextThermostatId: 1,
+		thermostats:      make(map[int64]map[int64]*Thermostat),
+		nextScheduleId:   1,
+		schedules:        make(map[int64]map[int64]*Schedule),
+		nextSceneId:      1,
+		scenes:           make(map[int64]map[int64]*Scene),
+		nextAlarmId:      1,
+		alarms:           make(map[int64]map[int64]*Alarm),
+		sensors:          make(map[int64]*Sensor),
+		samples:          make(map[int64][]memorySample),
+		lastSamples:      make(map[int64]sampleTiming),
+		rollups: map[historyTier]map[int64][]memoryRollup{
+			tierHourly: make(map[int64][]memoryRollup),
+			tierDaily:  make(map[int64][]memoryRollup),
+		},
+		nextUserId:  1,
+		nextTokenId: 1,
+		users:       make(map[int64]*User),
+		userDevices: make(map[int64]map[int64]*Permissions),
+		tokens:      make(map[int64]*memoryToken),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) GetDevice(serial string) (int64, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, device := range s.devices {
+		if device.serial == serial {
+			return id, device.name, nil
+		}
+	}
+	return 0, "", errNotFound
+}
+
+func (s *memoryStore) GetDevices() (map[int64]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	devices := make(map[int64]string, len(s.devices))
+	for id, device := range s.devices {
+		devices[id] = device.name
+	}
+	return devices, nil
+}
+
+func (s *memoryStore) AddDevice(serial, name string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, device := range s.devices {
+		if device.serial == serial {
+			return 0, errors.New("device already exists")
+		}
+	}
+	id := s.nextDeviceId
+	s.nextDeviceId++
+	s.devices[id] = &memoryDevice{serial, name}
+	return id, nil
+}
+
+func (s *memoryStore) SetDeviceName(id int64, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	device, ok := s.devices[id]
+	if !ok {
+		return errNotFound
+	}
+	device.name = name
+	return nil
+}
+
+func (s *memoryStore) SetDeviceSerial(id int64, serial string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	device, ok := s.devices[id]
+	if !ok {
+		return errNotFound
+	}
+	device.serial = serial
+	return nil
+}
+
+func (s *memoryStore) GetActuators(deviceId int64) (map[string]interface{}, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	actuators := make(map[string]interface{}, len(s.actuators[deviceId]))
+	for name, value := range s.actuators[deviceId] {
+		actuators[name] = value
+	}
+	return actuators, nil
+}
+
+func (s *memoryStore) SetActuator(deviceId int64, name string, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.actuators[deviceId] == nil {
+		s.actuators[deviceId] = make(map[string]interface{})
+	}
+	s.actuators[deviceId][name] = value
+	return nil
+}
+
+func (s *memoryStore) GetActuatorTypes(deviceId int64) (map[string]*ActuatorType, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	actuatorTypes := make(map[string]*ActuatorType, len(s.actuatorTypes[deviceId]))
+	for name, actuatorType := range s.actuatorTypes[deviceId] {
+		actuatorTypes[name] = actuatorType
+	}
+	return actuatorTypes, nil
+}
+
+func (s *memoryStore) SetActuatorType(deviceId int64, name string, actuatorType *ActuatorType) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if actuatorType == nil {
+		delete(s.actuatorTypes[deviceId], name)
+		return nil
+	}
+	if s.actuatorTypes[deviceId] == nil {
+		s.actuatorTypes[deviceId] = make(map[string]*ActuatorType)
+	}
+	s.actuatorTypes[deviceId][name] = actuatorType
+	return nil
+}
+
+func (s *memoryStore) AddActuatorChange(deviceId int64, change *ActuatorChange) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	changeCopy := *change
+	changes := s.changes[deviceId]
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].Time > change.Time
+	})
+	changes = append(changes, nil)
+	copy(changes[i+1:], changes[i:])
+	changes[i] = &changeCopy
+	s.changes[deviceId] = changes
+	return nil
+}
+
+func (s *memoryStore) GetActuatorChanges(deviceId int64, name string, start, end time.Duration, limit int) ([]*ActuatorChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Walk back from the newest change, so that the newest changes are kept
+	// when there are more than the limit.
+	changes := make([]*ActuatorChange, 0)
+	all := s.changes[deviceId]
+	for i := len(all) - 1; i >= 0 && len(changes) < limit; i-- {
+		change := all[i]
+		changeTime := time.Duration(change.Time) * time.Second
+		if changeTime < start || changeTime >= end || (name != "" && change.Name != name) {
+			continue
+		}
+		changeCopy := *change
+		changes = append(changes, &changeCopy)
+	}
+	reverseActuatorChanges(changes)
+	return changes, nil
+}
+
+func (s *memoryStore) GetRules(deviceId int64) ([]*Rule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rules := make([]*Rule, 0, len(s.rules[deviceId]))
+	for _, rule := range s.rules[deviceId] {
+		ruleCopy := *rule
+		rules = append(rules, &ruleCopy)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Id < rules[j].Id
+	})
+	return rules, nil
+}
+
+func (s *memoryStore) SaveRule(deviceId int64, rule *Rule) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ruleCopy := *rule
+	if ruleCopy.Id == 0 {
+		ruleCopy.Id = s.nextRuleId
+		s.nextRuleId++
+	} else if s.rules[deviceId][ruleCopy.Id] == nil {
+		return 0, errNotFound
+	}
+	if s.rules[deviceId] == nil {
+		s.rules[deviceId] = make(map[int64]*Rule)
+	}
+	s.rules[deviceId][ruleCopy.Id] = &ruleCopy
+	return ruleCopy.Id, nil
+}
+
+func (s *memoryStore) DeleteRule(deviceId, ruleId int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.rules[deviceId][ruleId] == nil {
+		return errNotFound
+	}
+	delete(s.rules[deviceId], ruleId)
+	return nil
+}
+
+func (s *memoryStore) GetThermostats(deviceId int64) ([]*Thermostat, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	thermostats := make([]*Thermostat, 0, len(s.thermostats[deviceId]))
+	for _, thermostat := range s.thermostats[deviceId] {
+		thermostatCopy := *thermostat
+		thermostats = append(thermostats, &thermostatCopy)
+	}
+	sort.Slice(thermostats, func(i, j int) bool {
+		return thermostats[i].Id < thermostats[j].Id
+	})
+	return thermostats, nil
+}
+
+func (s *memoryStore) SaveThermostat(deviceId int64, thermostat *Thermostat) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, other := range s.thermostats[deviceId] {
+		if other.Sensor == thermostat.Sensor && other.Id != thermostat.Id {
+			return 0, errors.New("sensor already has a thermostat")
+		}
+	}
+	thermostatCopy := *thermostat
+	if thermostatCopy.Id == 0 {
+		thermostatCopy.Id = s.nextThermostatId
+		s.nextThermostatId++
+	} else if s.thermostats[deviceId][thermostatCopy.Id] == nil {
+		return 0, errNotFound
+	}
+	if s.thermostats[deviceId] == nil {
+		s.thermostats[deviceId] = make(map[int64]*Thermostat)
+	}
+	s.thermostats[deviceId][thermostatCopy.Id] = &thermostatCopy
+	return thermostatCopy.Id, nil
+}
+
+func (s *memoryStore) DeleteThermostat(deviceId, thermostatId int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.thermostats[deviceId][thermostatId] == nil {
+		return errNotFound
+	}
+	delete(s.thermostats[deviceId], thermostatId)
+	return nil
+}
+
+func (s *memoryStore) GetSchedules(deviceId int64) ([]*Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	schedules := make([]*Schedule, 0, len(s.schedules[deviceId]))
+	for _, schedule := range s.schedules[deviceId] {
+		scheduleCopy := *schedule
+		schedules = append(schedules, &scheduleCopy)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Id < schedules[j].Id
+	})
+	return schedules, nil
+}
+
+func (s *memoryStore) SaveSchedule(deviceId int64, schedule *Schedule) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	scheduleCopy := *schedule
+	if scheduleCopy.Id == 0 {
+		scheduleCopy.Id = s.nextScheduleId
+		s.nextScheduleId++
+	} else if s.schedules[deviceId][scheduleCopy.Id] == nil {
+		return 0, errNotFound
+	}
+	if s.schedules[deviceId] == nil {
+		s.schedules[deviceId] = make(map[int64]*Schedule)
+	}
+	s.schedules[deviceId][scheduleCopy.Id] = &scheduleCopy
+	return scheduleCopy.Id, nil
+}
+
+func (s *memoryStore) DeleteSchedule(deviceId, scheduleId int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.schedules[deviceId][scheduleId] == nil {
+		return errNotFound
+	}
+	delete(s.schedules[deviceId], scheduleId)
+	return nil
+}
+
+// copyScene returns a deep copy of the scene, so callers can't modify the
+// stored actuator values.
+func copyScene(scene *Scene) *Scene {
+	sceneCopy := *scene
+	sceneCopy.Actuators = make(map[string]interface{}, len(scene.Actuators))
+	for name, value := range scene.Actuators {
+		sceneCopy.Actuators[name] = value
+	}
+	return &sceneCopy
+}
+
+func (s *memoryStore) GetScenes(deviceId int64) ([]*Scene, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	scenes := make([]*Scene, 0, len(s.scenes[deviceId]))
+	for _, scene := range s.scenes[deviceId] {
+		scenes = append(scenes, copyScene(scene))
+	}
+	sort.Slice(scenes, func(i, j int) bool {
+		return scenes[i].Id < scenes[j].Id
+	})
+	return scenes, nil
+}
+
+func (s *memoryStore) SaveScene(deviceId int64, scene *Scene) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, other := range s.scenes[deviceId] {
+		if other.Name == scene.Name && other.Id != scene.Id {
+			return 0, errors.New("scene name already in use")
+		}
+	}
+	sceneCopy := copyScene(scene)
+	if sceneCopy.Id == 0 {
+		sceneCopy.Id = s.nextSceneId
+		s.nextSceneId++
+	} else if s.scenes[deviceId][sceneCopy.Id] == nil {
+		return 0, errNotFound
+	}
+	if s.scenes[deviceId] == nil {
+		s.scenes[deviceId] = make(map[int64]*Scene)
+	}
+	s.scenes[deviceId][sceneCopy.Id] = sceneCopy
+	return sceneCopy.Id, nil
+}
+
+func (s *memoryStore) DeleteScene(deviceId, sceneId int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.scenes[deviceId][sceneId] == nil {
+		return errNotFound
+	}
+	delete(s.scenes[deviceId], sceneId)
+	return nil
+}
+
+func (s *memoryStore) GetOpenAlarms(deviceId int64) ([]*Alarm, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	alarms := make([]*Alarm, 0)
+	for _, alarm := range s.alarms[deviceId] {
+		if alarm.State != AlarmCleared {
+			alarmCopy := *alarm
+			alarms = append(alarms, &alarmCopy)
+		}
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].Id < alarms[j].Id
+	})
+	return alarms, nil
+}
+
+func (s *memoryStore) SaveAlarm(deviceId int64, alarm *Alarm) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	alarmCopy := *alarm
+	if alarmCopy.Id == 0 {
+		alarmCopy.Id = s.nextAlarmId
+		s.nextAlarmId++
+	} else if s.alarms[deviceId][alarmCopy.Id] == nil {
+		return 0, errNotFound
+	}
+	if s.alarms[deviceId] == nil {
+		s.alarms[deviceId] = make(map[int64]*Alarm)
+	}
+	s.alarms[deviceId][alarmCopy.Id] = &alarmCopy
+	return alarmCopy.Id, nil
+}
+
+func (s *memoryStore) GetSensors(deviceId int64) ([]*Sensor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sensors := make([]*Sensor, 0, 1)
+	for _, sensor := range s.sensors {
+		if sensor.deviceId == deviceId {
+			sensorCopy := *sensor
+			sensors = append(sensors, &sensorCopy)
+		}
+	}
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].dbId < sensors[j].dbId
+	})
+	return sensors, nil
+}
+
+func (s *memoryStore) GetSensor(deviceId int64, name string) (*Sensor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sensor := s.findSensor(deviceId, name)
+	if sensor == nil {
+		return nil, errNotFound
+	}
+	sensorCopy := *sensor
+	return &sensorCopy, nil
+}
+
+// findSensor returns the stored sensor, or nil. The lock must be held.
+func (s *memoryStore) findSensor(deviceId int64, name string) *Sensor {
+	for _, sensor := range s.sensors {
+		if sensor.deviceId == deviceId && sensor.name == name {
+			return sensor
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AddSensor(deviceId int64, name, sensorType, valueType string) (*Sensor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.findSensor(deviceId, name) != nil {
+		return nil, errors.New("sensor already exists")
+	}
+	sensor := &Sensor{
+		deviceId:   deviceId,
+		dbId:       s.nextSensorId,
+		name:       name,
+		sensorType: sensorType,
+		valueType:  valueType,
+	}
+	s.nextSensorId++
+	s.sensors[sensor.dbId] = sensor
+	sensorCopy := *sensor
+	return &sensorCopy, nil
+}
+
+func (s *memoryStore) UpdateSensor(sensorId int64, humanName, unit string, desiredValue, alarmMin, alarmMax interface{}, alarmHysteresis float64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sensor, ok := s.sensors[sensorId]
+	if !ok {
+		return errNotFound
+	}
+	sensor.humanName = humanName
+	sensor.unit = unit
+	sensor.desiredValue = desiredValue
+	sensor.alarmMin = alarmMin
+	sensor.alarmMax = alarmMax
+	sensor.alarmHysteresis = alarmHysteresis
+	return nil
+}
+
+func (s *memoryStore) InsertSample(sensorId int64, logtime, interval time.Duration, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.sensors[sensorId]; !ok {
+		return errNotFound
+	}
+	samples := s.samples[sensorId]
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].time > logtime
+	})
+	samples = append(samples, memorySample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = memorySample{logtime, interval, value}
+	s.samples[sensorId] = samples
+	if last, ok := s.lastSamples[sensorId]; !ok || last.last <= logtime {
+		s.lastSamples[sensorId] = sampleTiming{logtime, interval}
+	}
+	return nil
+}
+
+func (s *memoryStore) FetchSamples(sensorId int64, since time.Duration) ([]LogReplyRow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	samples := s.samples[sensorId]
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].time > since
+	})
+	rows := make([]LogReplyRow, 0, len(samples)-i)
+	for _, sample := range samples[i:] {
+		rows = append(rows, LogReplyRow{
+			Time:     int64(sample.time / time.Second),
+			Interval: int64(sample.interval / time.Second),
+			Value:    sample.value,
+		})
+	}
+	return rows, nil
+}
+
+func (s *memoryStore) GetLastSamples(deviceId int64) (map[string]sampleTiming, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	timings := make(map[string]sampleTiming)
+	for sensorId, last := range s.lastSamples {
+		sensor := s.sensors[sensorId]
+		if sensor.deviceId == deviceId {
+			timings[sensor.name] = last
+		}
+	}
+	return timings, nil
+}
+
+// rollup returns the given samples as rollup rows, bucketed by the period.
+// The samples must be sorted by time.
+func (s *memoryStore) rollup(samples []memoryRollup, from, until, period time.Duration) []memoryRollup {
+	rows := make([]memoryRollup, 0)
+	for _, sample := range samples {
+		if sample.time < from || sample.time >= until {
+			continue
+		}
+		bucketTime := sample.time / period * period
+		if len(rows) == 0 || rows[len(rows)-1].time != bucketTime {
+			sample.time = bucketTime
+			rows = append(rows, sample)
+			continue
+		}
+		row := &rows[len(rows)-1]
+		if sample.min < row.min {
+			row.min = sample.min
+		}
+		if sample.max > row.max {
+			row.max = sample.max
+		}
+		row.sum += sample.sum
+		row.weight += sample.weight
+		row.count += sample.count
+	}
+	return rows
+}
+
+// tierRows returns all rows of a tier for one sensor, as rollup rows. The lock
+// must be held.
+func (s *memoryStore) tierRows(sensorId int64, tier historyTier) []memoryRollup {
+	if tier != tierRaw {
+		return s.rollups[tier][sensorId]
+	}
+	rows := make([]memoryRollup, 0, len(s.samples[sensorId]))
+	for _, sample := range s.samples[sensorId] {
+		value, ok := sample.value.(float64)
+		if !ok {
+			continue
+		}
+		weight := float64(sample.interval)
+		if sample.interval <= 0 {
+			weight = float64(time.Second)
+		}
+		rows = append(rows, memoryRollup{sample.time, value, value, value * weight, weight, 1})
+	}
+	return rows
+}
+
+func (s *memoryStore) FetchHistory(sensorId int64, tier historyTier, start, end, bucket time.Duration) ([]HistoryBucket, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rows := s.rollup(s.tierRows(sensorId, tier), start, end, bucket)
+	buckets := make([]HistoryBucket, len(rows))
+	for i, row := range rows {
+		buckets[i] = HistoryBucket{
+			Time:   int64(row.time / time.Second),
+			Count:  row.count,
+			Min:    row.min,
+			Avg:    row.sum / row.weight,
+			Max:    row.max,
+			sum:    row.sum,
+			weight: row.weight,
+		}
+	}
+	return buckets, nil
+}
+
+func (s *memoryStore) LastRollup(tier historyTier) (time.Duration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var last time.Duration
+	for _, rows := range s.rollups[tier] {
+		if len(rows) != 0 && rows[len(rows)-1].time > last {
+			last = rows[len(rows)-1].time
+		}
+	}
+	return last, nil
+}
+
+func (s *memoryStore) Rollup(tier historyTier, from, until time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for sensorId := range s.sensors {
+		rows := s.rollup(s.tierRows(sensorId, tier-1), from, until, tier.period())
+		// Replace the rows in [from, until) with the new rows.
+		existing := s.rollups[tier][sensorId]
+		merged := make([]memoryRollup, 0, len(existing)+len(rows))
+		for _, row := range existing {
+			if row.time < from {
+				merged = append(merged, row)
+			}
+		}
+		merged = append(merged, rows...)
+		for _, row := range existing {
+			if row.time >= until {
+				merged = append(merged, row)
+			}
+		}
+		s.rollups[tier][sensorId] = merged
+	}
+	return nil
+}
+
+func (s *memoryStore) Prune(tier historyTier, before time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if tier == tierRaw {
+		for sensorId, samples := range s.samples {
+			i := sort.Search(len(samples), func(i int) bool {
+				return samples[i].time >= before
+			})
+			s.samples[sensorId] = samples[i:]
+		}
+		return nil
+	}
+	for sensorId, rows := range s.rollups[tier] {
+		i := sort.Search(len(rows), func(i int) bool {
+			return rows[i].time >= before
+		})
+		s.rollups[tier][sensorId] = rows[i:]
+	}
+	return nil
+}
+
+func (s *memoryStore) AddUser(name, passwordHash string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, user := range s.users {
+		if user.name == name {
+			return 0, errors.New("user already exists")
+		}
+	}
+	user := &User{
+		dbId:         s.nextUserId,
+		name:         name,
+		passwordHash: passwordHash,
+	}
+	s.nextUserId++
+	s.users[user.dbId] = user
+	return user.dbId, nil
+}
+
+func (s *memoryStore) GetUser(name string) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, user := range s.users {
+		if user.name == name {
+			userCopy := *user
+			return &userCopy, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStore) GetUsers() ([]*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		userCopy := *user
+		users = append(users, &userCopy)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users, nil
+}
+
+func (s *memoryStore) SetUserPassword(userId int64, passwordHash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return errNotFound
+	}
+	user.passwordHash = passwordHash
+	return nil
+}
+
+func (s *memoryStore) GetUserDevices(userId int64) ([]int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deviceIds := make([]int64, 0, 1)
+	for deviceId := range s.userDevices[userId] {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	sort.Slice(deviceIds, func(i, j int) bool {
+		return deviceIds[i] < deviceIds[j]
+	})
+	return deviceIds, nil
+}
+
+func (s *memoryStore) GrantDevice(userId, deviceId int64, role Role) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.users[userId] == nil || s.devices[deviceId] == nil {
+		return errNotFound
+	}
+	if s.userDevices[userId] == nil {
+		s.userDevices[userId] = make(map[int64]*Permissions)
+	}
+	if permissions := s.userDevices[userId][deviceId]; permissions != nil {
+		permissions.Role = role
+		return nil
+	}
+	s.userDevices[userId][deviceId] = &Permissions{
+		Role:      role,
+		Actuators: make(map[string]bool),
+		Sensors:   make(map[string]bool),
+	}
+	return nil
+}
+
+func (s *memoryStore) RevokeDevice(userId, deviceId int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.userDevices[userId], deviceId)
+	return nil
+}
+
+func (s *memoryStore) GetPermissions(userId, deviceId int64) (*Permissions, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	permissions := s.userDevices[userId][deviceId]
+	if permissions == nil {
+		return nil, errNotFound
+	}
+	permissionsCopy := &Permissions{
+		Role:      permissions.Role,
+		Actuators: make(map[string]bool, len(permissions.Actuators)),
+		Sensors:   make(map[string]bool, len(permissions.Sensors)),
+	}
+	for name := range permissions.Actuators {
+		permissionsCopy.Actuators[name] = true
+	}
+	for name := range permissions.Sensors {
+		permissionsCopy.Sensors[name] = true
+	}
+	return permissionsCopy, nil
+}
+
+// grants returns the grants of the given kind. The lock must be held.
+func (s *memoryStore) grants(userId, deviceId int64, kind string) (map[string]bool, error) {
+	permissions := s.userDevices[userId][deviceId]
+	if permissions == nil {
+		return nil, errNotFound
+	}
+	switch kind {
+	case GrantActuator:
+		return permissions.Actuators, nil
+	case GrantSensor:
+		return permissions.Sensors, nil
+	default:
+		return nil, errors.New("unknown grant kind")
+	}
+}
+
+func (s *memoryStore) AddGrant(userId, deviceId int64, kind, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	grants, err := s.grants(userId, deviceId, kind)
+	if err != nil {
+		return err
+	}
+	grants[name] = true
+	return nil
+}
+
+func (s *memoryStore) RemoveGrant(userId, deviceId int64, kind, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	grants, err := s.grants(userId, deviceId, kind)
+	if err != nil {
+		return err
+	}
+	delete(grants, name)
+	return nil
+}
+
+func (s *memoryStore) AddToken(userId int64, name, tokenHash string, created time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.users[userId] == nil {
+		return 0, errNotFound
+	}
+	token := &memoryToken{
+		Token: Token{
+			dbId:    s.nextTokenId,
+			userId:  userId,
+			name:    name,
+			created: created,
+		},
+		hash: tokenHash,
+	}
+	s.nextTokenId++
+	s.tokens[token.dbId] = token
+	return token.dbId, nil
+}
+
+func (s *memoryStore) GetTokens(userId int64) ([]*Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokens := make([]*Token, 0)
+	for _, token := range s.tokens {
+		if token.userId == userId {
+			tokenCopy := token.Token
+			tokens = append(tokens, &tokenCopy)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].dbId < tokens[j].dbId
+	})
+	return tokens, nil
+}
+
+func (s *memoryStore) GetTokenUser(tokenHash string) (*User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, token := range s.tokens {
+		if token.hash == tokenHash && token.revoked.IsZero() {
+			userCopy := *s.users[token.userId]
+			return &userCopy, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStore) RevokeToken(tokenId int64, revoked time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, ok := s.tokens[tokenId]
+	if !ok || !token.revoked.IsZero() {
+		return errNotFound
+	}
+	token.revoked = revoked
+	return nil
+}
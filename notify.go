@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagNotifyWebhook = flag.String("notify-webhook", "", "URL to POST notifications to, as JSON")
+var flagNotifySMTP = flag.String("notify-smtp", "", "SMTP server (host:port) to send notifications by email")
+var flagNotifySMTPFrom = flag.String("notify-smtp-from", "domos@localhost", "sender address of notification emails")
+var flagNotifySMTPTo = flag.String("notify-smtp-to", "", "recipients of notification emails, comma separated")
+var flagNotifySMTPUser = flag.String("notify-smtp-user", "", "SMTP username (optional)")
+var flagNotifySMTPPass = flag.String("notify-smtp-pass", "", "SMTP password (optional)")
+var flagNotifyMQTT = flag.String("notify-mqtt", "", "MQTT topic to publish notifications to, as JSON")
+var flagNotifyCommand = flag.String("notify-command", "", "command to run for every notification (gets the subject and message as arguments, JSON on stdin)")
+var flagNotifyMaxPerHour = flag.Int("notify-max-per-hour", 20, "maximum number of notifications per sink per hour (0 for no limit)")
+var flagNotifyDedup = flag.Duration("notify-dedup", time.Hour, "drop notifications with the same subject as one sent this recently")
+
+const NOTIFY_QUEUE = 16                 // notifications waiting per sink before new ones are dropped
+const NOTIFY_TIMEOUT = 30 * time.Second // time limit for delivering one notification
+
+// Notification is a message for the people living in the house, for example
+// because a sensor stopped reporting.
+type Notification struct {
+	Time    int64  `json:"time"`
+	Device  string `json:"device"`
+	Kind    string `json:"kind"` // what caused it: 'rule', 'online', 'offline', 'stale', 'fresh', 'alarm'
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+// dedupKey returns what makes a notification different from others. The
+// message is left out, as it usually contains the current value or time.
+func (n *Notification) dedupKey() string {
+	return n.Device + "\x00" + n.Kind + "\x00" + n.Subject
+}
+
+// NotificationSink delivers notifications somewhere outside domos.
+type NotificationSink interface {
+	Notify(ctx context.Context, n *Notification) error
+	String() string
+}
+
+// notificationSinks are the configured sinks.
+var notificationSinks []*limitedSink
+
+// setupNotifications creates the sinks configured with flags.
+func setupNotifications() error {
+	var sinks []NotificationSink
+	if *flagNotifyWebhook != "" {
+		sinks = append(sinks, &webhookSink{url: *flagNotifyWebhook})
+	}
+	if *flagNotifySMTP != "" {
+		if *flagNotifySMTPTo == "" {
+			return errors.New("no recipients for notification emails")
+		}
+		host, _, err := net.SplitHostPort(*flagNotifySMTP)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server: %s", err)
+		}
+		sink := &smtpSink{
+			address: *flagNotifySMTP,
+			from:    *flagNotifySMTPFrom,
+			to:      strings.Split(*flagNotifySMTPTo, ","),
+		}
+		if *flagNotifySMTPUser != "" {
+			sink.auth = smtp.PlainAuth("", *flagNotifySMTPUser, *flagNotifySMTPPass, host)
+		}
+		sinks = append(sinks, sink)
+	}
+	if *flagNotifyMQTT != "" {
+		sinks = append(sinks, &mqttSink{topic: *flagNotifyMQTT})
+	}
+	if *flagNotifyCommand != "" {
+		sinks = append(sinks, &commandSink{command: *flagNotifyCommand})
+	}
+
+	for _, sink := range sinks {
+		limited := newLimitedSink(sink, *flagNotifyMaxPerHour, *flagNotifyDedup)
+		notificationSinks = append(notificationSinks, limited)
+		go limited.run()
+	}
+	return nil
+}
+
+// notify sends a notification to all sinks. It never blocks, so it can be
+// called with the lock held.
+func (d *Device) notify(kind, subject, message string) {
+	n := &Notification{
+		Time:    time.Now().Unix(),
+		Device:  d.name,
+		Kind:    kind,
+		Subject: subject,
+		Message: message,
+	}
+	for _, sink := range notificationSinks {
+		sink.enqueue(n)
+	}
+}
+
+// limitedSink wraps a sink with a queue, rate limiting and deduplication.
+type limitedSink struct {
+	sink       NotificationSink
+	queue      chan *Notification
+	maxPerHour int
+	dedup      time.Duration
+
+	lock   sync.Mutex
+	sent   []time.Time          // send times in the last hour
+	recent map[string]time.Time // last send time per notification
+}
+
+func newLimitedSink(sink NotificationSink, maxPerHour int, dedup time.Duration) *limitedSink {
+	return &limitedSink{
+		sink:       sink,
+		queue:      make(chan *Notification, NOTIFY_QUEUE),
+		maxPerHour: maxPerHour,
+		dedup:      dedup,
+		recent:     make(map[string]time.Time),
+	}
+}
+
+// enqueue queues the notification, unless it is a duplicate, the rate limit
+// has been reached or the queue is full.
+func (s *limitedSink) enqueue(n *Notification) {
+	s.enqueueAt(n, time.Now())
+}
+
+// enqueueAt is enqueue at the given time. It returns whether the notification
+// was queued: only those count for the rate limit and deduplication.
+func (s *limitedSink) enqueueAt(n *Notification, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.allow(n, now) {
+		return false
+	}
+	select {
+	case s.queue <- n:
+	default:
+		log.Printf("notification queue of %s is full, dropping: %s", s.sink, n.Subject)
+		return false
+	}
+	s.sent = append(s.sent, now)
+	s.recent[n.dedupKey()] = now
+	return true
+}
+
+// allow returns whether the notification may be sent now. The lock must be
+// held.
+func (s *limitedSink) allow(n *Notification, now time.Time) bool {
+	if last, ok := s.recent[n.dedupKey()]; ok && now.Sub(last) < s.dedup {
+		return false
+	}
+	for key, last := range s.recent {
+		if now.Sub(last) >= s.dedup {
+			delete(s.recent, key)
+		}
+	}
+
+	for len(s.sent) != 0 && now.Sub(s.sent[0]) >= time.Hour {
+		s.sent = s.sent[1:]
+	}
+	if s.maxPerHour > 0 && len(s.sent) >= s.maxPerHour {
+		log.Printf("too many notifications for %s, dropping: %s", s.sink, n.Subject)
+		return false
+	}
+	return true
+}
+
+// run delivers queued notifications.
+func (s *limitedSink) run() {
+	for n := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), NOTIFY_TIMEOUT)
+		err := s.sink.Notify(ctx, n)
+		cancel()
+		if err != nil {
+			log.Printf("could not send notification to %s: %s", s.sink, err)
+		}
+	}
+}
+
+// webhookSink POSTs notifications as JSON to a URL.
+type webhookSink struct {
+	url string
+}
+
+func (s *webhookSink) String() string {
+	return "webhook " + s.url
+}
+
+func (s *webhookSink) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpSink sends notifications by email.
+type smtpSink struct {
+	address string
+	auth    smtp.Auth
+	from    string
+	to      []string
+}
+
+func (s *smtpSink) String() string {
+	return "SMTP server " + s.address
+}
+
+func (s *smtpSink) Notify(ctx context.Context, n *Notification) error {
+	subject := strings.Map(func(c rune) rune {
+		if c == '\r' || c == '\n' {
+			return ' '
+		}
+		return c
+	}, n.Subject)
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(msg, "Subject: [%s] %s\r\n", n.Device, subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Unix(n.Time, 0).Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(msg, "\r\n%s\r\n", strings.Replace(n.Message, "\n", "\r\n", -1))
+
+	// net/smtp doesn't support contexts, so the deadline of the context is
+	// set on the connection instead.
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(NOTIFY_TIMEOUT)
+	}
+	conn, err := net.DialTimeout("tcp", s.address, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Same steps as smtp.SendMail.
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support authentication")
+		}
+		err = c.Auth(s.auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(s.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg.Bytes())
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// mqttSink publishes notifications as JSON to an MQTT topic, using the
+// connection to the devices.
+type mqttSink struct {
+	topic string
+}
+
+func (s *mqttSink) String() string {
+	return "MQTT topic " + s.topic
+}
+
+func (s *mqttSink) Notify(ctx context.Context, n *Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return mqttPublish(ctx, s.topic, payload)
+}
+
+// commandSink runs a local command for every notification. The subject and
+// message are passed as arguments and the notification as JSON on stdin.
+type commandSink struct {
+	command string
+}
+
+func (s *commandSink) String() string {
+	return "command " + s.command
+}
+
+func (s *commandSink) Notify(ctx context.Context, n *Notification) error {
+	input, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, s.command, n.Subject, n.Message)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotification() *Notification {
+	return &Notification{
+		Time:    1000,
+		Device:  "house",
+		Kind:    "stale",
+		Subject: "Sensor temp stopped reporting",
+		Message: "No value since yesterday.",
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan *Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		n := &Notification{}
+		if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+			t.Error("could not decode notification:", err)
+		}
+		received <- n
+	}))
+	defer server.Close()
+
+	sink := &webhookSink{url: server.URL}
+	if err := sink.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatal("could not notify:", err)
+	}
+	if n := <-received; *n != *testNotification() {
+		t.Errorf("got notification %+v, expected %+v", n, testNotification())
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	sink = &webhookSink{url: failing.URL}
+	if err := sink.Notify(context.Background(), testNotification()); err == nil {
+		t.Error("expected an error for status 500")
+	}
+}
+
+// runFakeSMTPServer accepts one connection and speaks just enough SMTP to
+// receive one email. It returns the address to connect to and a channel that
+// gets the recipients and the message.
+func runFakeSMTPServer(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not listen:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		reply("220 localhost ESMTP")
+		var recipients []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				reply("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				recipients = append(recipients, strings.TrimSpace(line)[len("RCPT TO:"):])
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 go ahead")
+				message := &strings.Builder{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					message.WriteString(line)
+				}
+				reply("250 OK")
+				result <- append(recipients, message.String())
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), result
+}
+
+func TestSMTPSink(t *testing.T) {
+	address, result := runFakeSMTPServer(t)
+	sink := &smtpSink{
+		address: address,
+		from:    "domos@localhost",
+		to:      []string{"alice@example.com", "bob@example.com"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sink.Notify(ctx, testNotification()); err != nil {
+		t.Fatal("could not send email:", err)
+	}
+
+	received := <-result
+	if len(received) != 3 || received[0] != "<alice@example.com>" || received[1] != "<bob@example.com>" {
+		t.Errorf("got recipients %q", received[:len(received)-1])
+	}
+	message := received[len(received)-1]
+	for _, expected := range []string{
+		"Subject: [house] Sensor temp stopped reporting\r\n",
+		"To: alice@example.com, bob@example.com\r\n",
+		"\r\n\r\nNo value since yesterday.\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message doesn't contain %q:\n%s", expected, message)
+		}
+	}
+}
+
+func TestSMTPSinkTimeout(t *testing.T) {
+	// A server that accepts connections but never says anything.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("could not listen:", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	sink := &smtpSink{address: listener.Addr().String(), from: "domos@localhost", to: []string{"alice@example.com"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sink.Notify(ctx, testNotification()); err == nil {
+		t.Error("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Notify took %s, expected it to give up after the timeout", elapsed)
+	}
+}
+
+func TestMQTTSinkTimeout(t *testing.T) {
+	client := newFakeMQTTClient()
+	client.stalled = true
+	mqttServerLock.Lock()
+	oldServer := mqttServer
+	mqttServer = &MQTTServer{client: client}
+	mqttServerLock.Unlock()
+	t.Cleanup(func() {
+		mqttServerLock.Lock()
+		mqttServer = oldServer
+		mqttServerLock.Unlock()
+	})
+
+	sink := &mqttSink{topic: "domos/notifications"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sink.Notify(ctx, testNotification()); err == nil {
+		t.Error("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Notify took %s, expected it to give up after the timeout", elapsed)
+	}
+	var n Notification
+	if err := json.Unmarshal(client.take()["domos/notifications"], &n); err != nil || n != *testNotification() {
+		t.Errorf("published %+v (%v), expected %+v", n, err, testNotification())
+	}
+}
+
+func TestLimitedSinkDedup(t *testing.T) {
+	s := newLimitedSink(&webhookSink{url: "test"}, 0, time.Hour)
+	start := time.Unix(1000, 0)
+	n := testNotification()
+	// The message usually contains the current value, so it doesn't count.
+	sameSubject := testNotification()
+	sameSubject.Message = "No value since this morning."
+	other := testNotification()
+	other.Subject = "Sensor humidity stopped reporting"
+
+	if !s.enqueueAt(n, start) {
+		t.Error("first notification not allowed")
+	}
+	if s.enqueueAt(n, start.Add(30*time.Minute)) {
+		t.Error("duplicate within the dedup window allowed")
+	}
+	if s.enqueueAt(sameSubject, start.Add(30*time.Minute)) {
+		t.Error("duplicate with another message within the dedup window allowed")
+	}
+	if !s.enqueueAt(other, start.Add(30*time.Minute)) {
+		t.Error("different notification not allowed")
+	}
+	if !s.enqueueAt(n, start.Add(61*time.Minute)) {
+		t.Error("duplicate after the dedup window not allowed")
+	}
+}
+
+func TestLimitedSinkMaxPerHour(t *testing.T) {
+	s := newLimitedSink(&webhookSink{url: "test"}, 2, 0)
+	start := time.Unix(1000, 0)
+	notification := func(subject string) *Notification {
+		n := testNotification()
+		n.Subject = subject
+		return n
+	}
+
+	if !s.enqueueAt(notification("a"), start) || !s.enqueueAt(notification("b"), start.Add(time.Minute)) {
+		t.Fatal("notifications below the limit not allowed")
+	}
+	if s.enqueueAt(notification("c"), start.Add(2*time.Minute)) {
+		t.Error("notification over the hourly limit allowed")
+	}
+	// The first notification was sent more than an hour ago.
+	if !s.enqueueAt(notification("d"), start.Add(60*time.Minute+30*time.Second)) {
+		t.Error("notification not allowed after the oldest one left the hour")
+	}
+	if s.enqueueAt(notification("e"), start.Add(60*time.Minute+45*time.Second)) {
+		t.Error("notification over the hourly limit allowed")
+	}
+}
+
+func TestLimitedSinkQueueFull(t *testing.T) {
+	s := newLimitedSink(&webhookSink{url: "test"}, 1, time.Hour)
+	s.queue = make(chan *Notification, 1)
+	start := time.Unix(1000, 0)
+	s.queue <- testNotification()
+
+	// A dropped notification isn't counted as sent.
+	n := testNotification()
+	n.Subject = "Device house went offline"
+	if s.enqueueAt(n, start) {
+		t.Error("notification queued in a full queue")
+	}
+	<-s.queue
+	if !s.enqueueAt(n, start.Add(time.Minute)) {
+		t.Error("notification not allowed after it was dropped from a full queue")
+	}
+	if len(s.queue) != 1 {
+		t.Errorf("got %d notifications in the queue, expected 1", len(s.queue))
+	}
+}
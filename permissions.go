@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+)
+
+// Role is the level of access a user has to a device.
+type Role int
+
+const (
+	RoleViewer   Role = iota // read sensors and actuators, set granted actuators
+	RoleOperator             // also set all actuators and edit sensors
+	RoleAdmin                // full access
+)
+
+var roleNames = map[Role]string{
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(name string) (Role, bool) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, true
+		}
+	}
+	return 0, false
+}
+
+// Kinds of per-name grants.
+const (
+	GrantActuator = "actuator"
+	GrantSensor   = "sensor"
+)
+
+// Permissions are the permissions of one user on one device.
+type Permissions struct {
+	Role      Role
+	Actuators map[string]bool // actuators a viewer may set
+	Sensors   map[string]bool // if not empty, the only sensors a non-admin may read
+}
+
+// CanSetActuator returns whether the actuator may be changed.
+func (p *Permissions) CanSetActuator(name string) bool {
+	return p.Role >= RoleOperator || p.Actuators[name]
+}
+
+// CanApplyScene returns whether all actuators of the scene may be changed.
+func (p *Permissions) CanApplyScene(scene *Scene) bool {
+	for name := range scene.Actuators {
+		if !p.CanSetActuator(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanReadActuatorHistory returns whether the audit log of the actuator may be
+// read. It shows who made every change, so only users that may change the
+// actuator themselves get to see it.
+func (p *Permissions) CanReadActuatorHistory(name string) bool {
+	return p.CanSetActuator(name)
+}
+
+// CanReadSensor returns whether the sensor and its logs may be read.
+func (p *Permissions) CanReadSensor(name string) bool {
+	return p.Role == RoleAdmin || len(p.Sensors) == 0 || p.Sensors[name]
+}
+
+// CanAcknowledgeAlarm returns whether alarms of the sensor may be
+// acknowledged. Viewers need a grant on the sensor: an acknowledged alarm is no
+// longer shown as active to everyone else.
+func (p *Permissions) CanAcknowledgeAlarm(sensor string) bool {
+	return p.CanReadSensor(sensor) && (p.Role >= RoleOperator || p.Sensors[sensor])
+}
+
+// permissionDenied returns the error to send to a control for a request that
+// is not allowed.
+func permissionDenied(request, name string) ControlMessageError {
+	return ControlMessageError{
+		Message: "error",
+		Error:   "permission denied",
+		Request: request,
+		Name:    name,
+	}
+}
+
+// userPermissions returns the permissions of the user on the given device, or
+// nil if the user has no access at all.
+func userPermissions(user *User, deviceId int64) *Permissions {
+	permissions, err := store.GetPermissions(user.dbId, deviceId)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("could not look up permissions of user '%s': %s", user.name, err)
+		}
+		return nil
+	}
+	return permissions
+}
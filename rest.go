@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// JSON REST API, for clients that don't want to speak the control WebSocket
+// protocol. Requests authenticate like controls, either with a user name and
+// password (HTTP basic auth) or with an API token (bearer token). Sensor values
+// are converted to the unit system in the units query parameter, if present.
+
+type RESTDevice struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type RESTActuator struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type RESTError struct {
+	Error string `json:"error"`
+}
+
+type restHandler func(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device)
+
+func addRESTRoutes(router *mux.Router, deviceSet *DeviceSet) {
+	handle := func(path string, handler restHandler, methods ...string) {
+		router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			user := restAuthenticate(w, r)
+			if user == nil {
+				return
+			}
+			device, permissions := deviceSet.userDevice(user, restDeviceId(r))
+			if device == nil {
+				writeError(w, http.StatusNotFound, "unknown device")
+				return
+			}
+			handler(w, r, user, permissions, device)
+		}).Methods(methods...)
+	}
+	router.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		user := restAuthenticate(w, r)
+		if user == nil {
+			return
+		}
+		devices := deviceSet.userDevices(user)
+		reply := make([]RESTDevice, len(devices))
+		for i, device := range devices {
+			reply[i] = RESTDevice{device.dbId, device.name}
+		}
+		writeJSON(w, http.StatusOK, reply)
+	}).Methods("GET")
+	handle("/api/devices/{device}", restGetDevice, "GET")
+	handle("/api/devices/{device}/status", restGetDeviceStatus, "GET")
+	handle("/api/devices/{device}/alarms", restGetAlarms, "GET")
+	handle("/api/devices/{device}/alarms/{alarm}/acknowledge", restAcknowledgeAlarm, "POST")
+	handle("/api/devices/{device}/sensors", restGetSensors, "GET")
+	handle("/api/devices/{device}/sensors/{sensor}", restUpdateSensor, "PATCH")
+	handle("/api/devices/{device}/sensors/{sensor}/logs", restGetSensorLogs, "GET")
+	handle("/api/devices/{device}/sensors/{sensor}/history", restGetSensorHistory, "GET")
+	handle("/api/devices/{device}/actuators", restGetActuators, "GET")
+	handle("/api/devices/{device}/actuators/{actuator}", restGetActuator, "GET")
+	handle("/api/devices/{device}/actuators/{actuator}", restSetActuator, "PUT")
+	handle("/api/devices/{device}/actuators/{actuator}/history", restGetActuatorHistory, "GET")
+	handle("/api/devices/{device}/actuatorTypes", restGetActuatorTypes, "GET")
+	handle("/api/devices/{device}/scenes", restGetScenes, "GET")
+	handle("/api/devices/{device}/scenes/{scene}/apply", restApplyScene, "POST")
+}
+
+// restAuthenticate returns the user for the credentials in the request. On
+// failure it writes an error response and returns nil.
+func restAuthenticate(w http.ResponseWriter, r *http.Request) *User {
+	var user *User
+	if name, password, ok := r.BasicAuth(); ok {
+		user = authenticateUser(name, password, "")
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		user = authenticateUser("", "", auth[len("Bearer "):])
+	}
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="domos"`)
+		writeError(w, http.StatusUnauthorized, "invalid credentials")
+		return nil
+	}
+	return user
+}
+
+// restDeviceId returns the device ID from the path, or -1 if it is invalid.
+func restDeviceId(r *http.Request) int64 {
+	deviceId, err := strconv.ParseInt(mux.Vars(r)["device"], 10, 64)
+	if err != nil || deviceId <= 0 {
+		return -1
+	}
+	return deviceId
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Could not send REST reply:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, RESTError{message})
+}
+
+// queryInt returns the integer query parameter, or 0 if it is not present.
+func queryInt(r *http.Request, name string) (int64, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
+
+// restUnits returns the unit system from the query. On failure it writes an
+// error response and returns false.
+func restUnits(w http.ResponseWriter, r *http.Request) (string, bool) {
+	units := r.URL.Query().Get("units")
+	if err := checkUnits(units); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return units, true
+}
+
+// restSensor returns the sensor from the path. On failure it writes an error
+// response and returns nil.
+func restSensor(w http.ResponseWriter, r *http.Request, permissions *Permissions, device *Device) *Sensor {
+	name := mux.Vars(r)["sensor"]
+	if !permissions.CanReadSensor(name) {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return nil
+	}
+	sensor := GetSensor(device.dbId, name)
+	if sensor == nil {
+		writeError(w, http.StatusNotFound, "unknown sensor")
+		return nil
+	}
+	return sensor
+}
+
+func restGetDevice(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	writeJSON(w, http.StatusOK, RESTDevice{device.dbId, device.name})
+}
+
+func restGetDeviceStatus(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	writeJSON(w, http.StatusOK, device.Status(permissions))
+}
+
+func restGetAlarms(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, device.OpenAlarms(permissions, units))
+}
+
+func restAcknowledgeAlarm(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["alarm"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "unknown alarm")
+		return
+	}
+	alarm, err := device.AcknowledgeAlarm(id, permissions, user.name, units)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, "unknown alarm")
+		return
+	} else if err == errPermissionDenied {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, alarm)
+}
+
+func restGetSensors(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	sensors := device.getSensors()
+	if sensors == nil {
+		writeError(w, http.StatusInternalServerError, "could not read sensors")
+		return
+	}
+	reply := make([]*SensorInfo, 0, len(sensors))
+	for _, sensor := range sensors {
+		if !permissions.CanReadSensor(sensor.name) {
+			continue
+		}
+		reply = append(reply, sensor.Info(units))
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+func restUpdateSensor(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	name := mux.Vars(r)["sensor"]
+	if permissions.Role < RoleOperator || !permissions.CanReadSensor(name) {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	update := SensorUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not parse request: "+err.Error())
+		return
+	}
+	info, err := device.UpdateSensor(name, update, units)
+	if err == errNotFound {
+		writeError(w, http.StatusNotFound, "unknown sensor")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func restGetSensorLogs(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	since, ok := queryInt(r, "since")
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid since parameter")
+		return
+	}
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	sensor := restSensor(w, r, permissions, device)
+	if sensor == nil {
+		return
+	}
+	// Like controls, only get the raw values of the last day. Longer periods
+	// are available from the history, in buckets.
+	if now := time.Now().Unix(); since < now-GRAPH_TIME {
+		since = now - GRAPH_TIME
+	}
+	logs := sensor.FetchLogs(since, units)
+	if logs == nil {
+		writeError(w, http.StatusInternalServerError, "could not fetch logs")
+		return
+	}
+	logs.Stale = device.IsStale(sensor.name)
+	writeJSON(w, http.StatusOK, logs)
+}
+
+func restGetSensorHistory(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	start, ok1 := queryInt(r, "start")
+	end, ok2 := queryInt(r, "end")
+	bucket, ok3 := queryInt(r, "bucket")
+	if !ok1 || !ok2 || !ok3 {
+		writeError(w, http.StatusBadRequest, "invalid start, end or bucket parameter")
+		return
+	}
+	units, ok := restUnits(w, r)
+	if !ok {
+		return
+	}
+	sensor := restSensor(w, r, permissions, device)
+	if sensor == nil {
+		return
+	}
+	history := sensor.History(start, end, bucket, units)
+	if history == nil {
+		writeError(w, http.StatusInternalServerError, "could not fetch history")
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func restGetActuators(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	writeJSON(w, http.StatusOK, device.Actuators())
+}
+
+func restGetActuator(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	name := mux.Vars(r)["actuator"]
+	value, ok := device.Actuators()[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown actuator")
+		return
+	}
+	writeJSON(w, http.StatusOK, RESTActuator{name, value})
+}
+
+func restSetActuator(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	name := mux.Vars(r)["actuator"]
+	if !permissions.CanSetActuator(name) {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	msg := MessageActuator{}
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "could not parse request: "+err.Error())
+		return
+	}
+	err = device.CheckActuator(name, msg.Value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	device.SetActuator(name, msg.Value, restSource(user))
+	writeJSON(w, http.StatusOK, RESTActuator{name, msg.Value})
+}
+
+func restGetActuatorHistory(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	start, ok1 := queryInt(r, "start")
+	end, ok2 := queryInt(r, "end")
+	if !ok1 || !ok2 {
+		writeError(w, http.StatusBadRequest, "invalid start or end parameter")
+		return
+	}
+	name := mux.Vars(r)["actuator"]
+	if !permissions.CanReadActuatorHistory(name) {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	history := device.ActuatorHistory(name, start, end, permissions)
+	if history == nil {
+		writeError(w, http.StatusInternalServerError, "could not fetch actuator history")
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func restGetActuatorTypes(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	writeJSON(w, http.StatusOK, device.ActuatorTypes())
+}
+
+func restGetScenes(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	scenes := device.Scenes()
+	if scenes == nil {
+		writeError(w, http.StatusInternalServerError, "could not read scenes")
+		return
+	}
+	writeJSON(w, http.StatusOK, scenes)
+}
+
+func restApplyScene(w http.ResponseWriter, r *http.Request, user *User, permissions *Permissions, device *Device) {
+	scene := device.Scene(mux.Vars(r)["scene"])
+	if scene == nil {
+		writeError(w, http.StatusNotFound, "unknown scene")
+		return
+	}
+	if !permissions.CanApplyScene(scene) {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	err := device.ApplyScene(scene, restSource(user))
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, scene)
+}
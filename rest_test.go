@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestREST returns a REST API server for a test device. The user alice is
+// an admin of the device, bob is a viewer who may set the led and read the
+// temp sensor and logs in with the token "bob-token", and carol has no access.
+func newTestREST(t *testing.T) (*httptest.Server, *Device, chan MessageValue) {
+	t.Helper()
+	d, sendChan := newTestDevice(t)
+	ds := NewDeviceSet()
+	d.DeviceSet = ds
+	ds.devices[idHash("device")] = d
+
+	users := make(map[string]int64)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		hash, err := hashPassword(name + "-password")
+		if err != nil {
+			t.Fatal("could not hash password:", err)
+		}
+		users[name], err = store.AddUser(name, hash)
+		if err != nil {
+			t.Fatal("could not add user:", err)
+		}
+	}
+	for _, err := range []error{
+		store.GrantDevice(users["alice"], d.dbId, RoleAdmin),
+		store.GrantDevice(users["bob"], d.dbId, RoleViewer),
+		store.AddGrant(users["bob"], d.dbId, GrantActuator, "led"),
+		store.AddGrant(users["bob"], d.dbId, GrantSensor, "temp"),
+	} {
+		if err != nil {
+			t.Fatal("could not grant access:", err)
+		}
+	}
+	if _, err := store.AddToken(users["bob"], "test", hashToken("bob-token"), time.Now()); err != nil {
+		t.Fatal("could not add token:", err)
+	}
+
+	router := mux.NewRouter()
+	addRESTRoutes(router, ds)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, d, sendChan
+}
+
+// restRequest sends a request as the given user ("user:password" for basic
+// auth, a token otherwise, or nothing if empty) and decodes the reply into
+// reply, if not nil. It returns the status code.
+func restRequest(t *testing.T, server *httptest.Server, method, path, auth, body string, reply interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("could not create request:", err)
+	}
+	if i := strings.IndexByte(auth, ':'); i >= 0 {
+		req.SetBasicAuth(auth[:i], auth[i+1:])
+	} else if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	if reply != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			t.Errorf("%s %s: could not decode reply: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRESTAuthentication(t *testing.T) {
+	server, d, _ := newTestREST(t)
+	device := fmt.Sprintf("/api/devices/%d", d.dbId)
+
+	tests := []struct {
+		method, path string
+		auth         string
+		body         string
+		expected     int
+	}{
+		{"GET", device, "", "", http.StatusUnauthorized},
+		{"GET", device, "alice:alice-password", "", http.StatusOK},
+		{"GET", device, "alice:bob-password", "", http.StatusUnauthorized},
+		{"GET", device, "alice:", "", http.StatusUnauthorized},
+		{"GET", device, "nobody:alice-password", "", http.StatusUnauthorized},
+		{"GET", device, "bob-token", "", http.StatusOK},
+		{"GET", device, "alice-token", "", http.StatusUnauthorized},
+		{"GET", device, "carol:carol-password", "", http.StatusNotFound}, // no access
+		{"GET", "/api/devices/999", "alice:alice-password", "", http.StatusNotFound},
+		{"GET", "/api/devices/abc", "alice:alice-password", "", http.StatusNotFound},
+		{"GET", "/api/devices/0", "alice:alice-password", "", http.StatusNotFound},
+		{"GET", device + "/sensors/temp/logs", "bob-token", "", http.StatusNotFound},
+		{"GET", device + "/sensors/humidity/logs", "bob-token", "", http.StatusForbidden},
+		{"PUT", device + "/actuators/led", "bob-token", `{"value": true}`, http.StatusOK},
+		{"PUT", device + "/actuators/heater", "bob-token", `{"value": true}`, http.StatusForbidden},
+		{"PATCH", device + "/sensors/temp", "bob-token", `{"humanName": "Kitchen"}`, http.StatusForbidden},
+		{"POST", device + "/scenes/unknown/apply", "alice:alice-password", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if status := restRequest(t, server, tc.method, tc.path, tc.auth, tc.body, nil); status != tc.expected {
+			t.Errorf("%s %s as %q: got status %d, expected %d", tc.method, tc.path, tc.auth, status, tc.expected)
+		}
+	}
+
+	// Clients are told how to authenticate.
+	resp, err := http.Get(server.URL + device)
+	if err != nil {
+		t.Fatal("could not send request:", err)
+	}
+	resp.Body.Close()
+	if auth := resp.Header.Get("WWW-Authenticate"); auth != `Basic realm="domos"` {
+		t.Errorf("got WWW-Authenticate %q", auth)
+	}
+
+	var devices []RESTDevice
+	if status := restRequest(t, server, "GET", "/api/devices", "bob-token", "", &devices); status != http.StatusOK {
+		t.Errorf("GET /api/devices: got status %d", status)
+	}
+	if len(devices) != 1 || devices[0].Id != d.dbId || devices[0].Name != "house" {
+		t.Errorf("got devices %+v", devices)
+	}
+	if status := restRequest(t, server, "GET", "/api/devices", "carol:carol-password", "", &devices); status != http.StatusOK || len(devices) != 0 {
+		t.Errorf("carol got status %d and devices %+v", status, devices)
+	}
+}
+
+func TestRESTSetActuator(t *testing.T) {
+	server, d, sendChan := newTestREST(t)
+	d.actuatorTypes["heater"] = &ActuatorType{Type: ActuatorBoolean}
+	path := fmt.Sprintf("/api/devices/%d/actuators/heater", d.dbId)
+
+	tests := []struct {
+		body     string
+		expected int
+	}{
+		{`{"value": "on"}`, http.StatusBadRequest},
+		{`{"value": 1}`, http.StatusBadRequest},
+		{`{}`, http.StatusBadRequest},
+		{`{"value": `, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if status := restRequest(t, server, "PUT", path, "alice:alice-password", tc.body, nil); status != tc.expected {
+			t.Errorf("PUT %s: got status %d, expected %d", tc.body, status, tc.expected)
+		}
+		if got := sentActuator(t, sendChan, "heater"); got != nil {
+			t.Errorf("PUT %s: sent %v to the device", tc.body, got)
+		}
+	}
+
+	var reply RESTActuator
+	if status := restRequest(t, server, "PUT", path, "alice:alice-password", `{"value": true}`, &reply); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if reply.Name != "heater" || reply.Value != true {
+		t.Errorf("got reply %+v", reply)
+	}
+	if got := sentActuator(t, sendChan, "heater"); got != true {
+		t.Errorf("sent %v to the device, expected true", got)
+	}
+	if status := restRequest(t, server, "GET", path, "bob-token", "", &reply); status != http.StatusOK || reply.Value != true {
+		t.Errorf("got status %d and actuator %+v", status, reply)
+	}
+}
+
+func TestRESTGetSensors(t *testing.T) {
+	server, d, _ := newTestREST(t)
+	for _, name := range []string{"temp", "humidity"} {
+		if _, err := store.AddSensor(d.dbId, name, name, ValueNumber); err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+	}
+	unit := "°C"
+	_, err := d.UpdateSensor("temp", SensorUpdate{Unit: &unit, DesiredValue: json.RawMessage("20")}, "")
+	if err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	path := fmt.Sprintf("/api/devices/%d/sensors", d.dbId)
+
+	tests := []struct {
+		auth    string
+		units   string
+		unit    string
+		desired float64
+		sensors int
+	}{
+		{"alice:alice-password", "", "°C", 20, 2},
+		{"alice:alice-password", UnitsMetric, "°C", 20, 2},
+		{"alice:alice-password", UnitsImperial, "°F", 68, 2},
+		{"bob-token", UnitsImperial, "°F", 68, 1}, // may only read temp
+	}
+	for _, tc := range tests {
+		var sensors []SensorInfo
+		status := restRequest(t, server, "GET", path+"?units="+tc.units, tc.auth, "", &sensors)
+		if status != http.StatusOK {
+			t.Errorf("units %q as %q: got status %d", tc.units, tc.auth, status)
+			continue
+		}
+		if len(sensors) != tc.sensors {
+			t.Errorf("units %q as %q: got %d sensors, expected %d", tc.units, tc.auth, len(sensors), tc.sensors)
+		}
+		for _, sensor := range sensors {
+			if sensor.Name != "temp" {
+				continue
+			}
+			desired, _ := sensor.DesiredValue.(float64)
+			if sensor.Unit != tc.unit || !closeTo(desired, tc.desired) {
+				t.Errorf("units %q: got desired value %v %s, expected %v %s", tc.units, sensor.DesiredValue, sensor.Unit, tc.desired, tc.unit)
+			}
+		}
+	}
+
+	if status := restRequest(t, server, "GET", path+"?units=kelvin", "alice:alice-password", "", nil); status != http.StatusBadRequest {
+		t.Errorf("unknown unit system: got status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestRESTUpdateSensor(t *testing.T) {
+	server, d, _ := newTestREST(t)
+	for _, name := range []string{"temp", "humidity"} {
+		if _, err := store.AddSensor(d.dbId, name, name, ValueNumber); err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+	}
+	unit := "°C"
+	if _, err := d.UpdateSensor("temp", SensorUpdate{Unit: &unit}, ""); err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	path := fmt.Sprintf("/api/devices/%d/sensors/", d.dbId)
+
+	// Viewers may not change sensors.
+	if status := restRequest(t, server, "PATCH", path+"temp", "bob-token", `{"desiredValue": 70}`, nil); status != http.StatusForbidden {
+		t.Errorf("viewer: got status %d, expected %d", status, http.StatusForbidden)
+	}
+	// Operators only the sensors they may read.
+	bob, err := store.GetUser("bob")
+	if err != nil {
+		t.Fatal("could not get user:", err)
+	}
+	if err := store.GrantDevice(bob.dbId, d.dbId, RoleOperator); err != nil {
+		t.Fatal("could not grant access:", err)
+	}
+	if status := restRequest(t, server, "PATCH", path+"humidity", "bob-token", `{"desiredValue": 50}`, nil); status != http.StatusForbidden {
+		t.Errorf("operator without access to the sensor: got status %d, expected %d", status, http.StatusForbidden)
+	}
+
+	var info SensorInfo
+	if status := restRequest(t, server, "PATCH", path+"temp?units=imperial", "bob-token", `{"desiredValue": 68}`, &info); status != http.StatusOK {
+		t.Fatalf("operator: got status %d", status)
+	}
+	if desired, _ := info.DesiredValue.(float64); info.Unit != "°F" || !closeTo(desired, 68) {
+		t.Errorf("got desired value %v %s, expected 68 °F", info.DesiredValue, info.Unit)
+	}
+	sensor, err := store.GetSensor(d.dbId, "temp")
+	if err != nil {
+		t.Fatal("could not get sensor:", err)
+	}
+	if desired, _ := sensor.desiredValue.(float64); !closeTo(desired, 20) {
+		t.Errorf("stored desired value %v, expected 20", sensor.desiredValue)
+	}
+
+	tests := []struct {
+		path, body string
+		expected   int
+	}{
+		{"unknown", `{"desiredValue": 20}`, http.StatusNotFound},
+		{"temp", `{"desiredValue": "warm"}`, http.StatusBadRequest},
+		{"temp", `{"alarmMin": 30, "alarmMax": 10}`, http.StatusBadRequest},
+		{"temp", `{"desiredValue": `, http.StatusBadRequest},
+		{"temp?units=kelvin", `{"desiredValue": 20}`, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		if status := restRequest(t, server, "PATCH", path+tc.path, "alice:alice-password", tc.body, nil); status != tc.expected {
+			t.Errorf("PATCH %s %s: got status %d, expected %d", tc.path, tc.body, status, tc.expected)
+		}
+	}
+}
+
+func TestRESTGetSensorLogs(t *testing.T) {
+	server, d, _ := newTestREST(t)
+	sensor, err := store.AddSensor(d.dbId, "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	now := time.Now().Unix()
+	for i, logtime := range []int64{now - 2*GRAPH_TIME, now - GRAPH_TIME/2, now - 60} {
+		err := store.InsertSample(sensor.dbId, time.Duration(logtime)*time.Second, 60*time.Second, float64(i))
+		if err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+	}
+	path := fmt.Sprintf("/api/devices/%d/sensors/temp/logs", d.dbId)
+
+	// Without a start, or with one that is too long ago, only the values of
+	// the last day are returned.
+	tests := []struct {
+		query    string
+		expected []float64
+	}{
+		{"", []float64{1, 2}},
+		{"?since=0", []float64{1, 2}},
+		{fmt.Sprintf("?since=%d", now-3*GRAPH_TIME), []float64{1, 2}},
+		{fmt.Sprintf("?since=%d", now-GRAPH_TIME/2), []float64{2}},
+	}
+	for _, tc := range tests {
+		var reply LogReply
+		if status := restRequest(t, server, "GET", path+tc.query, "bob-token", "", &reply); status != http.StatusOK {
+			t.Errorf("GET %s: got status %d", tc.query, status)
+			continue
+		}
+		values := make([]float64, 0, len(reply.Log))
+		for _, row := range reply.Log {
+			value, _ := row.Value.(float64)
+			values = append(values, value)
+		}
+		if !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("GET %s: got values %v, expected %v", tc.query, values, tc.expected)
+		}
+	}
+}
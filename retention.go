@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var flagKeepRawDays = flag.Int("keep-raw-days", 0, "number of days to keep raw sensor values (0 means forever)")
+var flagKeepHourlyMonths = flag.Int("keep-hourly-months", 0, "number of months to keep hourly sensor rollups (0 means forever)")
+
+const ROLLUP_INTERVAL = 15 * time.Minute // how often to run the rollup job
+
+// historyTier is one of the resolutions in which the sensor log is stored.
+// Each tier is computed from the next finer tier.
+type historyTier int
+
+const (
+	tierRaw historyTier = iota
+	tierHourly
+	tierDaily
+)
+
+// period returns the size of one row in this tier.
+func (t historyTier) period() time.Duration {
+	switch t {
+	case tierHourly:
+		return time.Hour
+	case tierDaily:
+		return 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// keepUntil returns the point in time before which rows of this tier may be
+// removed, or the zero time if they should be kept forever.
+func (t historyTier) keepUntil(now time.Time) time.Time {
+	switch t {
+	case tierRaw:
+		if *flagKeepRawDays > 0 {
+			return now.AddDate(0, 0, -*flagKeepRawDays)
+		}
+	case tierHourly:
+		if *flagKeepHourlyMonths > 0 {
+			return now.AddDate(0, -*flagKeepHourlyMonths, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// tierFor returns the finest tier that still contains values from the given
+// start time.
+func tierFor(start, now time.Time) historyTier {
+	tier := tierRaw
+	for tier < tierDaily {
+		until := tier.keepUntil(now)
+		if until.IsZero() || !start.Before(until) {
+			break
+		}
+		tier++
+	}
+	return tier
+}
+
+// runRollups periodically computes the hourly and daily rollups and removes
+// values that are past their retention period.
+func runRollups() {
+	for {
+		rollupHistory(time.Now())
+		time.Sleep(ROLLUP_INTERVAL)
+	}
+}
+
+func rollupHistory(now time.Time) {
+	rolledUntil := make(map[historyTier]time.Duration)
+	for _, tier := range []historyTier{tierHourly, tierDaily} {
+		period := tier.period()
+		// Recompute the last bucket, it may have received late values.
+		from, err := store.LastRollup(tier)
+		if err != nil {
+			log.Println("could not determine last rollup:", err)
+			return
+		}
+		until := time.Duration(now.UnixNano()) / period * period
+		if until > from {
+			err = store.Rollup(tier, from, until)
+			if err != nil {
+				log.Println("could not roll up sensor data:", err)
+				return
+			}
+		}
+		// The next run recomputes the last bucket, from the values in the
+		// finer tier.
+		rolledUntil[tier], err = store.LastRollup(tier)
+		if err != nil {
+			log.Println("could not determine last rollup:", err)
+			return
+		}
+	}
+
+	for _, tier := range []historyTier{tierRaw, tierHourly} {
+		keepUntil := tier.keepUntil(now)
+		if keepUntil.IsZero() {
+			continue
+		}
+		before := time.Duration(keepUntil.UnixNano())
+		if before > rolledUntil[tier+1] {
+			// Never remove values that have not yet been rolled up, or that
+			// will be rolled up again.
+			before = rolledUntil[tier+1]
+		}
+		err := store.Prune(tier, before)
+		if err != nil {
+			log.Println("could not prune sensor data:", err)
+			return
+		}
+	}
+}
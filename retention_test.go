@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setRetention sets the retention flags for the duration of the test.
+func setRetention(t *testing.T, rawDays, hourlyMonths int) {
+	oldRawDays, oldHourlyMonths := *flagKeepRawDays, *flagKeepHourlyMonths
+	*flagKeepRawDays, *flagKeepHourlyMonths = rawDays, hourlyMonths
+	t.Cleanup(func() {
+		*flagKeepRawDays, *flagKeepHourlyMonths = oldRawDays, oldHourlyMonths
+	})
+}
+
+// useStore makes s the store of this process for the duration of the test.
+func useStore(t *testing.T, s Store) {
+	oldStore := store
+	store = s
+	t.Cleanup(func() { store = oldStore })
+}
+
+func TestTierFor(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	rawUntil := now.AddDate(0, 0, -2)
+	hourlyUntil := now.AddDate(0, -1, 0)
+	tests := []struct {
+		rawDays      int
+		hourlyMonths int
+		start        time.Time
+		expected     historyTier
+	}{
+		{2, 1, now, tierRaw},
+		{2, 1, rawUntil, tierRaw},
+		{2, 1, rawUntil.Add(-time.Nanosecond), tierHourly},
+		{2, 1, hourlyUntil, tierHourly},
+		{2, 1, hourlyUntil.Add(-time.Nanosecond), tierDaily},
+		{2, 1, time.Unix(0, 0), tierDaily},
+		{0, 1, time.Unix(0, 0), tierRaw},    // raw values are kept forever
+		{2, 0, time.Unix(0, 0), tierHourly}, // hourly rollups are kept forever
+	}
+	for _, tc := range tests {
+		setRetention(t, tc.rawDays, tc.hourlyMonths)
+		if tier := tierFor(tc.start, now); tier != tc.expected {
+			t.Errorf("keep %d days raw and %d months hourly: tierFor(%s) = %d, expected %d", tc.rawDays, tc.hourlyMonths, tc.start, tier, tc.expected)
+		}
+	}
+}
+
+func TestRollupHistory(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		useStore(t, s)
+		setRetention(t, 1, 1)
+		deviceId := addTestDevice(t, s, "device")
+		sensor, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+
+		const day = 24 * time.Hour
+		now := time.Unix(100*86400+1800, 0)
+		nowNs := time.Duration(now.UnixNano())
+		for i, age := range []time.Duration{40 * day, 2 * day, 10 * time.Minute} {
+			err := s.InsertSample(sensor.dbId, nowNs-age, 60*time.Second, float64(i))
+			if err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+
+		// Running it again recomputes the last buckets, which must give the
+		// same result.
+		for run := 1; run <= 2; run++ {
+			rollupHistory(now)
+
+			// The value of two days ago is past the retention period, but
+			// it is in the last hourly bucket, which is recomputed from the
+			// raw values on the next run. The last value is in the current
+			// hour, so it hasn't been rolled up yet.
+			rows, err := s.FetchSamples(sensor.dbId, 0)
+			if err != nil {
+				t.Fatal("could not fetch samples:", err)
+			}
+			if len(rows) != 2 || rows[0].Value != 1.0 || rows[1].Value != 2.0 {
+				t.Errorf("run %d: got raw values %+v, expected the last two", run, rows)
+			}
+
+			hourly, err := s.FetchHistory(sensor.dbId, tierHourly, 0, nowNs+day, time.Hour)
+			if err != nil {
+				t.Fatal("could not fetch hourly history:", err)
+			}
+			checkBuckets(t, "hourly", hourly, []HistoryBucket{
+				{Time: 98 * 86400, Count: 1, Min: 1, Avg: 1, Max: 1},
+			})
+
+			daily, err := s.FetchHistory(sensor.dbId, tierDaily, 0, nowNs+day, day)
+			if err != nil {
+				t.Fatal("could not fetch daily history:", err)
+			}
+			checkBuckets(t, "daily", daily, []HistoryBucket{
+				{Time: 60 * 86400, Count: 1, Min: 0, Avg: 0, Max: 0},
+				{Time: 98 * 86400, Count: 1, Min: 1, Avg: 1, Max: 1},
+			})
+		}
+	})
+}
+
+func TestHistoryTierSplit(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		useStore(t, s)
+		setRetention(t, 1, 0)
+		deviceId := addTestDevice(t, s, "device")
+		sensor, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		insert := func(logtime int64, value float64) {
+			t.Helper()
+			err := s.InsertSample(sensor.dbId, time.Duration(logtime)*time.Second, 60*time.Second, value)
+			if err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+
+		// History buckets of two hours start at a multiple of two hours.
+		split := time.Now().Unix() / 7200 * 7200
+		insert(split-72*3600+600, 10)
+		insert(split-2*3600+600, 20)
+		rollupHistory(time.Unix(split, 0))
+		// Not rolled up yet, so the history reads these from the raw values.
+		insert(split-3600+600, 30)
+		insert(split, 50)
+
+		reply := sensor.History(split-73*3600, split+3600, 7200, "")
+		if reply == nil {
+			t.Fatal("could not fetch history")
+		}
+		if reply.Bucket != 7200 {
+			t.Errorf("got bucket size %d, expected 7200", reply.Bucket)
+		}
+		checkBuckets(t, "history", reply.History, []HistoryBucket{
+			{Time: split - 72*3600, Count: 1, Min: 10, Avg: 10, Max: 10}, // only in the hourly rollup
+			{Time: split - 7200, Count: 2, Min: 20, Avg: 25, Max: 30},    // hourly rollup and raw value
+			{Time: split, Count: 1, Min: 50, Avg: 50, Max: 50},
+		})
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Rule sets an actuator when a sensor value crosses a threshold, for example
+// "if the temperature is below the desired value minus 0.5 then turn on the
+// heater".
+type Rule struct {
+	Id           int64       `json:"id"`
+	Name         string      `json:"name"`
+	Sensor       string      `json:"sensor"`
+	Operator     string      `json:"operator"`     // '<' or '>'
+	Threshold    float64     `json:"threshold"`    // absolute, or relative to the desired value
+	Relative     bool        `json:"relative"`     // threshold is relative to the desired value of the sensor
+	Hysteresis   float64     `json:"hysteresis"`   // how far the value must come back before the rule is released
+	Cooldown     int64       `json:"cooldown"`     // minimum number of seconds between two actions
+	Actuator     string      `json:"actuator"`     // actuator to set
+	Value        interface{} `json:"value"`        // value to set when the rule triggers
+	ReleaseValue interface{} `json:"releaseValue"` // value to set when the rule is released (optional)
+	Notify       bool        `json:"notify"`       // send a notification when the rule triggers or is released
+	Enabled      bool        `json:"enabled"`
+}
+
+// ruleState is the runtime state of a rule.
+type ruleState struct {
+	*Rule
+	active     bool      // the condition holds
+	lastAction time.Time // last time the actuator was set
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule has no name")
+	}
+	if r.Sensor == "" || r.Actuator == "" {
+		return errors.New("rule needs a sensor and an actuator")
+	}
+	if r.Operator != "<" && r.Operator != ">" {
+		return errors.New("rule operator must be < or >")
+	}
+	if r.Value == nil {
+		return errors.New("rule has no value")
+	}
+	if r.Hysteresis < 0 || r.Cooldown < 0 {
+		return errors.New("hysteresis and cooldown cannot be negative")
+	}
+	return nil
+}
+
+// loadRules loads the rules of this device from the database, keeping the
+// state of rules that were already loaded. The lock must be held.
+func (d *Device) loadRules() {
+	rules, err := store.GetRules(d.dbId)
+	if err != nil {
+		log.Printf("could not load rules of device %d: %s", d.dbId, err)
+		return
+	}
+	states := make([]*ruleState, len(rules))
+	for i, rule := range rules {
+		states[i] = &ruleState{Rule: rule}
+		for _, oldState := range d.rules {
+			if oldState.Id == rule.Id {
+				states[i].active = oldState.active
+				states[i].lastAction = oldState.lastAction
+			}
+		}
+	}
+	d.rules = states
+}
+
+// evaluateRules runs all rules for a new sensor value, received at the given
+// time.
+func (d *Device) evaluateRules(sensor *Sensor, value interface{}, now time.Time) {
+	valueFl, ok := value.(float64)
+	if !ok {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.rules == nil {
+		d.loadRules()
+	}
+
+	for _, rule := range d.rules {
+		if !rule.Enabled || rule.Sensor != sensor.name {
+			continue
+		}
+		threshold := rule.Threshold
+		if rule.Relative {
+			desiredValue, ok := toFloat(sensor.desiredValue)
+			if !ok {
+				// No desired value set.
+				continue
+			}
+			threshold += desiredValue
+		}
+
+		var trigger, release bool
+		switch rule.Operator {
+		case "<":
+			trigger = valueFl < threshold
+			release = valueFl >= threshold+rule.Hysteresis
+		case ">":
+			trigger = valueFl > threshold
+			release = valueFl <= threshold-rule.Hysteresis
+		}
+		if (!rule.active && !trigger) || (rule.active && !release) {
+			continue
+		}
+		if now.Sub(rule.lastAction) < time.Duration(rule.Cooldown)*time.Second {
+			// Try again on the next value.
+			continue
+		}
+
+		rule.active = !rule.active
+		if rule.Notify {
+			if rule.active {
+				d.notify("rule", "Rule "+rule.Name+" triggered", fmt.Sprintf("%s is %v, setting %s to %v.", sensor.name, valueFl, rule.Actuator, rule.Value))
+			} else {
+				d.notify("rule", "Rule "+rule.Name+" released", fmt.Sprintf("%s is %v.", sensor.name, valueFl))
+			}
+		}
+		newValue := rule.Value
+		if !rule.active {
+			newValue = rule.ReleaseValue
+		}
+		if newValue == nil {
+			continue
+		}
+		if *flagVerbose {
+			log.Printf("Rule %s: setting %s to %v (%s=%v)", rule.Name, rule.Actuator, newValue, sensor.name, valueFl)
+		}
+		rule.lastAction = now
+		d.broadcastActuator(rule.Actuator, newValue, "rule "+rule.Name, nil)
+	}
+}
+
+// Rules returns all rules of this device.
+func (d *Device) Rules() []*Rule {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.rules == nil {
+		d.loadRules()
+	}
+	rules := make([]*Rule, len(d.rules))
+	for i, state := range d.rules {
+		rules[i] = state.Rule
+	}
+	return rules
+}
+
+// SaveRule adds a new rule (if the ID is 0) or replaces an existing rule.
+func (d *Device) SaveRule(rule *Rule) error {
+	err := rule.validate()
+	if err != nil {
+		return err
+	}
+	err = d.CheckRule(rule)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	rule.Id, err = store.SaveRule(d.dbId, rule)
+	if err != nil {
+		log.Println("could not save rule:", err)
+		return errors.New("could not save rule")
+	}
+	d.loadRules()
+	return nil
+}
+
+// DeleteRule removes a rule.
+func (d *Device) DeleteRule(id int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := store.DeleteRule(d.dbId, id)
+	if err == errNotFound {
+		return errors.New("unknown rule")
+	} else if err != nil {
+		log.Println("could not delete rule:", err)
+		return errors.New("could not delete rule")
+	}
+	d.loadRules()
+	return nil
+}
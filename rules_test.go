@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestDevice returns a device in a new memory store, with one device
+// connection that gets the actuator values sent to the device.
+func newTestDevice(t *testing.T) (*Device, chan MessageValue) {
+	t.Helper()
+	oldStore := store
+	store = newMemoryStore()
+	t.Cleanup(func() { store = oldStore })
+	return addDevice(t, "device", "house")
+}
+
+// addDevice adds another device to the store of the test, like newTestDevice.
+func addDevice(t *testing.T, serial, name string) (*Device, chan MessageValue) {
+	t.Helper()
+	id := addTestDevice(t, store, serial)
+	sendChan := make(chan MessageValue, 100)
+	d := &Device{
+		DeviceSet:      &DeviceSet{},
+		dbId:           id,
+		name:           name,
+		controls:       make(map[int]*ControlConnection),
+		actuators:      make(map[string]interface{}),
+		actuatorTypes:  make(map[string]*ActuatorType),
+		sensorsSeen:    make(map[string]time.Time),
+		offlineSensors: make(map[string]bool),
+		staleSensors:   make(map[string]bool),
+	}
+	d.connections = map[int]*DeviceConnection{0: {Device: d, SendChan: sendChan}}
+	return d, sendChan
+}
+
+// sentActuator returns the value of the actuator sent to the device since the
+// last call, or nil if nothing was sent. It fails if more than one value was
+// sent.
+func sentActuator(t *testing.T, sendChan chan MessageValue, name string) interface{} {
+	t.Helper()
+	var value interface{}
+	for {
+		select {
+		case msg := <-sendChan:
+			if msg.Name != name {
+				t.Errorf("got value for actuator %s, expected %s", msg.Name, name)
+			}
+			if value != nil {
+				t.Errorf("got more than one value for %s: %v and %v", name, value, msg.Value)
+			}
+			value = msg.Value
+		default:
+			return value
+		}
+	}
+}
+
+// ruleStep is a sensor value that arrives some seconds after the start, with
+// the actuator value that should be sent because of it (nil for nothing).
+type ruleStep struct {
+	seconds  int
+	value    float64
+	expected interface{}
+}
+
+func runRuleSteps(t *testing.T, rule *Rule, sensor *Sensor, steps []ruleStep) {
+	d, sendChan := newTestDevice(t)
+	if _, err := store.SaveRule(d.dbId, rule); err != nil {
+		t.Fatal("could not save rule:", err)
+	}
+	start := time.Unix(1000000, 0)
+	for i, step := range steps {
+		d.evaluateRules(sensor, step.value, start.Add(time.Duration(step.seconds)*time.Second))
+		if got := sentActuator(t, sendChan, rule.Actuator); got != step.expected {
+			t.Errorf("step %d: value %v at %ds set %s to %v, expected %v", i, step.value, step.seconds, rule.Actuator, got, step.expected)
+		}
+	}
+}
+
+func TestRuleTriggerAndRelease(t *testing.T) {
+	rule := &Rule{
+		Name:         "hot",
+		Sensor:       "temp",
+		Operator:     ">",
+		Threshold:    25,
+		Hysteresis:   2,
+		Cooldown:     60,
+		Actuator:     "fan",
+		Value:        true,
+		ReleaseValue: false,
+		Enabled:      true,
+	}
+	runRuleSteps(t, rule, &Sensor{name: "temp"}, []ruleStep{
+		{0, 24, nil},
+		{10, 25, nil}, // the threshold itself doesn't trigger
+		{20, 26, true},
+		{30, 27, nil},   // fires once
+		{40, 24, nil},   // back below the threshold, but within the hysteresis band
+		{50, 22, nil},   // past the band, but within the cooldown
+		{90, 23, false}, // the band is inclusive
+		{100, 26, nil},  // cooldown after the release
+		{160, 26, true},
+	})
+}
+
+func TestRuleBelowRelative(t *testing.T) {
+	rule := &Rule{
+		Name:       "cold",
+		Sensor:     "temp",
+		Operator:   "<",
+		Threshold:  -1,
+		Relative:   true,
+		Hysteresis: 0.5,
+		Actuator:   "heater",
+		Value:      "on",
+		Enabled:    true,
+	}
+	sensor := &Sensor{name: "temp", desiredValue: 20.0}
+	runRuleSteps(t, rule, sensor, []ruleStep{
+		{0, 19.5, nil},
+		{10, 18.9, "on"},
+		{20, 19.2, nil}, // not released yet
+		{30, 19.5, nil}, // released, but there is no release value
+		{40, 18, "on"},
+	})
+
+	// Without a desired value, a relative rule does nothing.
+	runRuleSteps(t, rule, &Sensor{name: "temp"}, []ruleStep{
+		{0, -100, nil},
+	})
+}
+
+func TestRuleIgnored(t *testing.T) {
+	rule := &Rule{
+		Name:      "disabled",
+		Sensor:    "temp",
+		Operator:  ">",
+		Threshold: 25,
+		Actuator:  "fan",
+		Value:     true,
+	}
+	runRuleSteps(t, rule, &Sensor{name: "temp"}, []ruleStep{
+		{0, 30, nil},
+	})
+
+	rule.Enabled = true
+	runRuleSteps(t, rule, &Sensor{name: "humidity"}, []ruleStep{
+		{0, 30, nil},
+	})
+}
+
+func TestRuleSampleQueue(t *testing.T) {
+	d, sendChan := newTestDevice(t)
+	_, err := store.SaveRule(d.dbId, &Rule{
+		Name:      "hot",
+		Sensor:    "temp",
+		Operator:  ">",
+		Threshold: 25,
+		Actuator:  "fan",
+		Value:     true,
+		Enabled:   true,
+	})
+	if err != nil {
+		t.Fatal("could not save rule:", err)
+	}
+	ms := &MQTTServer{}
+	connection := &DeviceConnection{Device: d, samples: make(chan receivedSample, 1)}
+	sensor := &Sensor{name: "temp"}
+
+	// Queueing doesn't run the rules and doesn't block when the queue is full.
+	ms.queueSample(connection, sensor, 30.0)
+	ms.queueSample(connection, sensor, 31.0)
+	if got := sentActuator(t, sendChan, "fan"); got != nil {
+		t.Errorf("fan set to %v before the queue was handled", got)
+	}
+
+	close(connection.samples)
+	ms.sampleServer(connection)
+	if got := sentActuator(t, sendChan, "fan"); got != true {
+		t.Errorf("fan set to %v, expected true", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// Scene is a named set of actuator values that are applied together, for
+// example "movie" to dim the LED and lower the heating.
+type Scene struct {
+	Id        int64                  `json:"id"`
+	Name      string                 `json:"name"`
+	Actuators map[string]interface{} `json:"actuators"` // actuator name -> value
+}
+
+func (s *Scene) validate() error {
+	if s.Name == "" {
+		return errors.New("scene has no name")
+	}
+	if len(s.Actuators) == 0 {
+		return errors.New("scene has no actuators")
+	}
+	for name, value := range s.Actuators {
+		if value == nil {
+			return errors.New("scene has no value for actuator " + name)
+		}
+	}
+	return nil
+}
+
+// Scenes returns all scenes of this device.
+func (d *Device) Scenes() []*Scene {
+	scenes, err := store.GetScenes(d.dbId)
+	if err != nil {
+		log.Printf("could not load scenes of device %d: %s", d.dbId, err)
+		return nil
+	}
+	return scenes
+}
+
+// Scene returns the scene with the given name, or nil if there is no such
+// scene.
+func (d *Device) Scene(name string) *Scene {
+	for _, scene := range d.Scenes() {
+		if scene.Name == name {
+			return scene
+		}
+	}
+	return nil
+}
+
+// SaveScene adds a new scene (if the ID is 0) or replaces an existing scene.
+func (d *Device) SaveScene(scene *Scene) error {
+	err := scene.validate()
+	if err != nil {
+		return err
+	}
+	err = d.CheckScene(scene)
+	if err != nil {
+		return err
+	}
+	scene.Id, err = store.SaveScene(d.dbId, scene)
+	if err != nil {
+		log.Println("could not save scene:", err)
+		return errors.New("could not save scene")
+	}
+	return nil
+}
+
+// DeleteScene removes a scene.
+func (d *Device) DeleteScene(id int64) error {
+	err := store.DeleteScene(d.dbId, id)
+	if err == errNotFound {
+		return errors.New("unknown scene")
+	} else if err != nil {
+		log.Println("could not delete scene:", err)
+		return errors.New("could not delete scene")
+	}
+	return nil
+}
+
+// ApplyScene sets all actuators of the scene. Devices get one message per
+// actuator, but controls get all new values in a single message so they never
+// see a half-applied scene. The source is recorded in the audit log. Nothing
+// is changed if one of the values is not valid for its actuator (anymore).
+func (d *Device) ApplyScene(scene *Scene, source string) error {
+	d.lock.Lock()
+
+	// Check with the lock held, so the actuator types can't change before
+	// the scene is applied.
+	err := d.checkScene(scene)
+	if err != nil {
+		d.lock.Unlock()
+		return err
+	}
+
+	for name, value := range scene.Actuators {
+		d.storeActuator(name, value, source)
+	}
+
+	controlMsg := ControlMessageActuators{
+		Message:   "actuators",
+		Scene:     scene.Name,
+		Actuators: scene.Actuators,
+	}
+	for _, control := range d.controls {
+		control.sendChan <- controlMsg
+	}
+
+	connections := make([]*DeviceConnection, 0, len(d.connections))
+	for _, connection := range d.connections {
+		connections = append(connections, connection)
+	}
+	// A scene may have more actuators than fit in the send queue of the
+	// device, so wait for the device without holding the lock. Actuators
+	// changed in the meantime are sent after the scene.
+	d.sendLock.Lock()
+	defer d.sendLock.Unlock()
+	d.lock.Unlock()
+
+	for name, value := range scene.Actuators {
+		deviceMsg := MessageValue{
+			Message: "actuator",
+			Name:    name,
+			Value:   value,
+		}
+		for _, connection := range connections {
+			connection.SendChan <- deviceMsg
+		}
+	}
+	return nil
+}
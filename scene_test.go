@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSceneValidate(t *testing.T) {
+	tests := []struct {
+		scene *Scene
+		valid bool
+	}{
+		{&Scene{Name: "movie", Actuators: map[string]interface{}{"led": "#000000"}}, true},
+		{&Scene{Actuators: map[string]interface{}{"led": "#000000"}}, false},
+		{&Scene{Name: "movie"}, false},
+		{&Scene{Name: "movie", Actuators: map[string]interface{}{"led": nil}}, false},
+	}
+	for _, tc := range tests {
+		err := tc.scene.validate()
+		if (err == nil) != tc.valid {
+			t.Errorf("scene %+v: got error %v, expected valid=%v", tc.scene, err, tc.valid)
+		}
+	}
+}
+
+func TestSaveScene(t *testing.T) {
+	d, _ := newTestDevice(t)
+	d.actuatorTypes["heater"] = &ActuatorType{Type: ActuatorBoolean}
+
+	invalid := &Scene{Name: "away", Actuators: map[string]interface{}{"heater": "off"}}
+	if err := d.SaveScene(invalid); err == nil {
+		t.Error("saved a scene with an invalid actuator value")
+	}
+	if d.Scene("away") != nil {
+		t.Error("invalid scene was stored")
+	}
+
+	scene := &Scene{Name: "away", Actuators: map[string]interface{}{"heater": false, "led": "#000000"}}
+	if err := d.SaveScene(scene); err != nil {
+		t.Fatal("could not save scene:", err)
+	}
+	if scene.Id == 0 {
+		t.Error("saved scene has no ID")
+	}
+	if got := d.Scene("away"); got == nil || !reflect.DeepEqual(got, scene) {
+		t.Errorf("got scene %+v, expected %+v", got, scene)
+	}
+
+	// The type may change after the scene was saved.
+	d.actuatorTypes["led"] = &ActuatorType{Type: ActuatorEnum, Values: []string{"on", "off"}}
+	if err := d.CheckScene(scene); err == nil {
+		t.Error("scene with a value that is no longer valid passed the check")
+	}
+
+	if err := d.DeleteScene(scene.Id); err != nil {
+		t.Error("could not delete scene:", err)
+	}
+	if err := d.DeleteScene(scene.Id); err == nil {
+		t.Error("deleted an unknown scene")
+	}
+}
+
+func TestApplyScene(t *testing.T) {
+	d, _ := newTestDevice(t)
+	// A send queue that is shorter than the scene.
+	sendChan := make(chan MessageValue, 1)
+	d.connections[0].SendChan = sendChan
+	controlChan := make(chan interface{}, 10)
+	d.AddControl(&User{name: "alice"}, &Permissions{Role: RoleAdmin}, "", "", controlChan)
+
+	scene := &Scene{
+		Name: "movie",
+		Actuators: map[string]interface{}{
+			"led":    "#200000",
+			"heater": true,
+			"blinds": 80.0,
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		if err := d.ApplyScene(scene, "user alice"); err != nil {
+			t.Error("could not apply scene:", err)
+		}
+		close(done)
+	}()
+
+	// Controls get all values at once, before the device got them.
+	msg := <-controlChan
+	expected := ControlMessageActuators{
+		Message:   "actuators",
+		Scene:     "movie",
+		Actuators: scene.Actuators,
+	}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("got control message %#v, expected %#v", msg, expected)
+	}
+
+	// The device lock is not held while waiting for the device.
+	if actuators := d.Actuators(); !reflect.DeepEqual(actuators, scene.Actuators) {
+		t.Errorf("got actuators %v, expected %v", actuators, scene.Actuators)
+	}
+
+	// A change while the scene is being sent reaches the device after it.
+	changed := make(chan struct{})
+	go func() {
+		d.SetActuator("led", "#000000", "user bob")
+		close(changed)
+	}()
+
+	sent := make(map[string]interface{})
+	for len(sent) < len(scene.Actuators) {
+		msg := <-sendChan
+		sent[msg.Name] = msg.Value
+	}
+	<-done
+	if !reflect.DeepEqual(sent, scene.Actuators) {
+		t.Errorf("sent %v to the device, expected %v", sent, scene.Actuators)
+	}
+	if msg := <-sendChan; msg.Name != "led" || msg.Value != "#000000" {
+		t.Errorf("got %s=%v after the scene, expected led=#000000", msg.Name, msg.Value)
+	}
+	<-changed
+	<-controlChan
+	if len(controlChan) != 0 {
+		t.Errorf("%d more messages sent to the control", len(controlChan))
+	}
+
+	// Scenes with values that are no longer valid change nothing.
+	d.actuatorTypes["heater"] = &ActuatorType{Type: ActuatorEnum, Values: []string{"on", "off"}}
+	if err := d.ApplyScene(scene, "user alice"); err == nil {
+		t.Error("applied a scene with an invalid value")
+	}
+	if actuators := d.Actuators(); actuators["led"] != "#000000" {
+		t.Errorf("invalid scene changed the actuators: %v", actuators)
+	}
+	if len(sendChan) != 0 || len(controlChan) != 0 {
+		t.Errorf("invalid scene sent %d and %d messages", len(sendChan), len(controlChan))
+	}
+}
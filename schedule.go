@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var flagLatitude = flag.Float64("latitude", 0, "latitude of the house, for sunrise/sunset schedules")
+var flagLongitude = flag.Float64("longitude", 0, "longitude of the house (east is positive), for sunrise/sunset schedules")
+
+// Schedule sets an actuator at fixed times. The trigger is either a cron
+// expression in local time ("minute hour day-of-month month day-of-week", for
+// example "0 22 * * 1-5") or a sun event with an optional offset and
+// day-of-week field (for example "sunset-30m" or "sunrise+15m 1-5").
+type Schedule struct {
+	Id       int64       `json:"id"`
+	Name     string      `json:"name"`
+	Trigger  string      `json:"trigger"`
+	Actuator string      `json:"actuator"`
+	Value    interface{} `json:"value"`
+	Enabled  bool        `json:"enabled"`
+}
+
+// scheduleState is a loaded schedule with its parsed trigger.
+type scheduleState struct {
+	*Schedule
+	trigger trigger
+}
+
+// trigger decides whether a schedule fires in the given minute.
+type trigger interface {
+	matches(t time.Time) bool
+}
+
+func (s *Schedule) validate() (trigger, error) {
+	if s.Name == "" {
+		return nil, errors.New("schedule has no name")
+	}
+	if s.Actuator == "" || s.Value == nil {
+		return nil, errors.New("schedule needs an actuator and a value")
+	}
+	return parseTrigger(s.Trigger)
+}
+
+func parseTrigger(spec string) (trigger, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, errors.New("empty trigger")
+	}
+	for _, event := range []string{"sunrise", "sunset"} {
+		if !strings.HasPrefix(fields[0], event) {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, errors.New("expected sun event, offset and optional day-of-week")
+		}
+		if *flagLatitude == 0 && *flagLongitude == 0 {
+			return nil, errors.New("no location configured for sun events")
+		}
+		sun := &sunTrigger{
+			sunset: event == "sunset",
+		}
+		if offset := fields[0][len(event):]; offset != "" {
+			if offset[0] != '+' && offset[0] != '-' {
+				return nil, fmt.Errorf("invalid sun event: %s", fields[0])
+			}
+			var err error
+			sun.offset, err = time.ParseDuration(offset)
+			if err != nil {
+				return nil, fmt.Errorf("invalid offset: %s", offset)
+			}
+			// Only the sun events of the adjacent days are checked.
+			if sun.offset <= -24*time.Hour || sun.offset >= 24*time.Hour {
+				return nil, fmt.Errorf("offset must be less than a day: %s", offset)
+			}
+		}
+		weekdays := "*"
+		if len(fields) == 2 {
+			weekdays = fields[1]
+		}
+		var err error
+		sun.weekdays, err = parseCronField(weekdays, 0, 7)
+		if err != nil {
+			return nil, err
+		}
+		sun.weekdays = fixSunday(sun.weekdays)
+		return sun, nil
+	}
+	return parseCron(fields)
+}
+
+// cronTrigger is a parsed cron expression. Every field is a bitmap of the
+// allowed values.
+type cronTrigger struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	anyDayOfMonth, anyDayOfWeek                bool
+}
+
+func parseCron(fields []string) (*cronTrigger, error) {
+	if len(fields) != 5 {
+		return nil, errors.New("expected 5 fields in cron expression")
+	}
+	ranges := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var values [5]uint64
+	for i, field := range fields {
+		var err error
+		values[i], err = parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cronTrigger{
+		minute:        values[0],
+		hour:          values[1],
+		dayOfMonth:    values[2],
+		month:         values[3],
+		dayOfWeek:     fixSunday(values[4]),
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b), steps
+// (*/n, a-b/n, a/n which is a-max/n) or a wildcard (*) into a bitmap.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		hasStep := false
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in cron field: %s", field)
+			}
+			part = part[:i]
+			hasStep = true
+		}
+		start, end := min, max
+		if part != "*" {
+			var err error
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				start, err = strconv.Atoi(part[:i])
+				if err == nil {
+					end, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				start, err = strconv.Atoi(part)
+				end = start
+				if hasStep {
+					end = max
+				}
+			}
+			if err != nil || start < min || end > max || start > end {
+				return 0, fmt.Errorf("invalid cron field: %s", field)
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// fixSunday makes day 7 an alias of day 0 (Sunday).
+func fixSunday(weekdays uint64) uint64 {
+	if weekdays&(1<<7) != 0 {
+		weekdays |= 1
+	}
+	return weekdays
+}
+
+func (c *cronTrigger) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dayOfMonth := c.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := c.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if !c.anyDayOfMonth && !c.anyDayOfWeek {
+		// Like cron: either of them must match when both are restricted.
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// sunTrigger fires at sunrise or sunset, plus an offset.
+type sunTrigger struct {
+	sunset   bool
+	offset   time.Duration
+	weekdays uint64
+}
+
+// matches also checks the sun events of the day before and after, as the
+// offset may move the time to another day, like sunset+5h. The days of the
+// week are those of the sun event.
+func (s *sunTrigger) matches(t time.Time) bool {
+	for _, days := range []int{-1, 0, 1} {
+		day := t.AddDate(0, 0, days)
+		if s.weekdays&(1<<uint(day.Weekday())) == 0 {
+			continue
+		}
+		sunrise, sunset, ok := sunTimes(day, *flagLatitude, *flagLongitude)
+		if !ok {
+			continue
+		}
+		event := sunrise
+		if s.sunset {
+			event = sunset
+		}
+		if event.Add(s.offset).Truncate(time.Minute).Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSchedules loads the schedules of this device from the database. The lock
+// must be held.
+func (d *Device) loadSchedules() {
+	schedules, err := store.GetSchedules(d.dbId)
+	if err != nil {
+		log.Printf("could not load schedules of device %d: %s", d.dbId, err)
+		return
+	}
+	states := make([]*scheduleState, 0, len(schedules))
+	for _, schedule := range schedules {
+		trigger, err := schedule.validate()
+		if err != nil {
+			log.Printf("ignoring schedule %s: %s", schedule.Name, err)
+			continue
+		}
+		states = append(states, &scheduleState{schedule, trigger})
+	}
+	d.schedules = states
+}
+
+// runScheduled applies all schedules that fire in the given minute.
+func (d *Device) runScheduled(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.schedules == nil {
+		d.loadSchedules()
+	}
+	for _, schedule := range d.schedules {
+		if !schedule.Enabled || !schedule.trigger.matches(t) {
+			continue
+		}
+		if *flagVerbose {
+			log.Printf("Schedule %s: setting %s to %v", schedule.Name, schedule.Actuator, schedule.Value)
+		}
+		d.broadcastActuator(schedule.Actuator, schedule.Value, "schedule "+schedule.Name, nil)
+	}
+}
+
+// runSchedules runs the schedules of all devices, once every minute.
+func runSchedules(ds *DeviceSet) {
+	last := time.Now().Truncate(time.Minute)
+	for {
+		time.Sleep(time.Until(last.Add(time.Minute)))
+		now := time.Now().Truncate(time.Minute)
+		if now.Sub(last) > 10*time.Minute {
+			// The clock jumped (or the system was suspended), don't replay
+			// everything that was missed.
+			last = now.Add(-time.Minute)
+		}
+		for t := last.Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+			for _, device := range ds.allDevices() {
+				device.runScheduled(t.Local())
+			}
+		}
+		if now.After(last) {
+			last = now
+		}
+	}
+}
+
+// Schedules returns all schedules of this device.
+func (d *Device) Schedules() []*Schedule {
+	schedules, err := store.GetSchedules(d.dbId)
+	if err != nil {
+		log.Printf("could not load schedules of device %d: %s", d.dbId, err)
+		return nil
+	}
+	// Also returns schedules that fail to parse (for example, because the
+	// location was removed), so they can be fixed or deleted.
+	return schedules
+}
+
+// SaveSchedule adds a new schedule (if the ID is 0) or replaces an existing
+// schedule.
+func (d *Device) SaveSchedule(schedule *Schedule) error {
+	_, err := schedule.validate()
+	if err != nil {
+		return err
+	}
+	err = d.CheckSchedule(schedule)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	schedule.Id, err = store.SaveSchedule(d.dbId, schedule)
+	if err != nil {
+		log.Println("could not save schedule:", err)
+		return errors.New("could not save schedule")
+	}
+	d.loadSchedules()
+	return nil
+}
+
+// DeleteSchedule removes a schedule.
+func (d *Device) DeleteSchedule(id int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := store.DeleteSchedule(d.dbId, id)
+	if err == errNotFound {
+		return errors.New("unknown schedule")
+	} else if err != nil {
+		log.Println("could not delete schedule:", err)
+		return errors.New("could not delete schedule")
+	}
+	d.loadSchedules()
+	return nil
+}
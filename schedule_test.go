@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// bits returns a bitmap with the given values set.
+func bits(values ...int) uint64 {
+	var b uint64
+	for _, value := range values {
+		b |= 1 << uint(value)
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		expected uint64
+	}{
+		{"*", 0, 59, 1<<60 - 1},
+		{"*", 1, 12, bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)},
+		{"5", 0, 59, bits(5)},
+		{"1-3", 0, 23, bits(1, 2, 3)},
+		{"1,3,5", 0, 7, bits(1, 3, 5)},
+		{"1-2,10", 0, 23, bits(1, 2, 10)},
+		{"*/15", 0, 59, bits(0, 15, 30, 45)},
+		{"*/5", 1, 12, bits(1, 6, 11)},
+		{"10-20/5", 0, 59, bits(10, 15, 20)},
+		{"0,30-40/5", 0, 59, bits(0, 30, 35, 40)},
+		{"7", 0, 7, bits(7)},
+		{"5/15", 0, 59, bits(5, 20, 35, 50)},
+		{"9/2", 1, 12, bits(9, 11)},
+		{"1-3,20/20", 0, 59, bits(1, 2, 3, 20, 40)},
+	}
+	for _, tc := range tests {
+		got, err := parseCronField(tc.field, tc.min, tc.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %s", tc.field, err)
+		} else if got != tc.expected {
+			t.Errorf("parseCronField(%q) = %b, expected %b", tc.field, got, tc.expected)
+		}
+	}
+
+	for _, field := range []string{"", "60", "0", "a", "5-1", "1-", "-1", "1-32", "*/0", "*/x", "1,,2", "1-3/-1"} {
+		if _, err := parseCronField(field, 1, 31); err == nil {
+			t.Errorf("parseCronField(%q): expected an error", field)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec    string
+		time    time.Time
+		matches bool
+	}{
+		// Weekday evenings. 2024-06-21 is a Friday.
+		{"0 22 * * 1-5", date(2024, 6, 21, 22, 0), true},
+		{"0 22 * * 1-5", date(2024, 6, 21, 22, 1), false},
+		{"0 22 * * 1-5", date(2024, 6, 21, 21, 0), false},
+		{"0 22 * * 1-5", date(2024, 6, 22, 22, 0), false},
+		// Sunday is both 0 and 7.
+		{"0 0 * * 7", date(2024, 6, 23, 0, 0), true},
+		{"0 0 * * 0", date(2024, 6, 23, 0, 0), true},
+		{"0 0 * * 7", date(2024, 6, 24, 0, 0), false},
+		// Day of month.
+		{"30 7 1 * *", date(2024, 7, 1, 7, 30), true},
+		{"30 7 1 * *", date(2024, 7, 2, 7, 30), false},
+		// When both day fields are restricted, either may match. 2024-09-13
+		// is a Friday, 2024-10-13 a Sunday.
+		{"0 12 13 * 5", date(2024, 9, 13, 12, 0), true},
+		{"0 12 13 * 5", date(2024, 9, 20, 12, 0), true},
+		{"0 12 13 * 5", date(2024, 10, 13, 12, 0), true},
+		{"0 12 13 * 5", date(2024, 10, 14, 12, 0), false},
+		// A restricted day of week with a wildcard day of month.
+		{"0 12 * * 5", date(2024, 10, 13, 12, 0), false},
+		// Steps and months.
+		{"*/15 * * 2 *", date(2024, 2, 10, 10, 45), true},
+		{"*/15 * * 2 *", date(2024, 2, 10, 10, 46), false},
+		{"*/15 * * 2 *", date(2024, 3, 10, 10, 45), false},
+		{"0 8-18/2 * * *", date(2024, 3, 10, 14, 0), true},
+		{"0 8-18/2 * * *", date(2024, 3, 10, 15, 0), false},
+		{"0 9/4 * * *", date(2024, 3, 10, 21, 0), true},
+		{"0 9/4 * * *", date(2024, 3, 10, 1, 0), false},
+	}
+	for _, tc := range tests {
+		trigger, err := parseTrigger(tc.spec)
+		if err != nil {
+			t.Errorf("parseTrigger(%q): %s", tc.spec, err)
+			continue
+		}
+		if got := trigger.matches(tc.time); got != tc.matches {
+			t.Errorf("%q at %s: got %v, expected %v", tc.spec, tc.time.Format("Mon 2006-01-02 15:04"), got, tc.matches)
+		}
+	}
+}
+
+func TestParseTrigger(t *testing.T) {
+	oldLatitude, oldLongitude := *flagLatitude, *flagLongitude
+	defer func() { *flagLatitude, *flagLongitude = oldLatitude, oldLongitude }()
+
+	*flagLatitude, *flagLongitude = 0, 0
+	if _, err := parseTrigger("sunset"); err == nil {
+		t.Error("sun event without a location: expected an error")
+	}
+
+	*flagLatitude, *flagLongitude = 52.37, 4.90
+	valid := []string{"0 22 * * 1-5", "sunset", "sunrise+15m", "sunset-1h30m", "sunrise 1-5", "sunset-30m 0,6", "sunset+23h59m", "sunrise-23h59m"}
+	for _, spec := range valid {
+		if _, err := parseTrigger(spec); err != nil {
+			t.Errorf("parseTrigger(%q): %s", spec, err)
+		}
+	}
+	invalid := []string{"", "0 22 * *", "0 22 * * * *", "60 22 * * *", "sunset30m", "sunrise+x", "sunset 1-5 extra", "sunrise 8", "sunset+24h", "sunrise-25h"}
+	for _, spec := range invalid {
+		if _, err := parseTrigger(spec); err == nil {
+			t.Errorf("parseTrigger(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestSunTriggerMatches(t *testing.T) {
+	oldLatitude, oldLongitude := *flagLatitude, *flagLongitude
+	defer func() { *flagLatitude, *flagLongitude = oldLatitude, oldLongitude }()
+	*flagLatitude, *flagLongitude = 52.37, 4.90
+
+	// Sunset in Amsterdam on Friday 2024-06-21 is at 22:06 CEST.
+	cest := time.FixedZone("CEST", 2*3600)
+	_, sunset, _ := sunTimes(time.Date(2024, 6, 21, 12, 0, 0, 0, cest), *flagLatitude, *flagLongitude)
+	sunset = sunset.Truncate(time.Minute)
+	_, thursdaySunset, _ := sunTimes(time.Date(2024, 6, 20, 12, 0, 0, 0, cest), *flagLatitude, *flagLongitude)
+	thursdaySunset = thursdaySunset.Truncate(time.Minute)
+	tests := []struct {
+		spec    string
+		time    time.Time
+		matches bool
+	}{
+		{"sunset", sunset, true},
+		{"sunset", sunset.Add(time.Minute), false},
+		{"sunset-30m", sunset.Add(-30 * time.Minute), true},
+		{"sunset-30m", sunset, false},
+		{"sunset+1h", sunset.Add(time.Hour), true},
+		{"sunrise", sunset, false},
+		{"sunset 1-5", sunset, true},
+		{"sunset 0,6", sunset, false},
+		// Offsets that cross midnight fire on the next or previous day, on
+		// the days of the week of the sun event.
+		{"sunset+5h", sunset.Add(5 * time.Hour), true},
+		{"sunset+5h 5", sunset.Add(5 * time.Hour), true},
+		{"sunset+5h 6", sunset.Add(5 * time.Hour), false},
+		{"sunset+5h 4", thursdaySunset.Add(5 * time.Hour), true},
+		{"sunset+5h 4", sunset.Add(5 * time.Hour), false},
+		{"sunset-23h", sunset.Add(-23 * time.Hour), true},
+		{"sunset-23h 5", sunset.Add(-23 * time.Hour), true},
+		{"sunset-23h 4", sunset.Add(-23 * time.Hour), false},
+	}
+	for _, tc := range tests {
+		trigger, err := parseTrigger(tc.spec)
+		if err != nil {
+			t.Errorf("parseTrigger(%q): %s", tc.spec, err)
+			continue
+		}
+		if got := trigger.matches(tc.time); got != tc.matches {
+			t.Errorf("%q at %s: got %v, expected %v", tc.spec, tc.time.Format("Mon 2006-01-02 15:04"), got, tc.matches)
+		}
+	}
+}
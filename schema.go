@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migrations contains the statements to bring the log database from one
+// schema version to the next. Migration i upgrades the database from version i
+// to version i+1. Never change a migration once it has been released, append a
+// new one instead.
+var migrations = [][]string{
+	// 1: initial schema. Use IF NOT EXISTS so databases created by hand before
+	// there were migrations are adopted as-is.
+	{
+		`CREATE TABLE IF NOT EXISTS devices (
+			id     INTEGER PRIMARY KEY AUTOINCREMENT,
+			serial TEXT NOT NULL UNIQUE,
+			name   TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS sensors (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId     INTEGER NOT NULL REFERENCES devices(id),
+			name         TEXT NOT NULL,
+			type         TEXT NOT NULL,
+			humanName    TEXT NOT NULL DEFAULT '',
+			desiredValue REAL,
+			UNIQUE (deviceId, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS sensorData (
+			sensorId INTEGER NOT NULL REFERENCES sensors(id),
+			time     INTEGER NOT NULL,
+			value    REAL,
+			interval INTEGER NOT NULL DEFAULT 0
+		)`,
+		// Used by all range scans over the log.
+		`CREATE INDEX IF NOT EXISTS sensorData_sensorId_time ON sensorData (sensorId, time)`,
+	},
+	// 2: hourly and daily rollups of sensorData.
+	{
+		`CREATE TABLE sensorDataHourly (
+			sensorId INTEGER NOT NULL REFERENCES sensors(id),
+			time     INTEGER NOT NULL,
+			minValue REAL NOT NULL,
+			maxValue REAL NOT NULL,
+			sumValue REAL NOT NULL,
+			weight   REAL NOT NULL,
+			count    INTEGER NOT NULL,
+			PRIMARY KEY (sensorId, time)
+		)`,
+		`CREATE TABLE sensorDataDaily (
+			sensorId INTEGER NOT NULL REFERENCES sensors(id),
+			time     INTEGER NOT NULL,
+			minValue REAL NOT NULL,
+			maxValue REAL NOT NULL,
+			sumValue REAL NOT NULL,
+			weight   REAL NOT NULL,
+			count    INTEGER NOT NULL,
+			PRIMARY KEY (sensorId, time)
+		)`,
+		`CREATE INDEX sensorDataHourly_time ON sensorDataHourly (time)`,
+		`CREATE INDEX sensorDataDaily_time ON sensorDataDaily (time)`,
+		`CREATE INDEX sensorData_time ON sensorData (time)`,
+	},
+	// 3: user accounts and API tokens.
+	{
+		`CREATE TABLE users (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			name         TEXT NOT NULL UNIQUE,
+			passwordHash TEXT NOT NULL
+		)`,
+		`CREATE TABLE userDevices (
+			userId   INTEGER NOT NULL REFERENCES users(id),
+			deviceId INTEGER NOT NULL REFERENCES devices(id),
+			PRIMARY KEY (userId, deviceId)
+		)`,
+		`CREATE TABLE tokens (
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			userId  INTEGER NOT NULL REFERENCES users(id),
+			name    TEXT NOT NULL DEFAULT '',
+			hash    TEXT NOT NULL UNIQUE,
+			created INTEGER NOT NULL,
+			revoked INTEGER
+		)`,
+	},
+	// 4: roles and per-actuator/per-sensor grants. Existing users keep full
+	// access.
+	{
+		`ALTER TABLE userDevices ADD COLUMN role TEXT NOT NULL DEFAULT 'admin'`,
+		`CREATE TABLE grants (
+			userId   INTEGER NOT NULL REFERENCES users(id),
+			deviceId INTEGER NOT NULL REFERENCES devices(id),
+			kind     TEXT NOT NULL,
+			name     TEXT NOT NULL,
+			PRIMARY KEY (userId, deviceId, kind, name)
+		)`,
+	},
+	// 5: last known actuator values, as JSON.
+	{
+		`CREATE TABLE actuators (
+			deviceId INTEGER NOT NULL REFERENCES devices(id),
+			name     TEXT NOT NULL,
+			value    TEXT NOT NULL,
+			PRIMARY KEY (deviceId, name)
+		)`,
+	},
+	// 6: audit log of actuator changes. Values are stored as JSON.
+	{
+		`CREATE TABLE actuatorHistory (
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId INTEGER NOT NULL REFERENCES devices(id),
+			name     TEXT NOT NULL,
+			time     INTEGER NOT NULL,
+			value    TEXT NOT NULL,
+			previous TEXT,
+			source   TEXT NOT NULL
+		)`,
+		`CREATE INDEX actuatorHistory_deviceId_time ON actuatorHistory (deviceId, time)`,
+	},
+	// 7: rules that set actuators based on sensor values.
+	{
+		`CREATE TABLE rules (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId     INTEGER NOT NULL REFERENCES devices(id),
+			name         TEXT NOT NULL,
+			sensor       TEXT NOT NULL,
+			operator     TEXT NOT NULL,
+			threshold    REAL NOT NULL,
+			relative     INTEGER NOT NULL,
+			hysteresis   REAL NOT NULL,
+			cooldown     INTEGER NOT NULL,
+			actuator     TEXT NOT NULL,
+			value        TEXT NOT NULL,
+			releaseValue TEXT,
+			enabled      INTEGER NOT NULL
+		)`,
+	},
+	// 8: thermostats.
+	{
+		`CREATE TABLE thermostats (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId      INTEGER NOT NULL REFERENCES devices(id),
+			sensor        TEXT NOT NULL,
+			actuator      TEXT NOT NULL,
+			onValue       TEXT NOT NULL,
+			offValue      TEXT NOT NULL,
+			fallbackValue TEXT NOT NULL,
+			hysteresis    REAL NOT NULL,
+			minOnTime     INTEGER NOT NULL,
+			minOffTime    INTEGER NOT NULL,
+			timeout       INTEGER NOT NULL,
+			enabled       INTEGER NOT NULL,
+			UNIQUE (deviceId, sensor)
+		)`,
+	},
+	// 9: schedules.
+	{
+		`CREATE TABLE schedules (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId    INTEGER NOT NULL REFERENCES devices(id),
+			name        TEXT NOT NULL,
+			triggerSpec TEXT NOT NULL,
+			actuator    TEXT NOT NULL,
+			value       TEXT NOT NULL,
+			enabled     INTEGER NOT NULL
+		)`,
+	},
+	// 10: scenes.
+	{
+		`CREATE TABLE scenes (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId  INTEGER NOT NULL REFERENCES devices(id),
+			name      TEXT NOT NULL,
+			actuators TEXT NOT NULL,
+			UNIQUE (deviceId, name)
+		)`,
+	},
+	// 11: actuator types, as JSON.
+	{
+		`CREATE TABLE actuatorTypes (
+			deviceId   INTEGER NOT NULL REFERENCES devices(id),
+			name       TEXT NOT NULL,
+			definition TEXT NOT NULL,
+			PRIMARY KEY (deviceId, name)
+		)`,
+	},
+	// 12: non-numeric sensor values. These are stored as JSON in the data
+	// column, with a NULL value so they are left out of the rollups.
+	{
+		`ALTER TABLE sensors ADD COLUMN valueType TEXT NOT NULL DEFAULT 'number'`,
+		`ALTER TABLE sensorData ADD COLUMN data TEXT`,
+	},
+	// 13: sensor units.
+	{
+		`ALTER TABLE sensors ADD COLUMN unit TEXT NOT NULL DEFAULT ''`,
+	},
+	// 14: notifications from rules.
+	{
+		`ALTER TABLE rules ADD COLUMN notify INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 15: sensor alarm limits and alarms. Alarms refer to sensors by name,
+	// like rules.
+	{
+		`ALTER TABLE sensors ADD COLUMN alarmMin REAL`,
+		`ALTER TABLE sensors ADD COLUMN alarmMax REAL`,
+		`CREATE TABLE alarms (
+			id             INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId       INTEGER NOT NULL REFERENCES devices(id),
+			sensor         TEXT NOT NULL,
+			kind           TEXT NOT NULL,
+			state          TEXT NOT NULL,
+			threshold      REAL NOT NULL,
+			value          REAL NOT NULL,
+			unit           TEXT NOT NULL,
+			raised         INTEGER NOT NULL,
+			acknowledged   INTEGER NOT NULL DEFAULT 0,
+			acknowledgedBy TEXT NOT NULL DEFAULT '',
+			cleared        INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX alarms_deviceId_state ON alarms (deviceId, state)`,
+	},
+	// 16: the time and interval of the last value of each sensor, kept on the
+	// sensor as retention removes old values from sensorData.
+	{
+		`ALTER TABLE sensors ADD COLUMN lastSampleTime INTEGER`,
+		`ALTER TABLE sensors ADD COLUMN lastSampleInterval INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE sensors SET lastSampleTime = (SELECT MAX(time) FROM sensorData WHERE sensorId = sensors.id)`,
+		`UPDATE sensors SET lastSampleInterval = COALESCE((SELECT MAX(interval) FROM sensorData WHERE sensorId = sensors.id AND time = sensors.lastSampleTime), 0)`,
+	},
+	// 17: alarm hysteresis.
+	{
+		`ALTER TABLE sensors ADD COLUMN alarmHysteresis REAL NOT NULL DEFAULT 0`,
+	},
+}
+
+// migrateDatabase creates the schema in an empty database, or upgrades an
+// existing database to the latest schema version. Migrations are written for
+// SQLite, column types are translated for other databases.
+func migrateDatabase(db *sql.DB, dialect *sqlDialect) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schemaVersion (version INTEGER NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("could not create schema version table: %s", err)
+	}
+
+	var version int
+	err = db.QueryRow("SELECT version FROM schemaVersion").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = db.Exec("INSERT INTO schemaVersion (version) VALUES (0)")
+		if err != nil {
+			return fmt.Errorf("could not initialize schema version: %s", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not read schema version: %s", err)
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than supported (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		if *flagVerbose {
+			log.Printf("Migrating database schema to version %d", version+1)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range migrations[version] {
+			_, err := tx.Exec(dialect.types.Replace(statement))
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("could not migrate to schema version %d: %s", version+1, err)
+			}
+		}
+		_, err = tx.Exec(dialect.rebind("UPDATE schemaVersion SET version=?"), version+1)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not update schema version: %s", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("could not migrate to schema version %d: %s", version+1, err)
+		}
+	}
+
+	return nil
+}
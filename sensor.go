@@ -1,39 +1,139 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MAX_HUMAN_NAME = 64 // maximum length of a sensor name in characters
+
+// Kinds of sensor values. Only numbers are aggregated into history graphs.
+const (
+	ValueNumber  = "number"
+	ValueBoolean = "boolean"
+	ValueString  = "string"
+	ValueJSON    = "json" // JSON object or array
 )
 
 type Sensor struct {
-	deviceId     int64
-	dbId         int64
-	name         string
-	sensorType   string
-	humanName    string
-	desiredValue interface{}
+	deviceId        int64
+	dbId            int64
+	name            string
+	sensorType      string
+	valueType       string
+	unit            string
+	humanName       string
+	desiredValue    interface{}
+	alarmMin        interface{} // raise an alarm below this value (nil for no limit)
+	alarmMax        interface{} // raise an alarm above this value (nil for no limit)
+	alarmHysteresis float64     // how far the value must come back within the limits before the alarm clears
 }
 
 type LogReply struct {
-	Name         string        `json:"name"`
-	HumanName    string        `json:"humanName"`
-	DesiredValue interface{}   `json:"desiredValue"`
-	Type         string        `json:"type"`
-	Log          []LogReplyRow `json:"log"`
+	Name            string        `json:"name"`
+	HumanName       string        `json:"humanName"`
+	DesiredValue    interface{}   `json:"desiredValue"`
+	AlarmMin        interface{}   `json:"alarmMin"`
+	AlarmMax        interface{}   `json:"alarmMax"`
+	AlarmHysteresis float64       `json:"alarmHysteresis"`
+	Type            string        `json:"type"`
+	ValueType       string        `json:"valueType"`
+	Unit            string        `json:"unit"`
+	Stale           bool          `json:"stale"` // several reporting intervals passed without a value
+	Log             []LogReplyRow `json:"log"`
+}
+
+// SensorInfo describes a sensor, without its log.
+type SensorInfo struct {
+	Name            string      `json:"name"`
+	HumanName       string      `json:"humanName"`
+	DesiredValue    interface{} `json:"desiredValue"`
+	AlarmMin        interface{} `json:"alarmMin"`
+	AlarmMax        interface{} `json:"alarmMax"`
+	AlarmHysteresis float64     `json:"alarmHysteresis"`
+	Type            string      `json:"type"`
+	ValueType       string      `json:"valueType"`
+	Unit            string      `json:"unit"`
+}
+
+// SensorUpdate is a change to the metadata of a sensor. Fields that are left
+// out are not changed.
+type SensorUpdate struct {
+	HumanName       *string         `json:"humanName"`
+	Unit            *string         `json:"unit"`            // unit of the values sent by the device
+	DesiredValue    json.RawMessage `json:"desiredValue"`    // number, or null to unset
+	AlarmMin        json.RawMessage `json:"alarmMin"`        // number, or null to unset
+	AlarmMax        json.RawMessage `json:"alarmMax"`        // number, or null to unset
+	AlarmHysteresis *float64        `json:"alarmHysteresis"` // how far the value must come back before the alarm clears
 }
 
 type LogReplyRow struct {
-	Time     int64   `json:"time"`
-	Interval int64   `json:"interval"`
-	Value    float64 `json:"value"`
+	Time     int64       `json:"time"`
+	Interval int64       `json:"interval"`
+	Value    interface{} `json:"value"` // type depends on the value type of the sensor
 }
 
-func GetSensor(deviceId int64, name string) *Sensor {
-	sensor := &Sensor{
-		deviceId: deviceId,
-		name:     name,
+// HistoryReply is a downsampled sensor log.
+type HistoryReply struct {
+	Name    string          `json:"name"`
+	Unit    string          `json:"unit"`
+	Start   int64           `json:"start"`
+	End     int64           `json:"end"`
+	Bucket  int64           `json:"bucket"`
+	History []HistoryBucket `json:"history"`
+}
+
+// HistoryBucket aggregates all values logged in [Time, Time+bucket).
+type HistoryBucket struct {
+	Time  int64   `json:"time"`
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Avg   float64 `json:"avg"`
+	Max   float64 `json:"max"`
+
+	// Needed to merge buckets.
+	sum    float64
+	weight float64
+}
+
+// toFloat converts a numeric value as read from JSON or the database to a
+// float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// valueTypeOf returns the kind of a sensor value as decoded from JSON, or false
+// if it can't be logged.
+func valueTypeOf(value interface{}) (string, bool) {
+	switch value.(type) {
+	case float64:
+		return ValueNumber, true
+	case bool:
+		return ValueBoolean, true
+	case string:
+		return ValueString, true
+	case map[string]interface{}, []interface{}:
+		return ValueJSON, true
+	default:
+		return "", false
 	}
-	err := db.QueryRow("SELECT id, type, humanName, desiredValue FROM sensors WHERE deviceId=? AND name=?", deviceId, name).Scan(&sensor.dbId, &sensor.sensorType, &sensor.humanName, &sensor.desiredValue)
+}
+
+func GetSensor(deviceId int64, name string) *Sensor {
+	sensor, err := store.GetSensor(deviceId, name)
 	if err != nil {
 		log.Printf("could not query sensor ID for sensor '%s': %s", name, err)
 		return nil
@@ -41,34 +141,225 @@ func GetSensor(deviceId int64, name string) *Sensor {
 	return sensor
 }
 
-func (s *Sensor) FetchLogs(lastValueTime int64) *LogReply {
-	rows, err := db.Query("SELECT time, interval, value FROM sensorData WHERE sensorId=? AND time > ? ORDER BY time", s.dbId, lastValueTime*1000*1000*1000)
+// Info returns the metadata of the sensor, converted to the given unit system.
+func (s *Sensor) Info(units string) *SensorInfo {
+	converter := converterFor(s.unit, units)
+	return &SensorInfo{
+		Name:            s.name,
+		HumanName:       s.humanName,
+		DesiredValue:    converter.convert(s.desiredValue),
+		AlarmMin:        converter.convert(s.alarmMin),
+		AlarmMax:        converter.convert(s.alarmMax),
+		AlarmHysteresis: converter.convertDifference(s.alarmHysteresis),
+		Type:            s.sensorType,
+		ValueType:       s.valueType,
+		Unit:            converter.unit,
+	}
+}
+
+// parseNumber parses an optional number from an update. It returns nil if
+// the number is null.
+func parseNumber(data json.RawMessage, what string) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, errors.New("invalid " + what)
+	}
+	if value != nil {
+		if _, ok := value.(float64); !ok {
+			return nil, errors.New(what + " must be a number or null")
+		}
+	}
+	return value, nil
+}
+
+// apply validates the update and applies it to the sensor (not to the
+// database). The desired value and alarm limits are in the given unit system.
+func (s *Sensor) apply(update SensorUpdate, units string) error {
+	if update.HumanName != nil {
+		humanName := strings.TrimSpace(*update.HumanName)
+		if utf8.RuneCountInString(humanName) > MAX_HUMAN_NAME {
+			return fmt.Errorf("name is longer than %d characters", MAX_HUMAN_NAME)
+		}
+		for _, c := range humanName {
+			if unicode.IsControl(c) {
+				return errors.New("name contains control characters")
+			}
+		}
+		s.humanName = humanName
+	}
+	if update.Unit != nil {
+		unit := strings.TrimSpace(*update.Unit)
+		if utf8.RuneCountInString(unit) > MAX_UNIT {
+			return fmt.Errorf("unit is longer than %d characters", MAX_UNIT)
+		}
+		for _, c := range unit {
+			if unicode.IsControl(c) {
+				return errors.New("unit contains control characters")
+			}
+		}
+		s.unit = unit
+	}
+	converter := converterFor(s.unit, units)
+	if update.DesiredValue != nil {
+		desiredValue, err := parseNumber(update.DesiredValue, "desired value")
+		if err != nil {
+			return err
+		}
+		s.desiredValue = converter.revert(desiredValue)
+	}
+	if update.AlarmMin != nil {
+		alarmMin, err := parseNumber(update.AlarmMin, "alarm minimum")
+		if err != nil {
+			return err
+		}
+		s.alarmMin = converter.revert(alarmMin)
+	}
+	if update.AlarmMax != nil {
+		alarmMax, err := parseNumber(update.AlarmMax, "alarm maximum")
+		if err != nil {
+			return err
+		}
+		s.alarmMax = converter.revert(alarmMax)
+	}
+	if update.AlarmHysteresis != nil {
+		if *update.AlarmHysteresis < 0 {
+			return errors.New("alarm hysteresis cannot be negative")
+		}
+		s.alarmHysteresis = converter.revertDifference(*update.AlarmHysteresis)
+	}
+	alarmMin, hasMin := toFloat(s.alarmMin)
+	alarmMax, hasMax := toFloat(s.alarmMax)
+	if hasMin && hasMax && alarmMin > alarmMax {
+		return errors.New("alarm minimum is above the alarm maximum")
+	}
+	return nil
+}
+
+// FetchLogs returns the values logged after the given time (UNIX time in
+// seconds), converted to the given unit system.
+func (s *Sensor) FetchLogs(lastValueTime int64, units string) *LogReply {
+	rows, err := store.FetchSamples(s.dbId, time.Duration(lastValueTime)*time.Second)
 	if err != nil {
 		log.Print("could not fetch sensor data from log: ", err)
 		return nil
 	}
-	defer rows.Close()
+	converter := converterFor(s.unit, units)
+	for i := range rows {
+		rows[i].Value = converter.convert(rows[i].Value)
+	}
+
+	return &LogReply{
+		Name:            s.name,
+		Type:            s.sensorType,
+		ValueType:       s.valueType,
+		Unit:            converter.unit,
+		HumanName:       s.humanName,
+		DesiredValue:    converter.convert(s.desiredValue),
+		AlarmMin:        converter.convert(s.alarmMin),
+		AlarmMax:        converter.convert(s.alarmMax),
+		AlarmHysteresis: converter.convertDifference(s.alarmHysteresis),
+		Log:             rows,
+	}
+}
+
+// History returns the values logged between start and end (UNIX time in
+// seconds), aggregated into buckets of the given size in seconds. Missing or
+// unreasonable arguments are replaced with sane defaults. Only numeric values
+// are aggregated, so other sensors have an empty history. Values are converted
+// to the given unit system.
+func (s *Sensor) History(start, end, bucket int64, units string) *HistoryReply {
+	if end <= 0 {
+		end = time.Now().Unix()
+	}
+	if start <= 0 || start >= end {
+		start = end - GRAPH_TIME
+	}
+	if bucket <= 0 {
+		bucket = (end - start) / HISTORY_BUCKETS
+	}
+	// Round up, so that there are no more than MAX_HISTORY_BUCKETS buckets
+	// (plus one, as the range doesn't have to start at a bucket boundary).
+	if minBucket := (end - start + MAX_HISTORY_BUCKETS - 1) / MAX_HISTORY_BUCKETS; bucket < minBucket {
+		bucket = minBucket
+	}
+	if bucket < 1 {
+		bucket = 1
+	}
 
-	reply := LogReply{
-		Name:         s.name,
-		Type:         s.sensorType,
-		HumanName:    s.humanName,
-		DesiredValue: s.desiredValue,
-		Log:          make([]LogReplyRow, 0),
+	// Read from the finest tier that still has values for the start time.
+	tier := tierFor(time.Unix(start, 0), time.Now())
+	bucketNs := time.Duration(bucket) * time.Second
+	if bucketNs < tier.period() {
+		bucketNs = tier.period()
+		bucket = int64(bucketNs / time.Second)
 	}
-	for rows.Next() {
-		var logTimeNs int64
-		var logIntervalNs int64
-		var value float64
-		err := rows.Scan(&logTimeNs, &logIntervalNs, &value)
+	startNs := time.Duration(start) * time.Second
+	endNs := time.Duration(end) * time.Second
+
+	// The most recent values have not yet been rolled up, read those from the
+	// raw log.
+	splitNs := endNs
+	if tier != tierRaw {
+		lastRollup, err := store.LastRollup(tier)
 		if err != nil {
-			log.Print("could not read sensor data from log: ", err)
+			log.Print("could not fetch sensor history from log: ", err)
 			return nil
 		}
-		logTime := logTimeNs / int64(time.Second)
-		logInterval := logIntervalNs / int64(time.Second)
-		reply.Log = append(reply.Log, LogReplyRow{logTime, logInterval, value})
+		if lastRollup+tier.period() < splitNs {
+			splitNs = lastRollup + tier.period()
+		}
+		if splitNs < startNs {
+			splitNs = startNs
+		}
 	}
 
-	return &reply
+	buckets, err := store.FetchHistory(s.dbId, tier, startNs, splitNs, bucketNs)
+	if err != nil {
+		log.Print("could not fetch sensor history from log: ", err)
+		return nil
+	}
+	if splitNs < endNs {
+		recent, err := store.FetchHistory(s.dbId, tierRaw, splitNs, endNs, bucketNs)
+		if err != nil {
+			log.Print("could not fetch sensor history from log: ", err)
+			return nil
+		}
+		if len(buckets) != 0 && len(recent) != 0 && buckets[len(buckets)-1].Time == recent[0].Time {
+			// The split fell inside a bucket.
+			buckets[len(buckets)-1].merge(recent[0])
+			recent = recent[1:]
+		}
+		buckets = append(buckets, recent...)
+	}
+
+	converter := converterFor(s.unit, units)
+	for i := range buckets {
+		buckets[i].Min = converter.convertFloat(buckets[i].Min)
+		buckets[i].Avg = converter.convertFloat(buckets[i].Avg)
+		buckets[i].Max = converter.convertFloat(buckets[i].Max)
+	}
+
+	return &HistoryReply{
+		Name:    s.name,
+		Unit:    converter.unit,
+		Start:   start,
+		End:     end,
+		Bucket:  bucket,
+		History: buckets,
+	}
+}
+
+// merge adds the values of another bucket to this bucket.
+func (b *HistoryBucket) merge(other HistoryBucket) {
+	if other.Min < b.Min {
+		b.Min = other.Min
+	}
+	if other.Max > b.Max {
+		b.Max = other.Max
+	}
+	b.Count += other.Count
+	b.sum += other.sum
+	b.weight += other.weight
+	b.Avg = b.sum / b.weight
 }
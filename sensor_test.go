@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSensorHistoryArguments(t *testing.T) {
+	useStore(t, newMemoryStore())
+	setRetention(t, 0, 0)
+	sensor, err := store.AddSensor(addTestDevice(t, store, "device"), "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+
+	// A value every ten seconds for ten days.
+	const tenDays = 10 * 86400
+	for logtime := int64(0); logtime < 1000+tenDays; logtime += 10 {
+		if err := store.InsertSample(sensor.dbId, time.Duration(logtime)*time.Second, 10*time.Second, 20.0); err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+	}
+
+	tests := []struct {
+		start, end, bucket int64
+		expectedStart      int64
+		expectedBucket     int64
+	}{
+		{1000, 2000, 0, 1000, 2},                 // default number of buckets
+		{1000, 1100, 0, 1000, 1},                 // at least one second
+		{0, 100000, 60, 100000 - GRAPH_TIME, 60}, // no start: one day
+		{5000, 4000, 60, 4000 - GRAPH_TIME, 60},  // start after the end
+		{1000, 1000 + tenDays, 1, 1000, 87},      // too many buckets
+		{1000, 1000 + tenDays, 3600, 1000, 3600}, // a bucket size that is fine
+	}
+	for _, tc := range tests {
+		reply := sensor.History(tc.start, tc.end, tc.bucket, "")
+		if reply == nil {
+			t.Errorf("history(%d, %d, %d): could not fetch history", tc.start, tc.end, tc.bucket)
+			continue
+		}
+		if reply.Start != tc.expectedStart || reply.End != tc.end || reply.Bucket != tc.expectedBucket {
+			t.Errorf("history(%d, %d, %d): got start %d, end %d and bucket %d, expected %d, %d and %d", tc.start, tc.end, tc.bucket, reply.Start, reply.End, reply.Bucket, tc.expectedStart, tc.end, tc.expectedBucket)
+		}
+		if len(reply.History) == 0 {
+			t.Errorf("history(%d, %d, %d): got no buckets", tc.start, tc.end, tc.bucket)
+		}
+		// The first bucket may start before the start time.
+		if len(reply.History) > MAX_HISTORY_BUCKETS+1 {
+			t.Errorf("history(%d, %d, %d): got %d buckets, more than the maximum", tc.start, tc.end, tc.bucket, len(reply.History))
+		}
+	}
+}
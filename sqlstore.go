@@ -0,0 +1,987 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect describes the differences between the supported SQL databases.
+// Queries are written for SQLite and translated when needed.
+type sqlDialect struct {
+	numberedPlaceholders bool              // use $1, $2 etc. instead of ?
+	returningId          bool              // use RETURNING id instead of LastInsertId()
+	types                *strings.Replacer // translate column types in migrations
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"sqlite3": &sqlDialect{
+		types: strings.NewReplacer(),
+	},
+	"postgres": &sqlDialect{
+		numberedPlaceholders: true,
+		returningId:          true,
+		types: strings.NewReplacer(
+			"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+			"INTEGER", "BIGINT",
+			"REAL", "DOUBLE PRECISION",
+		),
+	},
+}
+
+// rebind replaces the ? placeholders in the query with the placeholders used
+// by this database.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// sqlStore is a Store backed by a SQL database.
+type sqlStore struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func newSQLStore(driver, dataSource string) (*sqlStore, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database: %s", driver)
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	err = migrateDatabase(db, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db, dialect}, nil
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// insert runs an INSERT statement and returns the id column of the new row.
+func (s *sqlStore) insert(query string, args ...interface{}) (int64, error) {
+	if s.dialect.returningId {
+		var id int64
+		err := s.queryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := s.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) GetDevice(serial string) (int64, string, error) {
+	var id int64
+	var name string
+	err := s.queryRow("SELECT id, name FROM devices WHERE serial=?", serial).Scan(&id, &name)
+	if err == sql.ErrNoRows {
+		return 0, "", errNotFound
+	}
+	return id, name, err
+}
+
+func (s *sqlStore) GetDevices() (map[int64]string, error) {
+	rows, err := s.query("SELECT id, name FROM devices")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var name string
+		err := rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+		devices[id] = name
+	}
+	return devices, rows.Err()
+}
+
+func (s *sqlStore) AddDevice(serial, name string) (int64, error) {
+	return s.insert("INSERT INTO devices (serial, name) VALUES (?, ?)", serial, name)
+}
+
+func (s *sqlStore) SetDeviceName(id int64, name string) error {
+	_, err := s.exec("UPDATE devices SET name=? WHERE id=?", name, id)
+	return err
+}
+
+func (s *sqlStore) SetDeviceSerial(id int64, serial string) error {
+	_, err := s.exec("UPDATE devices SET serial=? WHERE id=?", serial, id)
+	return err
+}
+
+func (s *sqlStore) GetActuators(deviceId int64) (map[string]interface{}, error) {
+	rows, err := s.query("SELECT name, value FROM actuators WHERE deviceId=?", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actuators := make(map[string]interface{})
+	for rows.Next() {
+		var name, data string
+		err := rows.Scan(&name, &data)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		err = json.Unmarshal([]byte(data), &value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse value of actuator %s: %s", name, err)
+		}
+		actuators[name] = value
+	}
+	return actuators, rows.Err()
+}
+
+func (s *sqlStore) SetActuator(deviceId int64, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	result, err := s.exec("UPDATE actuators SET value=? WHERE deviceId=? AND name=?", string(data), deviceId, name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n != 0 {
+		return nil
+	}
+	_, err = s.exec("INSERT INTO actuators (deviceId, name, value) VALUES (?, ?, ?)", deviceId, name, string(data))
+	return err
+}
+
+func (s *sqlStore) GetActuatorTypes(deviceId int64) (map[string]*ActuatorType, error) {
+	rows, err := s.query("SELECT name, definition FROM actuatorTypes WHERE deviceId=?", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actuatorTypes := make(map[string]*ActuatorType)
+	for rows.Next() {
+		var name, data string
+		err := rows.Scan(&name, &data)
+		if err != nil {
+			return nil, err
+		}
+		actuatorType := &ActuatorType{}
+		err = json.Unmarshal([]byte(data), actuatorType)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse type of actuator %s: %s", name, err)
+		}
+		actuatorTypes[name] = actuatorType
+	}
+	return actuatorTypes, rows.Err()
+}
+
+func (s *sqlStore) SetActuatorType(deviceId int64, name string, actuatorType *ActuatorType) error {
+	if actuatorType == nil {
+		_, err := s.exec("DELETE FROM actuatorTypes WHERE deviceId=? AND name=?", deviceId, name)
+		return err
+	}
+	data, err := json.Marshal(actuatorType)
+	if err != nil {
+		return err
+	}
+	result, err := s.exec("UPDATE actuatorTypes SET definition=? WHERE deviceId=? AND name=?", string(data), deviceId, name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n != 0 {
+		return nil
+	}
+	_, err = s.exec("INSERT INTO actuatorTypes (deviceId, name, definition) VALUES (?, ?, ?)", deviceId, name, string(data))
+	return err
+}
+
+func (s *sqlStore) AddActuatorChange(deviceId int64, change *ActuatorChange) error {
+	value, err := json.Marshal(change.Value)
+	if err != nil {
+		return err
+	}
+	var previous interface{}
+	if change.Previous != nil {
+		data, err := json.Marshal(change.Previous)
+		if err != nil {
+			return err
+		}
+		previous = string(data)
+	}
+	_, err = s.exec("INSERT INTO actuatorHistory (deviceId, name, time, value, previous, source) VALUES (?, ?, ?, ?, ?, ?)", deviceId, change.Name, change.Time*int64(time.Second), string(value), previous, change.Source)
+	return err
+}
+
+func (s *sqlStore) GetActuatorChanges(deviceId int64, name string, start, end time.Duration, limit int) ([]*ActuatorChange, error) {
+	query := "SELECT name, time, value, previous, source FROM actuatorHistory WHERE deviceId=? AND time >= ? AND time < ?"
+	args := []interface{}{deviceId, int64(start), int64(end)}
+	if name != "" {
+		query += " AND name=?"
+		args = append(args, name)
+	}
+	// Take the newest changes, and put them in chronological order below.
+	query += fmt.Sprintf(" ORDER BY time DESC, id DESC LIMIT %d", limit)
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := make([]*ActuatorChange, 0)
+	for rows.Next() {
+		change := &ActuatorChange{}
+		var timeNs int64
+		var value string
+		var previous sql.NullString
+		err := rows.Scan(&change.Name, &timeNs, &value, &previous, &change.Source)
+		if err != nil {
+			return nil, err
+		}
+		change.Time = timeNs / int64(time.Second)
+		err = json.Unmarshal([]byte(value), &change.Value)
+		if err != nil {
+			return nil, err
+		}
+		if previous.Valid {
+			err = json.Unmarshal([]byte(previous.String), &change.Previous)
+			if err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	reverseActuatorChanges(changes)
+	return changes, nil
+}
+
+// jsonValue returns the value encoded as JSON, or nil if the value is nil.
+func jsonValue(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// parseJSONValue decodes a nullable JSON column.
+func parseJSONValue(data sql.NullString) (interface{}, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var value interface{}
+	err := json.Unmarshal([]byte(data.String), &value)
+	return value, err
+}
+
+// boolInt converts a bool to an integer, as not all databases accept bools in
+// integer columns.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *sqlStore) GetRules(deviceId int64) ([]*Rule, error) {
+	rows, err := s.query("SELECT id, name, sensor, operator, threshold, relative, hysteresis, cooldown, actuator, value, releaseValue, notify, enabled FROM rules WHERE deviceId=? ORDER BY id", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make([]*Rule, 0)
+	for rows.Next() {
+		rule := &Rule{}
+		var value, releaseValue sql.NullString
+		err := rows.Scan(&rule.Id, &rule.Name, &rule.Sensor, &rule.Operator, &rule.Threshold, &rule.Relative, &rule.Hysteresis, &rule.Cooldown, &rule.Actuator, &value, &releaseValue, &rule.Notify, &rule.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		rule.Value, err = parseJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		rule.ReleaseValue, err = parseJSONValue(releaseValue)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *sqlStore) SaveRule(deviceId int64, rule *Rule) (int64, error) {
+	value, err := jsonValue(rule.Value)
+	if err != nil {
+		return 0, err
+	}
+	releaseValue, err := jsonValue(rule.ReleaseValue)
+	if err != nil {
+		return 0, err
+	}
+	if rule.Id == 0 {
+		return s.insert("INSERT INTO rules (deviceId, name, sensor, operator, threshold, relative, hysteresis, cooldown, actuator, value, releaseValue, notify, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			deviceId, rule.Name, rule.Sensor, rule.Operator, rule.Threshold, boolInt(rule.Relative), rule.Hysteresis, rule.Cooldown, rule.Actuator, value, releaseValue, boolInt(rule.Notify), boolInt(rule.Enabled))
+	}
+	result, err := s.exec("UPDATE rules SET name=?, sensor=?, operator=?, threshold=?, relative=?, hysteresis=?, cooldown=?, actuator=?, value=?, releaseValue=?, notify=?, enabled=? WHERE id=? AND deviceId=?",
+		rule.Name, rule.Sensor, rule.Operator, rule.Threshold, boolInt(rule.Relative), rule.Hysteresis, rule.Cooldown, rule.Actuator, value, releaseValue, boolInt(rule.Notify), boolInt(rule.Enabled), rule.Id, deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return 0, errNotFound
+	}
+	return rule.Id, nil
+}
+
+func (s *sqlStore) DeleteRule(deviceId, ruleId int64) error {
+	result, err := s.exec("DELETE FROM rules WHERE id=? AND deviceId=?", ruleId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetThermostats(deviceId int64) ([]*Thermostat, error) {
+	rows, err := s.query("SELECT id, sensor, actuator, onValue, offValue, fallbackValue, hysteresis, minOnTime, minOffTime, timeout, enabled FROM thermostats WHERE deviceId=? ORDER BY id", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	thermostats := make([]*Thermostat, 0)
+	for rows.Next() {
+		thermostat := &Thermostat{}
+		var onValue, offValue, fallbackValue sql.NullString
+		err := rows.Scan(&thermostat.Id, &thermostat.Sensor, &thermostat.Actuator, &onValue, &offValue, &fallbackValue, &thermostat.Hysteresis, &thermostat.MinOnTime, &thermostat.MinOffTime, &thermostat.Timeout, &thermostat.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range []struct {
+			dest *interface{}
+			data sql.NullString
+		}{{&thermostat.OnValue, onValue}, {&thermostat.OffValue, offValue}, {&thermostat.FallbackValue, fallbackValue}} {
+			*v.dest, err = parseJSONValue(v.data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		thermostats = append(thermostats, thermostat)
+	}
+	return thermostats, rows.Err()
+}
+
+func (s *sqlStore) SaveThermostat(deviceId int64, thermostat *Thermostat) (int64, error) {
+	values := make([]interface{}, 3)
+	for i, value := range []interface{}{thermostat.OnValue, thermostat.OffValue, thermostat.FallbackValue} {
+		var err error
+		values[i], err = jsonValue(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if thermostat.Id == 0 {
+		return s.insert("INSERT INTO thermostats (deviceId, sensor, actuator, onValue, offValue, fallbackValue, hysteresis, minOnTime, minOffTime, timeout, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			deviceId, thermostat.Sensor, thermostat.Actuator, values[0], values[1], values[2], thermostat.Hysteresis, thermostat.MinOnTime, thermostat.MinOffTime, thermostat.Timeout, boolInt(thermostat.Enabled))
+	}
+	result, err := s.exec("UPDATE thermostats SET sensor=?, actuator=?, onValue=?, offValue=?, fallbackValue=?, hysteresis=?, minOnTime=?, minOffTime=?, timeout=?, enabled=? WHERE id=? AND deviceId=?",
+		thermostat.Sensor, thermostat.Actuator, values[0], values[1], values[2], thermostat.Hysteresis, thermostat.MinOnTime, thermostat.MinOffTime, thermostat.Timeout, boolInt(thermostat.Enabled), thermostat.Id, deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return 0, errNotFound
+	}
+	return thermostat.Id, nil
+}
+
+func (s *sqlStore) DeleteThermostat(deviceId, thermostatId int64) error {
+	result, err := s.exec("DELETE FROM thermostats WHERE id=? AND deviceId=?", thermostatId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSchedules(deviceId int64) ([]*Schedule, error) {
+	rows, err := s.query("SELECT id, name, triggerSpec, actuator, value, enabled FROM schedules WHERE deviceId=? ORDER BY id", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	schedules := make([]*Schedule, 0)
+	for rows.Next() {
+		schedule := &Schedule{}
+		var value sql.NullString
+		err := rows.Scan(&schedule.Id, &schedule.Name, &schedule.Trigger, &schedule.Actuator, &value, &schedule.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Value, err = parseJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func (s *sqlStore) SaveSchedule(deviceId int64, schedule *Schedule) (int64, error) {
+	value, err := jsonValue(schedule.Value)
+	if err != nil {
+		return 0, err
+	}
+	if schedule.Id == 0 {
+		return s.insert("INSERT INTO schedules (deviceId, name, triggerSpec, actuator, value, enabled) VALUES (?, ?, ?, ?, ?, ?)",
+			deviceId, schedule.Name, schedule.Trigger, schedule.Actuator, value, boolInt(schedule.Enabled))
+	}
+	result, err := s.exec("UPDATE schedules SET name=?, triggerSpec=?, actuator=?, value=?, enabled=? WHERE id=? AND deviceId=?",
+		schedule.Name, schedule.Trigger, schedule.Actuator, value, boolInt(schedule.Enabled), schedule.Id, deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return 0, errNotFound
+	}
+	return schedule.Id, nil
+}
+
+func (s *sqlStore) DeleteSchedule(deviceId, scheduleId int64) error {
+	result, err := s.exec("DELETE FROM schedules WHERE id=? AND deviceId=?", scheduleId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetScenes(deviceId int64) ([]*Scene, error) {
+	rows, err := s.query("SELECT id, name, actuators FROM scenes WHERE deviceId=? ORDER BY id", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scenes := make([]*Scene, 0)
+	for rows.Next() {
+		scene := &Scene{}
+		var actuators string
+		err := rows.Scan(&scene.Id, &scene.Name, &actuators)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(actuators), &scene.Actuators)
+		if err != nil {
+			return nil, err
+		}
+		scenes = append(scenes, scene)
+	}
+	return scenes, rows.Err()
+}
+
+func (s *sqlStore) SaveScene(deviceId int64, scene *Scene) (int64, error) {
+	actuators, err := jsonValue(scene.Actuators)
+	if err != nil {
+		return 0, err
+	}
+	if scene.Id == 0 {
+		return s.insert("INSERT INTO scenes (deviceId, name, actuators) VALUES (?, ?, ?)",
+			deviceId, scene.Name, actuators)
+	}
+	result, err := s.exec("UPDATE scenes SET name=?, actuators=? WHERE id=? AND deviceId=?",
+		scene.Name, actuators, scene.Id, deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return 0, errNotFound
+	}
+	return scene.Id, nil
+}
+
+func (s *sqlStore) DeleteScene(deviceId, sceneId int64) error {
+	result, err := s.exec("DELETE FROM scenes WHERE id=? AND deviceId=?", sceneId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetOpenAlarms(deviceId int64) ([]*Alarm, error) {
+	rows, err := s.query("SELECT id, sensor, kind, state, threshold, value, unit, raised, acknowledged, acknowledgedBy, cleared FROM alarms WHERE deviceId=? AND state<>? ORDER BY id", deviceId, AlarmCleared)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	alarms := make([]*Alarm, 0)
+	for rows.Next() {
+		alarm := &Alarm{}
+		err := rows.Scan(&alarm.Id, &alarm.Sensor, &alarm.Kind, &alarm.State, &alarm.Threshold, &alarm.Value, &alarm.Unit, &alarm.Raised, &alarm.Acknowledged, &alarm.AcknowledgedBy, &alarm.Cleared)
+		if err != nil {
+			return nil, err
+		}
+		alarms = append(alarms, alarm)
+	}
+	return alarms, rows.Err()
+}
+
+func (s *sqlStore) SaveAlarm(deviceId int64, alarm *Alarm) (int64, error) {
+	if alarm.Id == 0 {
+		return s.insert("INSERT INTO alarms (deviceId, sensor, kind, state, threshold, value, unit, raised, acknowledged, acknowledgedBy, cleared) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			deviceId, alarm.Sensor, alarm.Kind, alarm.State, alarm.Threshold, alarm.Value, alarm.Unit, alarm.Raised, alarm.Acknowledged, alarm.AcknowledgedBy, alarm.Cleared)
+	}
+	result, err := s.exec("UPDATE alarms SET state=?, acknowledged=?, acknowledgedBy=?, cleared=? WHERE id=? AND deviceId=?",
+		alarm.State, alarm.Acknowledged, alarm.AcknowledgedBy, alarm.Cleared, alarm.Id, deviceId)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return 0, errNotFound
+	}
+	return alarm.Id, nil
+}
+
+func (s *sqlStore) GetSensors(deviceId int64) ([]*Sensor, error) {
+	rows, err := s.query("SELECT id, name, type, valueType, unit, humanName, desiredValue, alarmMin, alarmMax, alarmHysteresis FROM sensors WHERE deviceId=? ORDER BY id", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sensors := make([]*Sensor, 0, 1)
+	for rows.Next() {
+		sensor := &Sensor{
+			deviceId: deviceId,
+		}
+		err := rows.Scan(&sensor.dbId, &sensor.name, &sensor.sensorType, &sensor.valueType, &sensor.unit, &sensor.humanName, &sensor.desiredValue, &sensor.alarmMin, &sensor.alarmMax, &sensor.alarmHysteresis)
+		if err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors, rows.Err()
+}
+
+func (s *sqlStore) GetSensor(deviceId int64, name string) (*Sensor, error) {
+	sensor := &Sensor{
+		deviceId: deviceId,
+		name:     name,
+	}
+	err := s.queryRow("SELECT id, type, valueType, unit, humanName, desiredValue, alarmMin, alarmMax, alarmHysteresis FROM sensors WHERE deviceId=? AND name=?", deviceId, name).Scan(&sensor.dbId, &sensor.sensorType, &sensor.valueType, &sensor.unit, &sensor.humanName, &sensor.desiredValue, &sensor.alarmMin, &sensor.alarmMax, &sensor.alarmHysteresis)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return sensor, nil
+}
+
+func (s *sqlStore) AddSensor(deviceId int64, name, sensorType, valueType string) (*Sensor, error) {
+	id, err := s.insert("INSERT INTO sensors (deviceId, name, type, valueType) VALUES (?, ?, ?, ?)", deviceId, name, sensorType, valueType)
+	if err != nil {
+		return nil, err
+	}
+	return &Sensor{
+		deviceId:   deviceId,
+		dbId:       id,
+		name:       name,
+		sensorType: sensorType,
+		valueType:  valueType,
+	}, nil
+}
+
+func (s *sqlStore) UpdateSensor(sensorId int64, humanName, unit string, desiredValue, alarmMin, alarmMax interface{}, alarmHysteresis float64) error {
+	_, err := s.exec("UPDATE sensors SET humanName=?, unit=?, desiredValue=?, alarmMin=?, alarmMax=?, alarmHysteresis=? WHERE id=?", humanName, unit, desiredValue, alarmMin, alarmMax, alarmHysteresis, sensorId)
+	return err
+}
+
+func (s *sqlStore) InsertSample(sensorId int64, logtime, interval time.Duration, value interface{}) error {
+	// Numbers go in the value column so they can be aggregated, everything
+	// else is stored as JSON in the data column.
+	var data interface{}
+	if _, ok := value.(float64); !ok {
+		var err error
+		data, err = jsonValue(value)
+		if err != nil {
+			return err
+		}
+		value = nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.dialect.rebind("INSERT INTO sensorData (sensorId, time, value, data, interval) VALUES (?, ?, ?, ?, ?)"), sensorId, int64(logtime), value, data, int64(interval))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Values that arrive late don't replace the last value.
+	_, err = tx.Exec(s.dialect.rebind("UPDATE sensors SET lastSampleTime=?, lastSampleInterval=? WHERE id=? AND (lastSampleTime IS NULL OR lastSampleTime <= ?)"), int64(logtime), int64(interval), sensorId, int64(logtime))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) FetchSamples(sensorId int64, since time.Duration) ([]LogReplyRow, error) {
+	rows, err := s.query("SELECT time, interval, value, data FROM sensorData WHERE sensorId=? AND time > ? ORDER BY time", sensorId, int64(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]LogReplyRow, 0)
+	for rows.Next() {
+		var logTimeNs int64
+		var logIntervalNs int64
+		var number sql.NullFloat64
+		var data sql.NullString
+		err := rows.Scan(&logTimeNs, &logIntervalNs, &number, &data)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if number.Valid {
+			value = number.Float64
+		} else {
+			value, err = parseJSONValue(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if value == nil {
+			continue
+		}
+		logTime := logTimeNs / int64(time.Second)
+		logInterval := logIntervalNs / int64(time.Second)
+		samples = append(samples, LogReplyRow{logTime, logInterval, value})
+	}
+	return samples, rows.Err()
+}
+
+func (s *sqlStore) GetLastSamples(deviceId int64) (map[string]sampleTiming, error) {
+	rows, err := s.query("SELECT name, lastSampleTime, lastSampleInterval FROM sensors WHERE deviceId=? AND lastSampleTime IS NOT NULL", deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	timings := make(map[string]sampleTiming)
+	for rows.Next() {
+		var name string
+		var logTimeNs, logIntervalNs int64
+		err := rows.Scan(&name, &logTimeNs, &logIntervalNs)
+		if err != nil {
+			return nil, err
+		}
+		timings[name] = sampleTiming{time.Duration(logTimeNs), time.Duration(logIntervalNs)}
+	}
+	return timings, rows.Err()
+}
+
+// historyTables maps each history tier to its table.
+var historyTables = map[historyTier]string{
+	tierRaw:    "sensorData",
+	tierHourly: "sensorDataHourly",
+	tierDaily:  "sensorDataDaily",
+}
+
+// historySource returns a subquery that presents all tiers as rollup rows.
+func (s *sqlStore) historySource(tier historyTier) string {
+	if tier == tierRaw {
+		// The average is weighted by the interval of each value, as a value
+		// that was measured over a longer period counts for more.
+		weight := fmt.Sprintf("CASE WHEN interval > 0 THEN interval ELSE %d END", int64(time.Second))
+		return fmt.Sprintf(`(SELECT sensorId, time, value AS minValue, value AS maxValue, value * %[1]s AS sumValue, %[1]s AS weight, 1 AS count
+			FROM sensorData WHERE value IS NOT NULL) AS samples`, weight)
+	}
+	return historyTables[tier] + " AS samples"
+}
+
+func (s *sqlStore) FetchHistory(sensorId int64, tier historyTier, start, end, bucket time.Duration) ([]HistoryBucket, error) {
+	query := fmt.Sprintf(`SELECT time / %[1]d, MIN(minValue), MAX(maxValue), SUM(sumValue), SUM(weight), SUM(count)
+		FROM %[2]s WHERE sensorId=? AND time >= ? AND time < ?
+		GROUP BY time / %[1]d ORDER BY time / %[1]d`, int64(bucket), s.historySource(tier))
+	rows, err := s.query(query, sensorId, int64(start), int64(end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]HistoryBucket, 0)
+	for rows.Next() {
+		var bucketIndex int64
+		row := HistoryBucket{}
+		err := rows.Scan(&bucketIndex, &row.Min, &row.Max, &row.sum, &row.weight, &row.Count)
+		if err != nil {
+			return nil, err
+		}
+		row.Time = int64(time.Duration(bucketIndex) * bucket / time.Second)
+		row.Avg = row.sum / row.weight
+		buckets = append(buckets, row)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *sqlStore) LastRollup(tier historyTier) (time.Duration, error) {
+	var last sql.NullInt64
+	err := s.queryRow("SELECT MAX(time) FROM " + historyTables[tier]).Scan(&last)
+	return time.Duration(last.Int64), err
+}
+
+func (s *sqlStore) Rollup(tier historyTier, from, until time.Duration) error {
+	period := int64(tier.period())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.dialect.rebind("DELETE FROM "+historyTables[tier]+" WHERE time >= ? AND time < ?"), int64(from), int64(until))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO %[1]s (sensorId, time, minValue, maxValue, sumValue, weight, count)
+		SELECT sensorId, (time / %[2]d) * %[2]d, MIN(minValue), MAX(maxValue), SUM(sumValue), SUM(weight), SUM(count)
+		FROM %[3]s WHERE time >= ? AND time < ?
+		GROUP BY sensorId, time / %[2]d`, historyTables[tier], period, s.historySource(tier-1))
+	_, err = tx.Exec(s.dialect.rebind(query), int64(from), int64(until))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Prune(tier historyTier, before time.Duration) error {
+	_, err := s.exec("DELETE FROM "+historyTables[tier]+" WHERE time < ?", int64(before))
+	return err
+}
+
+func (s *sqlStore) AddUser(name, passwordHash string) (int64, error) {
+	return s.insert("INSERT INTO users (name, passwordHash) VALUES (?, ?)", name, passwordHash)
+}
+
+func (s *sqlStore) GetUser(name string) (*User, error) {
+	user := &User{}
+	err := s.queryRow("SELECT id, name, passwordHash FROM users WHERE name=?", name).Scan(&user.dbId, &user.name, &user.passwordHash)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) GetUsers() ([]*User, error) {
+	rows, err := s.query("SELECT id, name, passwordHash FROM users ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]*User, 0)
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(&user.dbId, &user.name, &user.passwordHash)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) SetUserPassword(userId int64, passwordHash string) error {
+	_, err := s.exec("UPDATE users SET passwordHash=? WHERE id=?", passwordHash, userId)
+	return err
+}
+
+func (s *sqlStore) GetUserDevices(userId int64) ([]int64, error) {
+	rows, err := s.query("SELECT deviceId FROM userDevices WHERE userId=? ORDER BY deviceId", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deviceIds := make([]int64, 0, 1)
+	for rows.Next() {
+		var deviceId int64
+		err := rows.Scan(&deviceId)
+		if err != nil {
+			return nil, err
+		}
+		deviceIds = append(deviceIds, deviceId)
+	}
+	return deviceIds, rows.Err()
+}
+
+func (s *sqlStore) GrantDevice(userId, deviceId int64, role Role) error {
+	result, err := s.exec("UPDATE userDevices SET role=? WHERE userId=? AND deviceId=?", role.String(), userId, deviceId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n != 0 {
+		return nil
+	}
+	_, err = s.exec("INSERT INTO userDevices (userId, deviceId, role) VALUES (?, ?, ?)", userId, deviceId, role.String())
+	return err
+}
+
+func (s *sqlStore) RevokeDevice(userId, deviceId int64) error {
+	_, err := s.exec("DELETE FROM grants WHERE userId=? AND deviceId=?", userId, deviceId)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("DELETE FROM userDevices WHERE userId=? AND deviceId=?", userId, deviceId)
+	return err
+}
+
+func (s *sqlStore) GetPermissions(userId, deviceId int64) (*Permissions, error) {
+	var roleName string
+	err := s.queryRow("SELECT role FROM userDevices WHERE userId=? AND deviceId=?", userId, deviceId).Scan(&roleName)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	role, ok := parseRole(roleName)
+	if !ok {
+		return nil, fmt.Errorf("unknown role: %s", roleName)
+	}
+	permissions := &Permissions{
+		Role:      role,
+		Actuators: make(map[string]bool),
+		Sensors:   make(map[string]bool),
+	}
+
+	rows, err := s.query("SELECT kind, name FROM grants WHERE userId=? AND deviceId=?", userId, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, name string
+		err := rows.Scan(&kind, &name)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case GrantActuator:
+			permissions.Actuators[name] = true
+		case GrantSensor:
+			permissions.Sensors[name] = true
+		}
+	}
+	return permissions, rows.Err()
+}
+
+func (s *sqlStore) AddGrant(userId, deviceId int64, kind, name string) error {
+	_, err := s.exec("INSERT INTO grants (userId, deviceId, kind, name) VALUES (?, ?, ?, ?)", userId, deviceId, kind, name)
+	return err
+}
+
+func (s *sqlStore) RemoveGrant(userId, deviceId int64, kind, name string) error {
+	_, err := s.exec("DELETE FROM grants WHERE userId=? AND deviceId=? AND kind=? AND name=?", userId, deviceId, kind, name)
+	return err
+}
+
+func (s *sqlStore) AddToken(userId int64, name, tokenHash string, created time.Time) (int64, error) {
+	return s.insert("INSERT INTO tokens (userId, name, hash, created) VALUES (?, ?, ?, ?)", userId, name, tokenHash, created.Unix())
+}
+
+func (s *sqlStore) GetTokens(userId int64) ([]*Token, error) {
+	rows, err := s.query("SELECT id, name, created, revoked FROM tokens WHERE userId=? ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]*Token, 0)
+	for rows.Next() {
+		token := &Token{
+			userId: userId,
+		}
+		var created int64
+		var revoked sql.NullInt64
+		err := rows.Scan(&token.dbId, &token.name, &created, &revoked)
+		if err != nil {
+			return nil, err
+		}
+		token.created = time.Unix(created, 0)
+		if revoked.Valid {
+			token.revoked = time.Unix(revoked.Int64, 0)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) GetTokenUser(tokenHash string) (*User, error) {
+	user := &User{}
+	err := s.queryRow("SELECT users.id, users.name, users.passwordHash FROM tokens JOIN users ON users.id=tokens.userId WHERE tokens.hash=? AND tokens.revoked IS NULL", tokenHash).Scan(&user.dbId, &user.name, &user.passwordHash)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *sqlStore) RevokeToken(tokenId int64, revoked time.Time) error {
+	result, err := s.exec("UPDATE tokens SET revoked=? WHERE id=? AND revoked IS NULL", revoked.Unix(), tokenId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// openTestSQLite returns a sqlStore on a new SQLite database in a temporary
+// directory.
+func openTestSQLite(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := newSQLStore("sqlite3", filepath.Join(t.TempDir(), "domos.db"))
+	if err != nil {
+		t.Fatal("could not open SQLite store:", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testPostgres is the postgres server the tests run against, started by the
+// first test that needs it.
+var testPostgres struct {
+	once       sync.Once
+	dataSource string // connection to the server, without a database name
+	err        error  // why there is no server
+	dir        string // data directory of the server started by the tests
+	databases  int    // number of databases created so far
+}
+
+// TestMain stops the postgres server after the tests, if one was started.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testPostgres.dir != "" {
+		stopTestPostgres()
+	}
+	os.Exit(code)
+}
+
+// openTestPostgres returns a sqlStore on a new postgres database. The server
+// is the one in DOMOS_TEST_POSTGRES, for example
+// "postgres://domos@localhost/?sslmode=disable", which must allow creating
+// databases. Without it, a server is started in a temporary directory with
+// initdb and pg_ctl. The test is skipped if neither is available.
+func openTestPostgres(t *testing.T) *sqlStore {
+	t.Helper()
+	testPostgres.once.Do(startTestPostgres)
+	if testPostgres.err != nil {
+		t.Skip("no postgres server:", testPostgres.err)
+	}
+
+	admin, err := sql.Open("postgres", testPostgres.dataSource)
+	if err != nil {
+		t.Fatal("could not connect to postgres:", err)
+	}
+	defer admin.Close()
+	testPostgres.databases++
+	name := fmt.Sprintf("domos_test_%d_%d", os.Getpid(), testPostgres.databases)
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatal("could not create postgres database:", err)
+	}
+	t.Cleanup(func() {
+		admin, err := sql.Open("postgres", testPostgres.dataSource)
+		if err != nil {
+			t.Error("could not connect to postgres:", err)
+			return
+		}
+		defer admin.Close()
+		if _, err := admin.Exec("DROP DATABASE " + name); err != nil {
+			t.Error("could not drop postgres database:", err)
+		}
+	})
+
+	s, err := newSQLStore("postgres", testPostgres.dataSource+" dbname="+name)
+	if err != nil {
+		t.Fatal("could not open postgres store:", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// startTestPostgres sets up testPostgres.
+func startTestPostgres() {
+	if dataSource := os.Getenv("DOMOS_TEST_POSTGRES"); dataSource != "" {
+		if strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://") {
+			// The database name is appended as a keyword below.
+			dataSource, testPostgres.err = pq.ParseURL(dataSource)
+		}
+		testPostgres.dataSource = dataSource
+		return
+	}
+
+	initdb, err := findPostgresCommand("initdb")
+	if err != nil {
+		testPostgres.err = err
+		return
+	}
+	pgctl, err := findPostgresCommand("pg_ctl")
+	if err != nil {
+		testPostgres.err = err
+		return
+	}
+	if os.Geteuid() == 0 {
+		testPostgres.err = errors.New("postgres refuses to run as root")
+		return
+	}
+
+	// Not t.TempDir(): the server outlives the test that started it, and the
+	// path of the socket must be short.
+	dir, err := os.MkdirTemp("", "domos-postgres")
+	if err != nil {
+		testPostgres.err = err
+		return
+	}
+	testPostgres.dir = dir
+	output, err := exec.Command(initdb, "--pgdata", filepath.Join(dir, "data"), "--username", "domos", "--auth", "trust", "--encoding", "UTF8").CombinedOutput()
+	if err != nil {
+		testPostgres.err = fmt.Errorf("initdb: %s: %s", err, bytes.TrimSpace(output))
+		return
+	}
+	// Only listen on a socket in the temporary directory, so it doesn't
+	// conflict with other servers.
+	options := fmt.Sprintf("-c listen_addresses='' -c unix_socket_directories='%s' -c fsync=off", dir)
+	output, err = exec.Command(pgctl, "start", "--wait", "--pgdata", filepath.Join(dir, "data"), "--log", filepath.Join(dir, "log"), "-o", options).CombinedOutput()
+	if err != nil {
+		testPostgres.err = fmt.Errorf("pg_ctl start: %s: %s", err, bytes.TrimSpace(output))
+		return
+	}
+	testPostgres.dataSource = fmt.Sprintf("host=%s user=domos sslmode=disable dbname=postgres", dir)
+}
+
+// stopTestPostgres stops the server started by startTestPostgres and removes
+// its data.
+func stopTestPostgres() {
+	if pgctl, err := findPostgresCommand("pg_ctl"); err == nil {
+		output, err := exec.Command(pgctl, "stop", "--wait", "--mode", "fast", "--pgdata", filepath.Join(testPostgres.dir, "data")).CombinedOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pg_ctl stop: %s: %s\n", err, bytes.TrimSpace(output))
+		}
+	}
+	os.RemoveAll(testPostgres.dir)
+}
+
+// findPostgresCommand looks for a postgres server command in $PATH and in the
+// directories where Debian and Ubuntu install them.
+func findPostgresCommand(name string) (string, error) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	paths, _ := filepath.Glob(filepath.Join("/usr/lib/postgresql/*/bin", name))
+	if len(paths) == 0 {
+		return "", fmt.Errorf("%s not found", name)
+	}
+	sort.Strings(paths)
+	return paths[len(paths)-1], nil
+}
+
+func TestRebind(t *testing.T) {
+	postgres := sqlDialects["postgres"]
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT id FROM devices", "SELECT id FROM devices"},
+		{"SELECT id FROM devices WHERE serial=?", "SELECT id FROM devices WHERE serial=$1"},
+		{"UPDATE sensors SET humanName=?, unit=? WHERE id=?", "UPDATE sensors SET humanName=$1, unit=$2 WHERE id=$3"},
+		{"INSERT INTO t (a, b, c, d, e, f, g, h, i, j, k) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", "INSERT INTO t (a, b, c, d, e, f, g, h, i, j, k) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"},
+	}
+	for _, tc := range tests {
+		if got := postgres.rebind(tc.query); got != tc.expected {
+			t.Errorf("rebind(%q) = %q, expected %q", tc.query, got, tc.expected)
+		}
+		if got := sqlDialects["sqlite3"].rebind(tc.query); got != tc.query {
+			t.Errorf("SQLite rebind(%q) = %q, expected the query unchanged", tc.query, got)
+		}
+	}
+}
+
+func TestMigrationTypes(t *testing.T) {
+	postgres := sqlDialects["postgres"]
+	statement := `CREATE TABLE t (
+		id    INTEGER PRIMARY KEY AUTOINCREMENT,
+		count INTEGER NOT NULL,
+		value REAL
+	)`
+	expected := `CREATE TABLE t (
+		id    BIGSERIAL PRIMARY KEY,
+		count BIGINT NOT NULL,
+		value DOUBLE PRECISION
+	)`
+	if got := postgres.types.Replace(statement); got != expected {
+		t.Errorf("postgres types:\n%s\nexpected:\n%s", got, expected)
+	}
+	if got := sqlDialects["sqlite3"].types.Replace(statement); got != statement {
+		t.Errorf("SQLite types changed the statement:\n%s", got)
+	}
+
+	// Every migration must still be valid after the rewrite.
+	for i, migration := range migrations {
+		for _, statement := range migration {
+			rewritten := postgres.types.Replace(statement)
+			if strings.Contains(rewritten, "AUTOINCREMENT") {
+				t.Errorf("migration %d still contains AUTOINCREMENT for postgres: %s", i+1, rewritten)
+			}
+		}
+	}
+}
+
+// TestMigrateUnversioned upgrades a database that was created by hand before
+// there were migrations, and checks that the data survives.
+func TestMigrateUnversioned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domos.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal("could not open database:", err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE devices (
+			id     INTEGER PRIMARY KEY AUTOINCREMENT,
+			serial TEXT NOT NULL UNIQUE,
+			name   TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE sensors (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			deviceId     INTEGER NOT NULL REFERENCES devices(id),
+			name         TEXT NOT NULL,
+			type         TEXT NOT NULL,
+			humanName    TEXT NOT NULL DEFAULT '',
+			desiredValue REAL,
+			UNIQUE (deviceId, name)
+		)`,
+		`CREATE TABLE sensorData (
+			sensorId INTEGER NOT NULL REFERENCES sensors(id),
+			time     INTEGER NOT NULL,
+			value    REAL,
+			interval INTEGER NOT NULL DEFAULT 0
+		)`,
+		`INSERT INTO devices (serial, name) VALUES ('device', 'house')`,
+		`INSERT INTO sensors (deviceId, name, type, humanName, desiredValue) VALUES (1, 'temp', 'temp', 'Living room', 20.5)`,
+		`INSERT INTO sensorData (sensorId, time, value, interval) VALUES (1, 1000000000000, 21.5, 60000000000)`,
+		`INSERT INTO sensorData (sensorId, time, value, interval) VALUES (1, 2000000000000, 22, 30000000000)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("could not create version 0 database: %s\n%s", err, statement)
+		}
+	}
+	db.Close()
+
+	// Twice: the second time there is nothing to migrate.
+	for i := 0; i < 2; i++ {
+		s, err := newSQLStore("sqlite3", path)
+		if err != nil {
+			t.Fatal("could not migrate:", err)
+		}
+		defer s.Close()
+		var version int
+		if err := s.queryRow("SELECT version FROM schemaVersion").Scan(&version); err != nil || version != len(migrations) {
+			t.Errorf("got schema version %d (%v), expected %d", version, err, len(migrations))
+		}
+
+		deviceId, name, err := s.GetDevice("device")
+		if err != nil || deviceId != 1 || name != "house" {
+			t.Fatalf("got device %d %q (%v), expected 1 \"house\"", deviceId, name, err)
+		}
+		sensor, err := s.GetSensor(deviceId, "temp")
+		if err != nil {
+			t.Fatal("could not get sensor:", err)
+		}
+		if sensor.sensorType != "temp" || sensor.valueType != ValueNumber || sensor.humanName != "Living room" || sensor.desiredValue != 20.5 || sensor.unit != "" || sensor.alarmMin != nil || sensor.alarmHysteresis != 0 {
+			t.Errorf("got sensor %+v", sensor)
+		}
+		samples, err := s.FetchSamples(sensor.dbId, 0)
+		if err != nil {
+			t.Fatal("could not fetch samples:", err)
+		}
+		expected := []LogReplyRow{{1000, 60, 21.5}, {2000, 30, 22.0}}
+		if !reflect.DeepEqual(samples, expected) {
+			t.Errorf("got samples %v, expected %v", samples, expected)
+		}
+		timings, err := s.GetLastSamples(deviceId)
+		if err != nil {
+			t.Fatal("could not get last samples:", err)
+		}
+		if timing := timings["temp"]; timing.last != 2000*time.Second || timing.interval != 30*time.Second {
+			t.Errorf("got last sample %v every %v, expected 2000s every 30s", timing.last, timing.interval)
+		}
+	}
+}
+
+// TestInsertReturningId checks both ways of getting the ID of a new row. SQLite
+// supports RETURNING too, so the postgres code path can be tested without a
+// postgres server.
+func TestInsertReturningId(t *testing.T) {
+	for _, returningId := range []bool{false, true} {
+		s := openTestSQLite(t)
+		s.dialect = &sqlDialect{
+			returningId: returningId,
+			types:       strings.NewReplacer(),
+		}
+		first, err := s.insert("INSERT INTO devices (serial, name) VALUES (?, ?)", "serial1", "first")
+		if err != nil {
+			t.Fatalf("returningId=%v: could not insert: %s", returningId, err)
+		}
+		second, err := s.insert("INSERT INTO devices (serial, name) VALUES (?, ?)", "serial2", "second")
+		if err != nil {
+			t.Fatalf("returningId=%v: could not insert: %s", returningId, err)
+		}
+		if first <= 0 || second != first+1 {
+			t.Errorf("returningId=%v: got IDs %d and %d", returningId, first, second)
+		}
+		var name string
+		err = s.queryRow("SELECT name FROM devices WHERE id=?", second).Scan(&name)
+		if err != nil || name != "second" {
+			t.Errorf("returningId=%v: selected %q (%v), expected \"second\"", returningId, name, err)
+		}
+	}
+}
+
+// TestSQLiteInsertSelect checks that the query helpers reach the database and
+// that rows come back as they were inserted.
+func TestSQLiteInsertSelect(t *testing.T) {
+	s := openTestSQLite(t)
+	testSQLInsertSelect(t, s)
+}
+
+// TestPostgresInsertSelect is TestSQLiteInsertSelect for postgres.
+func TestPostgresInsertSelect(t *testing.T) {
+	s := openTestPostgres(t)
+	testSQLInsertSelect(t, s)
+}
+
+func testSQLInsertSelect(t *testing.T, s *sqlStore) {
+	serial := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	id, err := s.AddDevice(serial, "kitchen")
+	if err != nil {
+		t.Fatal("could not add device:", err)
+	}
+	gotId, name, err := s.GetDevice(serial)
+	if err != nil {
+		t.Fatal("could not get device:", err)
+	}
+	if gotId != id || name != "kitchen" {
+		t.Errorf("got device %d %q, expected %d \"kitchen\"", gotId, name, id)
+	}
+	if _, _, err := s.GetDevice(serial + "-unknown"); err != errNotFound {
+		t.Errorf("unknown device: got error %v, expected errNotFound", err)
+	}
+
+	sensor, err := s.AddSensor(id, "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	err = s.InsertSample(sensor.dbId, 1000*time.Second, 60*time.Second, 21.5)
+	if err != nil {
+		t.Fatal("could not insert sample:", err)
+	}
+	rows, err := s.FetchSamples(sensor.dbId, 0)
+	if err != nil {
+		t.Fatal("could not fetch samples:", err)
+	}
+	if len(rows) != 1 || rows[0].Time != 1000 || rows[0].Interval != 60 || rows[0].Value != 21.5 {
+		t.Errorf("got samples %+v", rows)
+	}
+
+	var version int
+	err = s.queryRow("SELECT version FROM schemaVersion").Scan(&version)
+	if err == sql.ErrNoRows || version != len(migrations) {
+		t.Errorf("schema version %d (%v), expected %d", version, err, len(migrations))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var flagStaleIntervals = flag.Int("stale-intervals", 3, "mark a sensor stale after this many reporting intervals without a value (0 to disable)")
+
+// sampleTiming is the time of the last value of a sensor and the reporting
+// interval the device sent with it. Both are durations, the time is relative
+// to the UNIX epoch like in the store.
+type sampleTiming struct {
+	last     time.Duration
+	interval time.Duration
+}
+
+// staleAfter returns the time after which the sensor is stale, and false if it
+// never becomes stale because the device didn't say when it would report next.
+func (t sampleTiming) staleAfter() (time.Time, bool) {
+	if t.interval <= 0 || *flagStaleIntervals <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(t.last+t.interval*time.Duration(*flagStaleIntervals))), true
+}
+
+// loadSampleTimes loads the time of the last value of every sensor, so stale
+// sensors are still detected after a restart. The lock must be held.
+func (d *Device) loadSampleTimes() {
+	timings, err := store.GetLastSamples(d.dbId)
+	if err != nil {
+		log.Printf("could not load last sample times of device %d: %s", d.dbId, err)
+		timings = make(map[string]sampleTiming)
+	}
+	d.sampleTimes = timings
+}
+
+// markSampled records a new value of the sensor, and tells controls when the
+// sensor was stale.
+func (d *Device) markSampled(sensorName string, logtime, interval time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.sampleTimes == nil {
+		d.loadSampleTimes()
+	}
+	if timing, ok := d.sampleTimes[sensorName]; ok && timing.last > logtime {
+		// An old value that arrived late.
+		return
+	}
+	d.sampleTimes[sensorName] = sampleTiming{logtime, interval}
+	if d.staleSensors[sensorName] {
+		delete(d.staleSensors, sensorName)
+		d.sendStatus("fresh", sensorName, time.Unix(0, int64(logtime)))
+		d.notify("fresh", "Sensor "+sensorName+" is reporting again", "")
+	}
+}
+
+// checkStale marks sensors stale when several reporting intervals passed
+// without a value.
+func (d *Device) checkStale(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.sampleTimes == nil {
+		d.loadSampleTimes()
+	}
+	for name, timing := range d.sampleTimes {
+		staleAfter, ok := timing.staleAfter()
+		if !ok || d.staleSensors[name] || !now.After(staleAfter) {
+			continue
+		}
+		last := time.Unix(0, int64(timing.last))
+		log.Printf("Sensor %s of device %s is stale: no value since %s", name, d.name, last.Format(time.RFC3339))
+		d.staleSensors[name] = true
+		d.sendStatus("stale", name, last)
+		d.notify("stale", "Sensor "+name+" stopped reporting", "No value since "+last.Format(time.RFC1123)+".")
+	}
+}
+
+// IsStale returns whether the sensor missed several reports.
+func (d *Device) IsStale(sensorName string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.staleSensors[sensorName]
+}
+
+// runStaleCheck periodically checks for stale sensors.
+func runStaleCheck(ds *DeviceSet) {
+	if *flagStaleIntervals <= 0 {
+		return
+	}
+	for {
+		now := time.Now()
+		for _, device := range ds.allDevices() {
+			device.checkStale(now)
+		}
+		time.Sleep(LIVENESS_INTERVAL)
+	}
+}
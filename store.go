@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errNotFound is returned by a Store when the requested row does not exist.
+var errNotFound = errors.New("not found")
+
+// Store is the persistent storage for devices, sensors and sensor logs.
+type Store interface {
+	// GetDevice returns the ID and name of the device with the given serial.
+	// The serial is the hash of the device password (see deviceSerial).
+	GetDevice(serial string) (id int64, name string, err error)
+	// GetDevices returns the names of all devices, by ID.
+	GetDevices() (map[int64]string, error)
+	AddDevice(serial, name string) (int64, error)
+	SetDeviceName(id int64, name string) error
+	SetDeviceSerial(id int64, serial string) error
+
+	// GetActuators returns the last known value of all actuators of a device.
+	GetActuators(deviceId int64) (map[string]interface{}, error)
+	SetActuator(deviceId int64, name string, value interface{}) error
+	GetActuatorTypes(deviceId int64) (map[string]*ActuatorType, error)
+	// SetActuatorType stores the type of an actuator, or removes it if the
+	// type is nil.
+	SetActuatorType(deviceId int64, name string, actuatorType *ActuatorType) error
+	AddActuatorChange(deviceId int64, change *ActuatorChange) error
+	// GetActuatorChanges returns the changes in [start, end) in chronological
+	// order, for one actuator or (if the name is empty) for all actuators. At
+	// most limit changes are returned: the newest ones.
+	GetActuatorChanges(deviceId int64, name string, start, end time.Duration, limit int) ([]*ActuatorChange, error)
+
+	GetRules(deviceId int64) ([]*Rule, error)
+	// SaveRule inserts a rule (if the ID is 0) or updates it, and returns the
+	// ID.
+	SaveRule(deviceId int64, rule *Rule) (int64, error)
+	DeleteRule(deviceId, ruleId int64) error
+
+	GetThermostats(deviceId int64) ([]*Thermostat, error)
+	// SaveThermostat inserts a thermostat (if the ID is 0) or updates it, and
+	// returns the ID.
+	SaveThermostat(deviceId int64, thermostat *Thermostat) (int64, error)
+	DeleteThermostat(deviceId, thermostatId int64) error
+
+	GetSchedules(deviceId int64) ([]*Schedule, error)
+	// SaveSchedule inserts a schedule (if the ID is 0) or updates it, and
+	// returns the ID.
+	SaveSchedule(deviceId int64, schedule *Schedule) (int64, error)
+	DeleteSchedule(deviceId, scheduleId int64) error
+
+	GetScenes(deviceId int64) ([]*Scene, error)
+	// SaveScene inserts a scene (if the ID is 0) or updates it, and returns the
+	// ID. Scene names are unique per device.
+	SaveScene(deviceId int64, scene *Scene) (int64, error)
+	DeleteScene(deviceId, sceneId int64) error
+
+	// GetOpenAlarms returns the alarms of a device that have not been
+	// cleared, in the order they were raised.
+	GetOpenAlarms(deviceId int64) ([]*Alarm, error)
+	// SaveAlarm inserts an alarm (if the ID is 0) or updates it, and returns
+	// the ID.
+	SaveAlarm(deviceId int64, alarm *Alarm) (int64, error)
+
+	GetSensors(deviceId int64) ([]*Sensor, error)
+	GetSensor(deviceId int64, name string) (*Sensor, error)
+	AddSensor(deviceId int64, name, sensorType, valueType string) (*Sensor, error)
+	UpdateSensor(sensorId int64, humanName, unit string, desiredValue, alarmMin, alarmMax interface{}, alarmHysteresis float64) error
+
+	// InsertSample stores one sensor value. The time is relative to the UNIX
+	// epoch.
+	InsertSample(sensorId int64, logtime, interval time.Duration, value interface{}) error
+	// FetchSamples returns all values logged strictly after the given time, in
+	// chronological order.
+	FetchSamples(sensorId int64, since time.Duration) ([]LogReplyRow, error)
+	// GetLastSamples returns the time and interval of the last value of each
+	// sensor of a device that has values, by sensor name. They are kept when
+	// the values themselves are pruned.
+	GetLastSamples(deviceId int64) (map[string]sampleTiming, error)
+	// FetchHistory aggregates the values of the given tier in [start, end)
+	// into buckets of the given size. Buckets without values are omitted.
+	FetchHistory(sensorId int64, tier historyTier, start, end, bucket time.Duration) ([]HistoryBucket, error)
+	// LastRollup returns the start time of the most recent row in the given
+	// rollup tier, or 0 if it is empty.
+	LastRollup(tier historyTier) (time.Duration, error)
+	// Rollup (re)computes the rows of a rollup tier in [from, until) from the
+	// next finer tier.
+	Rollup(tier historyTier, from, until time.Duration) error
+	// Prune removes all rows of the given tier before the given time.
+	Prune(tier historyTier, before time.Duration) error
+
+	AddUser(name, passwordHash string) (int64, error)
+	GetUser(name string) (*User, error)
+	GetUsers() ([]*User, error)
+	SetUserPassword(userId int64, passwordHash string) error
+	// GetUserDevices returns the IDs of the devices the user has access to.
+	GetUserDevices(userId int64) ([]int64, error)
+	// GrantDevice gives a user access to a device, or changes the role if the
+	// user already has access.
+	GrantDevice(userId, deviceId int64, role Role) error
+	RevokeDevice(userId, deviceId int64) error
+	// GetPermissions returns the permissions of a user on a device, or
+	// errNotFound if the user has no access to it.
+	GetPermissions(userId, deviceId int64) (*Permissions, error)
+	AddGrant(userId, deviceId int64, kind, name string) error
+	RemoveGrant(userId, deviceId int64, kind, name string) error
+
+	AddToken(userId int64, name, tokenHash string, created time.Time) (int64, error)
+	GetTokens(userId int64) ([]*Token, error)
+	// GetTokenUser returns the owner of a token that has not been revoked.
+	GetTokenUser(tokenHash string) (*User, error)
+	RevokeToken(tokenId int64, revoked time.Time) error
+
+	Close() error
+}
+
+// store is the Store in use by this process.
+var store Store
+
+// openStore returns the Store for the given -logtype and -log flags.
+func openStore(logType, path string) (Store, error) {
+	switch logType {
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite3", "postgres":
+		if path == "" {
+			return nil, errors.New("empty log path")
+		}
+		return newSQLStore(logType, path)
+	default:
+		return nil, fmt.Errorf("unknown log type: %s", logType)
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testStores runs the test against every Store implementation, each with a new
+// empty store. The postgres store is skipped when there is no postgres server,
+// see openTestPostgres.
+func testStores(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("sqlite3", func(t *testing.T) {
+		test(t, openTestSQLite(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		test(t, openTestPostgres(t))
+	})
+}
+
+// addTestDevice adds a device to the store and returns its ID.
+func addTestDevice(t *testing.T, s Store, serial string) int64 {
+	t.Helper()
+	id, err := s.AddDevice(serial, serial+" name")
+	if err != nil {
+		t.Fatal("could not add device:", err)
+	}
+	return id
+}
+
+func TestStoreDevices(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		if _, _, err := s.GetDevice("unknown"); err != errNotFound {
+			t.Errorf("unknown device: got error %v, expected errNotFound", err)
+		}
+		first := addTestDevice(t, s, "first")
+		second := addTestDevice(t, s, "second")
+		if first == second {
+			t.Fatalf("both devices got ID %d", first)
+		}
+		if err := s.SetDeviceName(second, "renamed"); err != nil {
+			t.Fatal("could not rename device:", err)
+		}
+		if err := s.SetDeviceSerial(second, "2nd"); err != nil {
+			t.Fatal("could not change serial:", err)
+		}
+		if _, _, err := s.GetDevice("second"); err != errNotFound {
+			t.Errorf("old serial: got error %v, expected errNotFound", err)
+		}
+		id, name, err := s.GetDevice("2nd")
+		if err != nil || id != second || name != "renamed" {
+			t.Errorf("got device %d %q (%v), expected %d \"renamed\"", id, name, err, second)
+		}
+		devices, err := s.GetDevices()
+		if err != nil {
+			t.Fatal("could not get devices:", err)
+		}
+		expected := map[int64]string{first: "first name", second: "renamed"}
+		if !reflect.DeepEqual(devices, expected) {
+			t.Errorf("got devices %v, expected %v", devices, expected)
+		}
+	})
+}
+
+func TestStoreActuators(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		values := map[string]interface{}{
+			"led":    "#ff0000",
+			"heater": true,
+			"level":  3.0,
+		}
+		for name, value := range values {
+			if err := s.SetActuator(deviceId, name, value); err != nil {
+				t.Fatal("could not set actuator:", err)
+			}
+		}
+		if err := s.SetActuator(deviceId, "level", 4.0); err != nil {
+			t.Fatal("could not update actuator:", err)
+		}
+		values["level"] = 4.0
+		actuators, err := s.GetActuators(deviceId)
+		if err != nil {
+			t.Fatal("could not get actuators:", err)
+		}
+		if !reflect.DeepEqual(actuators, values) {
+			t.Errorf("got actuators %v, expected %v", actuators, values)
+		}
+
+		for i, value := range []interface{}{1.0, 2.0, 3.0} {
+			err := s.AddActuatorChange(deviceId, &ActuatorChange{
+				Name:   "level",
+				Time:   int64(100 + i),
+				Value:  value,
+				Source: SourceDevice,
+			})
+			if err != nil {
+				t.Fatal("could not add actuator change:", err)
+			}
+		}
+		changes, err := s.GetActuatorChanges(deviceId, "level", 0, 200*time.Second, 10)
+		if err != nil {
+			t.Fatal("could not get actuator changes:", err)
+		}
+		if len(changes) != 3 || changes[0].Time != 100 || changes[2].Value != 3.0 || changes[2].Source != SourceDevice {
+			t.Errorf("got changes %+v", changes)
+		}
+
+		// Only the newest changes fit in the limit.
+		changes, err = s.GetActuatorChanges(deviceId, "level", 0, 200*time.Second, 2)
+		if err != nil {
+			t.Fatal("could not get actuator changes:", err)
+		}
+		if len(changes) != 2 || changes[0].Time != 101 || changes[1].Time != 102 {
+			t.Errorf("got changes %+v, expected the changes at 101 and 102", changes)
+		}
+	})
+}
+
+func TestStoreRules(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		rule := &Rule{
+			Name:      "cold",
+			Sensor:    "temp",
+			Operator:  "<",
+			Threshold: 18,
+			Actuator:  "heater",
+			Value:     true,
+			Notify:    true,
+			Enabled:   true,
+		}
+		id, err := s.SaveRule(deviceId, rule)
+		if err != nil {
+			t.Fatal("could not save rule:", err)
+		}
+		rule.Id = id
+		rule.ReleaseValue = false
+		if _, err := s.SaveRule(deviceId, rule); err != nil {
+			t.Fatal("could not update rule:", err)
+		}
+		rules, err := s.GetRules(deviceId)
+		if err != nil {
+			t.Fatal("could not get rules:", err)
+		}
+		if len(rules) != 1 || !reflect.DeepEqual(rules[0], rule) {
+			t.Errorf("got rules %+v, expected %+v", rules, rule)
+		}
+
+		unknown := *rule
+		unknown.Id = id + 100
+		if _, err := s.SaveRule(deviceId, &unknown); err != errNotFound {
+			t.Errorf("update of unknown rule: got error %v, expected errNotFound", err)
+		}
+		if err := s.DeleteRule(deviceId, id); err != nil {
+			t.Error("could not delete rule:", err)
+		}
+		if err := s.DeleteRule(deviceId, id); err != errNotFound {
+			t.Errorf("second delete: got error %v, expected errNotFound", err)
+		}
+	})
+}
+
+func TestStoreSensors(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		if _, err := s.GetSensor(deviceId, "temp"); err != errNotFound {
+			t.Errorf("unknown sensor: got error %v, expected errNotFound", err)
+		}
+		sensor, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		err = s.UpdateSensor(sensor.dbId, "Living room", "°C", 20.5, nil, 30.0, 0.5)
+		if err != nil {
+			t.Fatal("could not update sensor:", err)
+		}
+		sensor, err = s.GetSensor(deviceId, "temp")
+		if err != nil {
+			t.Fatal("could not get sensor:", err)
+		}
+		if sensor.humanName != "Living room" || sensor.unit != "°C" || sensor.desiredValue != 20.5 || sensor.alarmMin != nil || sensor.alarmMax != 30.0 || sensor.alarmHysteresis != 0.5 {
+			t.Errorf("got sensor %+v", sensor)
+		}
+		if _, err := s.AddSensor(deviceId, "door", "door", ValueBoolean); err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		sensors, err := s.GetSensors(deviceId)
+		if err != nil {
+			t.Fatal("could not get sensors:", err)
+		}
+		if len(sensors) != 2 || sensors[0].name != "temp" || sensors[1].valueType != ValueBoolean {
+			t.Errorf("got sensors %+v", sensors)
+		}
+	})
+}
+
+func TestStoreSamples(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		temp, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		door, err := s.AddSensor(deviceId, "door", "door", ValueBoolean)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		for i, value := range []float64{20, 21, 22} {
+			err := s.InsertSample(temp.dbId, time.Duration(100+60*i)*time.Second, 60*time.Second, value)
+			if err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+		if err := s.InsertSample(door.dbId, 130*time.Second, 0, true); err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+
+		rows, err := s.FetchSamples(temp.dbId, 100*time.Second)
+		if err != nil {
+			t.Fatal("could not fetch samples:", err)
+		}
+		expected := []LogReplyRow{{160, 60, 21.0}, {220, 60, 22.0}}
+		if !reflect.DeepEqual(rows, expected) {
+			t.Errorf("got samples %v, expected %v", rows, expected)
+		}
+		rows, err = s.FetchSamples(door.dbId, 0)
+		if err != nil {
+			t.Fatal("could not fetch samples:", err)
+		}
+		if len(rows) != 1 || rows[0].Value != true {
+			t.Errorf("got samples %v, expected one true value", rows)
+		}
+
+		timings, err := s.GetLastSamples(deviceId)
+		if err != nil {
+			t.Fatal("could not get last samples:", err)
+		}
+		expectedTimings := map[string]sampleTiming{
+			"temp": {220 * time.Second, 60 * time.Second},
+			"door": {130 * time.Second, 0},
+		}
+		if !reflect.DeepEqual(timings, expectedTimings) {
+			t.Errorf("got last samples %v, expected %v", timings, expectedTimings)
+		}
+
+		// The last samples are still known when retention removed the values.
+		if err := s.Prune(tierRaw, 1000*time.Second); err != nil {
+			t.Fatal("could not prune samples:", err)
+		}
+		timings, err = s.GetLastSamples(deviceId)
+		if err != nil {
+			t.Fatal("could not get last samples:", err)
+		}
+		if !reflect.DeepEqual(timings, expectedTimings) {
+			t.Errorf("got last samples after pruning %v, expected %v", timings, expectedTimings)
+		}
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		userId, err := s.AddUser("alice", "hash")
+		if err != nil {
+			t.Fatal("could not add user:", err)
+		}
+		if _, err := s.GetPermissions(userId, deviceId); err != errNotFound {
+			t.Errorf("permissions without access: got error %v, expected errNotFound", err)
+		}
+		if err := s.GrantDevice(userId, deviceId, RoleViewer); err != nil {
+			t.Fatal("could not grant device:", err)
+		}
+		if err := s.AddGrant(userId, deviceId, GrantActuator, "led"); err != nil {
+			t.Fatal("could not add grant:", err)
+		}
+		permissions, err := s.GetPermissions(userId, deviceId)
+		if err != nil {
+			t.Fatal("could not get permissions:", err)
+		}
+		if permissions.Role != RoleViewer || !permissions.CanSetActuator("led") || permissions.CanSetActuator("heater") {
+			t.Errorf("got permissions %+v", permissions)
+		}
+
+		tokenId, err := s.AddToken(userId, "phone", "tokenhash", time.Unix(1000, 0))
+		if err != nil {
+			t.Fatal("could not add token:", err)
+		}
+		user, err := s.GetTokenUser("tokenhash")
+		if err != nil || user.name != "alice" {
+			t.Errorf("got token user %+v (%v), expected alice", user, err)
+		}
+		if err := s.RevokeToken(tokenId, time.Unix(2000, 0)); err != nil {
+			t.Fatal("could not revoke token:", err)
+		}
+		if _, err := s.GetTokenUser("tokenhash"); err != errNotFound {
+			t.Errorf("revoked token: got error %v, expected errNotFound", err)
+		}
+	})
+}
+
+func TestStoreAlarms(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		alarm := &Alarm{
+			Sensor:    "freezer",
+			Kind:      AlarmHigh,
+			State:     AlarmActive,
+			Threshold: -15,
+			Value:     -12,
+			Unit:      "°C",
+			Raised:    1000,
+		}
+		id, err := s.SaveAlarm(deviceId, alarm)
+		if err != nil {
+			t.Fatal("could not save alarm:", err)
+		}
+		alarm.Id = id
+		alarms, err := s.GetOpenAlarms(deviceId)
+		if err != nil {
+			t.Fatal("could not get alarms:", err)
+		}
+		if len(alarms) != 1 || !reflect.DeepEqual(alarms[0], alarm) {
+			t.Errorf("got alarms %+v, expected %+v", alarms, alarm)
+		}
+
+		alarm.State = AlarmCleared
+		alarm.Cleared = 2000
+		if _, err := s.SaveAlarm(deviceId, alarm); err != nil {
+			t.Fatal("could not update alarm:", err)
+		}
+		alarms, err = s.GetOpenAlarms(deviceId)
+		if err != nil || len(alarms) != 0 {
+			t.Errorf("got open alarms %+v (%v), expected none", alarms, err)
+		}
+	})
+}
+
+// checkBuckets compares history buckets, ignoring rounding errors in the
+// average.
+func checkBuckets(t *testing.T, what string, buckets, expected []HistoryBucket) {
+	t.Helper()
+	if len(buckets) != len(expected) {
+		t.Errorf("%s: got %d buckets %+v, expected %+v", what, len(buckets), buckets, expected)
+		return
+	}
+	for i, bucket := range buckets {
+		e := expected[i]
+		if bucket.Time != e.Time || bucket.Count != e.Count || bucket.Min != e.Min || bucket.Max != e.Max || math.Abs(bucket.Avg-e.Avg) > 1e-9 {
+			t.Errorf("%s: bucket %d is %+v, expected %+v", what, i, bucket, e)
+		}
+	}
+}
+
+func TestStoreRollup(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		temp, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		door, err := s.AddSensor(deviceId, "door", "door", ValueBoolean)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+
+		const day = 86400
+		start := int64(10 * day)
+		samples := []struct {
+			time     int64
+			interval int64
+			value    float64
+		}{
+			{start, 60, 10},
+			{start + 1800, 180, 20}, // counts three times as much as the first
+			{start + 3600, 0, 30},   // no interval: counts as one second
+			{start + day + 100, 60, 40},
+		}
+		for _, sample := range samples {
+			err := s.InsertSample(temp.dbId, time.Duration(sample.time)*time.Second, time.Duration(sample.interval)*time.Second, sample.value)
+			if err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+		if err := s.InsertSample(door.dbId, time.Duration(start)*time.Second, 60*time.Second, true); err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+
+		for _, tier := range []historyTier{tierHourly, tierDaily} {
+			last, err := s.LastRollup(tier)
+			if err != nil || last != 0 {
+				t.Errorf("tier %d: got last rollup %v (%v) before the first rollup, expected 0", tier, last, err)
+			}
+		}
+
+		startNs := time.Duration(start) * time.Second
+		untilNs := startNs + 2*day*time.Second
+		if err := s.Rollup(tierHourly, 0, untilNs); err != nil {
+			t.Fatal("could not roll up hourly:", err)
+		}
+		if err := s.Rollup(tierDaily, 0, untilNs); err != nil {
+			t.Fatal("could not roll up daily:", err)
+		}
+
+		hourly, err := s.FetchHistory(temp.dbId, tierHourly, 0, untilNs, time.Hour)
+		if err != nil {
+			t.Fatal("could not fetch hourly history:", err)
+		}
+		checkBuckets(t, "hourly", hourly, []HistoryBucket{
+			{Time: start, Count: 2, Min: 10, Avg: (10*60 + 20*180) / 240.0, Max: 20},
+			{Time: start + 3600, Count: 1, Min: 30, Avg: 30, Max: 30},
+			{Time: start + day, Count: 1, Min: 40, Avg: 40, Max: 40},
+		})
+		daily, err := s.FetchHistory(temp.dbId, tierDaily, 0, untilNs, 24*time.Hour)
+		if err != nil {
+			t.Fatal("could not fetch daily history:", err)
+		}
+		checkBuckets(t, "daily", daily, []HistoryBucket{
+			{Time: start, Count: 3, Min: 10, Avg: (10*60 + 20*180 + 30*1) / 241.0, Max: 30},
+			{Time: start + day, Count: 1, Min: 40, Avg: 40, Max: 40},
+		})
+		for _, tier := range []historyTier{tierHourly, tierDaily} {
+			buckets, err := s.FetchHistory(door.dbId, tier, 0, untilNs, tier.period())
+			if err != nil || len(buckets) != 0 {
+				t.Errorf("tier %d: got buckets %+v (%v) for a boolean sensor, expected none", tier, buckets, err)
+			}
+		}
+
+		// The last bucket is recomputed with the values that arrived late,
+		// without touching the buckets before it.
+		lastHour, err := s.LastRollup(tierHourly)
+		if err != nil || lastHour != startNs+day*time.Second {
+			t.Fatalf("got last hourly rollup %v (%v), expected %v", lastHour, err, startNs+day*time.Second)
+		}
+		if err := s.InsertSample(temp.dbId, lastHour+200*time.Second, 60*time.Second, 50.0); err != nil {
+			t.Fatal("could not insert sample:", err)
+		}
+		if err := s.Rollup(tierHourly, lastHour, untilNs); err != nil {
+			t.Fatal("could not roll up hourly:", err)
+		}
+		hourly, err = s.FetchHistory(temp.dbId, tierHourly, 0, untilNs, time.Hour)
+		if err != nil {
+			t.Fatal("could not fetch hourly history:", err)
+		}
+		checkBuckets(t, "hourly after recomputing", hourly, []HistoryBucket{
+			{Time: start, Count: 2, Min: 10, Avg: (10*60 + 20*180) / 240.0, Max: 20},
+			{Time: start + 3600, Count: 1, Min: 30, Avg: 30, Max: 30},
+			{Time: start + day, Count: 2, Min: 40, Avg: 45, Max: 50},
+		})
+
+		// Rollup rows stay when the values they were computed from are
+		// pruned, and can be pruned themselves.
+		if err := s.Prune(tierRaw, untilNs); err != nil {
+			t.Fatal("could not prune raw values:", err)
+		}
+		if err := s.Prune(tierHourly, startNs+day*time.Second); err != nil {
+			t.Fatal("could not prune hourly rollups:", err)
+		}
+		raw, err := s.FetchHistory(temp.dbId, tierRaw, 0, untilNs, time.Hour)
+		if err != nil || len(raw) != 0 {
+			t.Errorf("got raw history %+v (%v) after pruning, expected none", raw, err)
+		}
+		hourly, err = s.FetchHistory(temp.dbId, tierHourly, 0, untilNs, time.Hour)
+		if err != nil {
+			t.Fatal("could not fetch hourly history:", err)
+		}
+		checkBuckets(t, "hourly after pruning", hourly, []HistoryBucket{
+			{Time: start + day, Count: 2, Min: 40, Avg: 45, Max: 50},
+		})
+		daily, err = s.FetchHistory(temp.dbId, tierDaily, 0, untilNs, 24*time.Hour)
+		if err != nil {
+			t.Fatal("could not fetch daily history:", err)
+		}
+		if len(daily) != 2 {
+			t.Errorf("got daily history %+v after pruning, expected 2 buckets", daily)
+		}
+	})
+}
+
+func TestStoreFetchHistory(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		deviceId := addTestDevice(t, s, "device")
+		sensor, err := s.AddSensor(deviceId, "temp", "temp", ValueNumber)
+		if err != nil {
+			t.Fatal("could not add sensor:", err)
+		}
+		samples := []struct {
+			time     int64
+			interval int64
+			value    interface{}
+		}{
+			{990, 60, 1.0},   // before the start
+			{1000, 60, 10.0}, // the start is inclusive
+			{1100, 300, 20.0},
+			{1200, 0, "invalid"}, // not a number
+			{1300, 0, true},
+			{1650, 0, 30.0}, // no interval: counts as one second
+			{1700, 120, -5.0},
+			{3000, 60, 40.0}, // after an empty bucket
+			{3600, 60, 50.0}, // the end is exclusive
+		}
+		for _, sample := range samples {
+			err := s.InsertSample(sensor.dbId, time.Duration(sample.time)*time.Second, time.Duration(sample.interval)*time.Second, sample.value)
+			if err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+
+		buckets, err := s.FetchHistory(sensor.dbId, tierRaw, 1000*time.Second, 3600*time.Second, 600*time.Second)
+		if err != nil {
+			t.Fatal("could not fetch history:", err)
+		}
+		// Buckets start at a multiple of the bucket size, and empty buckets
+		// are left out.
+		checkBuckets(t, "history", buckets, []HistoryBucket{
+			{Time: 600, Count: 2, Min: 10, Avg: (10*60 + 20*300) / 360.0, Max: 20},
+			{Time: 1200, Count: 2, Min: -5, Avg: (30*1 - 5*120) / 121.0, Max: 30},
+			{Time: 3000, Count: 1, Min: 40, Avg: 40, Max: 40},
+		})
+	})
+}
+
+// TestStoreHistoryAgree checks that every store aggregates the same values the
+// same way as the memory store, which is the simplest implementation.
+func TestStoreHistoryAgree(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		reference := newMemoryStore()
+		var sensorIds [2]int64
+		var referenceIds [2]int64
+		for i, name := range []string{"temp", "humidity"} {
+			sensor, err := s.AddSensor(addTestDevice(t, s, name), name, name, ValueNumber)
+			if err != nil {
+				t.Fatal("could not add sensor:", err)
+			}
+			sensorIds[i] = sensor.dbId
+			sensor, err = reference.AddSensor(addTestDevice(t, reference, name), name, name, ValueNumber)
+			if err != nil {
+				t.Fatal("could not add sensor:", err)
+			}
+			referenceIds[i] = sensor.dbId
+		}
+
+		const days = 3
+		random := rand.New(rand.NewSource(1))
+		intervals := []time.Duration{0, 30 * time.Second, 60 * time.Second, 300 * time.Second}
+		for n := 0; n < 1000; n++ {
+			i := random.Intn(len(sensorIds))
+			logtime := time.Duration(random.Int63n(days*86400)) * time.Second
+			interval := intervals[random.Intn(len(intervals))]
+			var value interface{} = float64(random.Intn(4000)-1000) / 100
+			if random.Intn(20) == 0 {
+				value = "not a number"
+			}
+			if err := s.InsertSample(sensorIds[i], logtime, interval, value); err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+			if err := reference.InsertSample(referenceIds[i], logtime, interval, value); err != nil {
+				t.Fatal("could not insert sample:", err)
+			}
+		}
+
+		compare := func(tier historyTier, start, end, bucket time.Duration) {
+			t.Helper()
+			for i := range sensorIds {
+				buckets, err := s.FetchHistory(sensorIds[i], tier, start, end, bucket)
+				if err != nil {
+					t.Fatal("could not fetch history:", err)
+				}
+				expected, err := reference.FetchHistory(referenceIds[i], tier, start, end, bucket)
+				if err != nil {
+					t.Fatal("could not fetch reference history:", err)
+				}
+				checkBuckets(t, fmt.Sprintf("tier %d, sensor %d, [%v, %v) by %v", tier, i, start, end, bucket), buckets, expected)
+			}
+		}
+		compare(tierRaw, 0, days*24*time.Hour, time.Hour)
+		compare(tierRaw, 1234*time.Second, 86400*time.Second, 7*time.Second)
+		compare(tierRaw, 5*time.Hour, 50*time.Hour, 3601*time.Second)
+
+		for _, tier := range []historyTier{tierHourly, tierDaily} {
+			for _, st := range []Store{s, reference} {
+				if err := st.Rollup(tier, 0, days*24*time.Hour); err != nil {
+					t.Fatal("could not roll up:", err)
+				}
+			}
+			compare(tier, 0, days*24*time.Hour, tier.period())
+			compare(tier, 3*time.Hour, 60*time.Hour, 2*tier.period())
+		}
+	})
+}
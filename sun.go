@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// sunTimes returns the time of sunrise and sunset on the given day at the
+// given location (degrees, north and east are positive). It uses the sunrise
+// equation, which is accurate to about a minute. The last return value is
+// false if the sun doesn't rise or set on that day (polar day or night).
+func sunTimes(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	const toRad = math.Pi / 180
+	const toDeg = 180 / math.Pi
+
+	// Julian day number of this date (at noon UTC).
+	year, month, day := date.Date()
+	noon := time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	julianDate := float64(noon.Unix())/86400 + 2440587.5
+	n := math.Round(julianDate - 2451545.0 + 0.0008)
+
+	// Mean solar time, solar mean anomaly, equation of the center and
+	// ecliptic longitude.
+	meanSolarTime := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(anomaly*toRad) + 0.02*math.Sin(2*anomaly*toRad) + 0.0003*math.Sin(3*anomaly*toRad)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+
+	// Solar transit (solar noon) and declination of the sun.
+	transit := 2451545.0 + meanSolarTime + 0.0053*math.Sin(anomaly*toRad) - 0.0069*math.Sin(2*eclipticLongitude*toRad)
+	sinDeclination := math.Sin(eclipticLongitude*toRad) * math.Sin(23.44*toRad)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+
+	// Hour angle, corrected for refraction and the size of the solar disc.
+	cosHourAngle := (math.Sin(-0.833*toRad) - math.Sin(latitude*toRad)*sinDeclination) / (math.Cos(latitude*toRad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * toDeg
+
+	fromJulian := func(julianDate float64) time.Time {
+		seconds := (julianDate - 2440587.5) * 86400
+		return time.Unix(int64(seconds), 0).In(date.Location())
+	}
+	return fromJulian(transit - hourAngle/360), fromJulian(transit + hourAngle/360), true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunTimes(t *testing.T) {
+	tests := []struct {
+		name                string
+		latitude, longitude float64
+		date                time.Time // noon local time
+		sunrise, sunset     string    // local time, from published tables
+	}{
+		{"Amsterdam midsummer", 52.37, 4.90, time.Date(2024, 6, 21, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600)), "05:18", "22:06"},
+		{"Amsterdam midwinter", 52.37, 4.90, time.Date(2024, 12, 21, 12, 0, 0, 0, time.FixedZone("CET", 1*3600)), "08:48", "16:29"},
+		{"New York", 40.7128, -74.0060, time.Date(2024, 12, 21, 12, 0, 0, 0, time.FixedZone("EST", -5*3600)), "07:16", "16:32"},
+		{"Sydney", -33.8688, 151.2093, time.Date(2024, 6, 21, 12, 0, 0, 0, time.FixedZone("AEST", 10*3600)), "07:00", "16:54"},
+	}
+	for _, tc := range tests {
+		sunrise, sunset, ok := sunTimes(tc.date, tc.latitude, tc.longitude)
+		if !ok {
+			t.Errorf("%s: no sunrise or sunset", tc.name)
+			continue
+		}
+		for _, event := range []struct {
+			name     string
+			got      time.Time
+			expected string
+		}{{"sunrise", sunrise, tc.sunrise}, {"sunset", sunset, tc.sunset}} {
+			clock, err := time.Parse("15:04", event.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			year, month, day := tc.date.Date()
+			expected := time.Date(year, month, day, clock.Hour(), clock.Minute(), 0, 0, tc.date.Location())
+			// The sunrise equation is accurate to about a minute, and the
+			// tables are rounded to the minute.
+			if diff := event.got.Sub(expected); diff < -2*time.Minute || diff > 2*time.Minute {
+				t.Errorf("%s: %s at %s, expected %s", tc.name, event.name, event.got.Format("2006-01-02 15:04:05 MST"), event.expected)
+			}
+		}
+	}
+}
+
+func TestSunTimesPolar(t *testing.T) {
+	// Tromsø has midnight sun in June and polar night in December.
+	for _, date := range []time.Time{
+		time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 12, 21, 12, 0, 0, 0, time.UTC),
+	} {
+		if sunrise, sunset, ok := sunTimes(date, 69.65, 18.96); ok {
+			t.Errorf("Tromsø on %s: got sunrise %s and sunset %s, expected none", date.Format("2006-01-02"), sunrise, sunset)
+		}
+	}
+	// But the sun does rise and set there at the equinox.
+	if _, _, ok := sunTimes(time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC), 69.65, 18.96); !ok {
+		t.Error("Tromsø at the equinox: no sunrise or sunset")
+	}
+}
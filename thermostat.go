@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const THERMOSTAT_INTERVAL = 30 * time.Second // how often to check for stale sensors
+
+// Thermostat drives a heating actuator to keep a temperature sensor at its
+// desired value.
+type Thermostat struct {
+	Id            int64       `json:"id"`
+	Sensor        string      `json:"sensor"`
+	Actuator      string      `json:"actuator"`
+	OnValue       interface{} `json:"onValue"`       // actuator value to turn the heating on
+	OffValue      interface{} `json:"offValue"`      // actuator value to turn the heating off
+	FallbackValue interface{} `json:"fallbackValue"` // actuator value when the sensor stops reporting
+	Hysteresis    float64     `json:"hysteresis"`    // width of the band around the desired value
+	MinOnTime     int64       `json:"minOnTime"`     // minimum number of seconds to stay on
+	MinOffTime    int64       `json:"minOffTime"`    // minimum number of seconds to stay off
+	Timeout       int64       `json:"timeout"`       // seconds without values before falling back
+	Enabled       bool        `json:"enabled"`
+}
+
+// thermostatState is the runtime state of a thermostat.
+type thermostatState struct {
+	*Thermostat
+	known      bool // the actuator has been set at least once
+	heating    bool
+	fallback   bool
+	lastSwitch time.Time
+	lastValue  float64
+	lastSample time.Time
+}
+
+func (t *Thermostat) validate() error {
+	if t.Sensor == "" || t.Actuator == "" {
+		return errors.New("thermostat needs a sensor and an actuator")
+	}
+	if t.OnValue == nil || t.OffValue == nil || t.FallbackValue == nil {
+		return errors.New("thermostat needs an on, off and fallback value")
+	}
+	if t.Hysteresis < 0 || t.MinOnTime < 0 || t.MinOffTime < 0 {
+		return errors.New("hysteresis and minimum times cannot be negative")
+	}
+	if t.Timeout <= 0 {
+		return errors.New("thermostat timeout must be positive")
+	}
+	return nil
+}
+
+// loadThermostats loads the thermostats of this device from the database,
+// keeping the state of thermostats that were already loaded. The lock must be
+// held.
+func (d *Device) loadThermostats() {
+	thermostats, err := store.GetThermostats(d.dbId)
+	if err != nil {
+		log.Printf("could not load thermostats of device %d: %s", d.dbId, err)
+		return
+	}
+	states := make([]*thermostatState, len(thermostats))
+	for i, thermostat := range thermostats {
+		states[i] = &thermostatState{
+			Thermostat: thermostat,
+			// Give the sensor some time to report after a restart.
+			lastSample: time.Now(),
+		}
+		for _, oldState := range d.thermostats {
+			if oldState.Id == thermostat.Id && oldState.Sensor == thermostat.Sensor {
+				state := *oldState
+				state.Thermostat = thermostat
+				states[i] = &state
+			}
+		}
+	}
+	d.thermostats = states
+}
+
+// updateThermostats runs the thermostats bound to this sensor for a new value,
+// received at the given time.
+func (d *Device) updateThermostats(sensor *Sensor, value interface{}, now time.Time) {
+	valueFl, ok := value.(float64)
+	if !ok {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.thermostats == nil {
+		d.loadThermostats()
+	}
+	for _, thermostat := range d.thermostats {
+		if thermostat.Sensor != sensor.name {
+			continue
+		}
+		thermostat.lastValue = valueFl
+		thermostat.lastSample = now
+		d.runThermostat(thermostat, sensor.desiredValue, now)
+	}
+}
+
+// runThermostat decides whether the heating should be on. The lock must be
+// held.
+func (d *Device) runThermostat(thermostat *thermostatState, desiredValue interface{}, now time.Time) {
+	if !thermostat.Enabled {
+		return
+	}
+	desired, ok := toFloat(desiredValue)
+	if !ok {
+		// No desired value, so no heating.
+		d.switchThermostat(thermostat, false, now)
+		return
+	}
+
+	heating := thermostat.heating
+	if thermostat.lastValue < desired-thermostat.Hysteresis/2 {
+		heating = true
+	} else if thermostat.lastValue > desired+thermostat.Hysteresis/2 {
+		heating = false
+	}
+	if thermostat.known && !thermostat.fallback && heating != thermostat.heating {
+		minTime := thermostat.MinOffTime
+		if thermostat.heating {
+			minTime = thermostat.MinOnTime
+		}
+		if now.Sub(thermostat.lastSwitch) < time.Duration(minTime)*time.Second {
+			// Try again later.
+			return
+		}
+	}
+	d.switchThermostat(thermostat, heating, now)
+}
+
+// switchThermostat sets the heating actuator, if needed. The lock must be
+// held.
+func (d *Device) switchThermostat(thermostat *thermostatState, heating bool, now time.Time) {
+	if thermostat.known && !thermostat.fallback && heating == thermostat.heating {
+		return
+	}
+	value := thermostat.OffValue
+	if heating {
+		value = thermostat.OnValue
+	}
+	if *flagVerbose {
+		log.Printf("Thermostat for %s: setting %s to %v", thermostat.Sensor, thermostat.Actuator, value)
+	}
+	thermostat.known = true
+	thermostat.fallback = false
+	thermostat.heating = heating
+	thermostat.lastSwitch = now
+	d.broadcastActuator(thermostat.Actuator, value, "thermostat "+thermostat.Sensor, nil)
+}
+
+// checkThermostats puts thermostats in the fallback state when their sensor
+// stops reporting, and retries switches that were delayed by the minimum
+// on/off times.
+func (d *Device) checkThermostats(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.thermostats == nil {
+		d.loadThermostats()
+	}
+	for _, thermostat := range d.thermostats {
+		if !thermostat.Enabled || thermostat.fallback {
+			continue
+		}
+		if now.Sub(thermostat.lastSample) > time.Duration(thermostat.Timeout)*time.Second {
+			log.Printf("Thermostat for %s: no values since %s, falling back", thermostat.Sensor, thermostat.lastSample.Format(time.RFC3339))
+			thermostat.fallback = true
+			thermostat.known = false
+			d.broadcastActuator(thermostat.Actuator, thermostat.FallbackValue, "thermostat "+thermostat.Sensor, nil)
+			continue
+		}
+		if !thermostat.known {
+			continue
+		}
+		sensor := GetSensor(d.dbId, thermostat.Sensor)
+		if sensor != nil {
+			d.runThermostat(thermostat, sensor.desiredValue, now)
+		}
+	}
+}
+
+// runThermostats periodically checks the thermostats of all devices.
+func runThermostats(ds *DeviceSet) {
+	for {
+		time.Sleep(THERMOSTAT_INTERVAL)
+		for _, device := range ds.allDevices() {
+			device.checkThermostats(time.Now())
+		}
+	}
+}
+
+// Thermostats returns all thermostats of this device.
+func (d *Device) Thermostats() []*Thermostat {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.thermostats == nil {
+		d.loadThermostats()
+	}
+	thermostats := make([]*Thermostat, len(d.thermostats))
+	for i, state := range d.thermostats {
+		thermostats[i] = state.Thermostat
+	}
+	return thermostats
+}
+
+// SaveThermostat adds a new thermostat (if the ID is 0) or replaces an
+// existing thermostat.
+func (d *Device) SaveThermostat(thermostat *Thermostat) error {
+	err := thermostat.validate()
+	if err != nil {
+		return err
+	}
+	err = d.CheckThermostat(thermostat)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	thermostat.Id, err = store.SaveThermostat(d.dbId, thermostat)
+	if err != nil {
+		log.Println("could not save thermostat:", err)
+		return errors.New("could not save thermostat")
+	}
+	d.loadThermostats()
+	return nil
+}
+
+// DeleteThermostat removes a thermostat.
+func (d *Device) DeleteThermostat(id int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := store.DeleteThermostat(d.dbId, id)
+	if err == errNotFound {
+		return errors.New("unknown thermostat")
+	} else if err != nil {
+		log.Println("could not delete thermostat:", err)
+		return errors.New("could not delete thermostat")
+	}
+	d.loadThermostats()
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// thermostatStep is either a new sensor value or (if check is set) a periodic
+// check, some seconds after the start, with the heater value that should be
+// sent because of it (nil for nothing).
+type thermostatStep struct {
+	seconds  int
+	check    bool
+	value    float64
+	expected interface{}
+}
+
+func runThermostatSteps(t *testing.T, desiredValue interface{}, steps []thermostatStep) {
+	d, sendChan := newTestDevice(t)
+	sensor, err := store.AddSensor(d.dbId, "temp", "temp", ValueNumber)
+	if err != nil {
+		t.Fatal("could not add sensor:", err)
+	}
+	if err := store.UpdateSensor(sensor.dbId, "", "°C", desiredValue, nil, nil, 0); err != nil {
+		t.Fatal("could not update sensor:", err)
+	}
+	sensor.desiredValue = desiredValue
+	_, err = store.SaveThermostat(d.dbId, &Thermostat{
+		Sensor:        "temp",
+		Actuator:      "heater",
+		OnValue:       "on",
+		OffValue:      "off",
+		FallbackValue: "safe",
+		Hysteresis:    1,
+		MinOnTime:     300,
+		MinOffTime:    120,
+		Timeout:       600,
+		Enabled:       true,
+	})
+	if err != nil {
+		t.Fatal("could not save thermostat:", err)
+	}
+
+	// Thermostats give the sensor time to report from the moment they are
+	// loaded, which uses the real clock.
+	start := time.Now()
+	for i, step := range steps {
+		now := start.Add(time.Duration(step.seconds) * time.Second)
+		if step.check {
+			d.checkThermostats(now)
+		} else {
+			d.updateThermostats(sensor, step.value, now)
+		}
+		if got := sentActuator(t, sendChan, "heater"); got != step.expected {
+			t.Errorf("step %d at %ds: heater set to %v, expected %v", i, step.seconds, got, step.expected)
+		}
+	}
+}
+
+func TestThermostat(t *testing.T) {
+	runThermostatSteps(t, 20.0, []thermostatStep{
+		{0, false, 20, "off"},     // the first value sets the heater
+		{10, false, 19.6, nil},    // within the hysteresis band
+		{20, false, 19.4, nil},    // too cold, but the heater was switched off too recently
+		{60, true, 0, nil},        // still too recently
+		{130, true, 0, "on"},      // the minimum off time passed
+		{140, false, 19, nil},     // stays on
+		{150, false, 20.6, nil},   // warm enough, but within the minimum on time
+		{430, false, 20.4, nil},   // within the band, so keep heating
+		{440, false, 20.6, "off"}, // the minimum on time passed
+		{450, false, 25, nil},
+		{1040, true, 0, nil},     // the last value was 590 seconds ago
+		{1060, true, 0, "safe"},  // no values for longer than the timeout
+		{1100, true, 0, nil},     // the fallback is only set once
+		{1110, false, 19, "on"},  // a new value ends the fallback, without waiting
+		{1120, false, 20.6, nil}, // but the minimum on time applies again
+		{1410, false, 20.6, "off"},
+	})
+}
+
+func TestThermostatNoDesiredValue(t *testing.T) {
+	runThermostatSteps(t, nil, []thermostatStep{
+		{0, false, 10, "off"},
+		{10, false, 5, nil},
+	})
+}
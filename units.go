@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+)
+
+const MAX_UNIT = 16 // maximum length of a unit in characters
+
+// Unit systems a client can ask for. Values are converted to units of that
+// system when domos knows how, or sent in the unit of the sensor otherwise.
+// The empty string means no conversion at all.
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+// unitConversion is a linear conversion between a metric and an imperial
+// unit: imperial = metric*scale + offset.
+type unitConversion struct {
+	metric   string
+	imperial string
+	scale    float64
+	offset   float64
+}
+
+// unitConversions lists all known conversions. When a unit appears more than
+// once, the first conversion is used to convert to that unit.
+var unitConversions = []unitConversion{
+	{"°C", "°F", 1.8, 32},
+	{"mm", "in", 1 / 25.4, 0},
+	{"cm", "in", 1 / 2.54, 0},
+	{"m", "ft", 1 / 0.3048, 0},
+	{"km", "mi", 1 / 1.609344, 0},
+	{"km/h", "mph", 1 / 1.609344, 0},
+	{"m/s", "mph", 3600 / 1609.344, 0},
+	{"hPa", "inHg", 1 / 33.8639, 0},
+	{"l", "gal", 1 / 3.785411784, 0},
+	{"kg", "lb", 1 / 0.45359237, 0},
+}
+
+// checkUnits returns an error if the unit system is not known.
+func checkUnits(units string) error {
+	switch units {
+	case "", UnitsMetric, UnitsImperial:
+		return nil
+	default:
+		return fmt.Errorf("unknown unit system: %s", units)
+	}
+}
+
+// unitConverter converts values from the unit of a sensor to the unit shown to
+// a client: client value = sensor value*scale + offset.
+type unitConverter struct {
+	unit   string
+	scale  float64
+	offset float64
+}
+
+// converterFor returns the converter from the given sensor unit to the given
+// unit system.
+func converterFor(unit, units string) unitConverter {
+	for _, c := range unitConversions {
+		if units == UnitsImperial && unit == c.metric {
+			return unitConverter{c.imperial, c.scale, c.offset}
+		}
+		if units == UnitsMetric && unit == c.imperial {
+			return unitConverter{c.metric, 1 / c.scale, -c.offset / c.scale}
+		}
+	}
+	return unitConverter{unit, 1, 0}
+}
+
+// convert converts a value for the client. Non-numeric values are returned as
+// they are.
+func (c unitConverter) convert(value interface{}) interface{} {
+	if valueFl, ok := value.(float64); ok {
+		return c.convertFloat(valueFl)
+	}
+	return value
+}
+
+func (c unitConverter) convertFloat(value float64) float64 {
+	return value*c.scale + c.offset
+}
+
+// convertDifference converts the difference between two values, like a
+// hysteresis, for the client. The offset doesn't apply to differences.
+func (c unitConverter) convertDifference(value float64) float64 {
+	return value * c.scale
+}
+
+// revertDifference converts a difference from the client back to the unit of
+// the sensor.
+func (c unitConverter) revertDifference(value float64) float64 {
+	return value / c.scale
+}
+
+// revert converts a value from the client back to the unit of the sensor.
+func (c unitConverter) revert(value interface{}) interface{} {
+	if valueFl, ok := value.(float64); ok {
+		return (valueFl - c.offset) / c.scale
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// closeTo returns whether two values are equal, apart from rounding errors.
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestConvertTemperature(t *testing.T) {
+	toImperial := converterFor("°C", UnitsImperial)
+	if toImperial.unit != "°F" {
+		t.Errorf("°C in imperial units: got unit %q, expected °F", toImperial.unit)
+	}
+	toMetric := converterFor("°F", UnitsMetric)
+	if toMetric.unit != "°C" {
+		t.Errorf("°F in metric units: got unit %q, expected °C", toMetric.unit)
+	}
+
+	tests := []struct {
+		celsius, fahrenheit float64
+	}{
+		{0, 32},
+		{100, 212},
+		{-40, -40},
+		{21.5, 70.7},
+	}
+	for _, tc := range tests {
+		if got := toImperial.convert(tc.celsius).(float64); !closeTo(got, tc.fahrenheit) {
+			t.Errorf("%v°C = %v°F, expected %v°F", tc.celsius, got, tc.fahrenheit)
+		}
+		if got := toImperial.revert(tc.fahrenheit).(float64); !closeTo(got, tc.celsius) {
+			t.Errorf("reverting %v°F gave %v°C, expected %v°C", tc.fahrenheit, got, tc.celsius)
+		}
+		if got := toMetric.convert(tc.fahrenheit).(float64); !closeTo(got, tc.celsius) {
+			t.Errorf("%v°F = %v°C, expected %v°C", tc.fahrenheit, got, tc.celsius)
+		}
+		if got := toMetric.revert(tc.celsius).(float64); !closeTo(got, tc.fahrenheit) {
+			t.Errorf("reverting %v°C gave %v°F, expected %v°F", tc.celsius, got, tc.fahrenheit)
+		}
+	}
+}
+
+func TestConvertDifference(t *testing.T) {
+	// A difference of 1°C is 1.8°F, the 32° offset doesn't apply.
+	toImperial := converterFor("°C", UnitsImperial)
+	if got := toImperial.convertDifference(1); !closeTo(got, 1.8) {
+		t.Errorf("difference of 1°C = %v°F, expected 1.8°F", got)
+	}
+	if got := toImperial.revertDifference(1.8); !closeTo(got, 1) {
+		t.Errorf("reverting difference of 1.8°F gave %v°C, expected 1°C", got)
+	}
+	toMetric := converterFor("°F", UnitsMetric)
+	if got := toMetric.convertDifference(9); !closeTo(got, 5) {
+		t.Errorf("difference of 9°F = %v°C, expected 5°C", got)
+	}
+	if got := toMetric.revertDifference(5); !closeTo(got, 9) {
+		t.Errorf("reverting difference of 5°C gave %v°F, expected 9°F", got)
+	}
+}
+
+func TestConvertOtherUnits(t *testing.T) {
+	if got := converterFor("km/h", UnitsImperial).convert(100.0).(float64); !closeTo(got, 100/1.609344) {
+		t.Errorf("100 km/h = %v mph, expected %v mph", got, 100/1.609344)
+	}
+	if got := converterFor("in", UnitsMetric); got.unit != "mm" || !closeTo(got.convert(1.0).(float64), 25.4) {
+		t.Errorf("1 in in metric units = %v %s, expected 25.4 mm", got.convert(1.0), got.unit)
+	}
+}
+
+func TestConvertPassThrough(t *testing.T) {
+	tests := []struct {
+		unit, units string
+	}{
+		{"°C", ""},          // no conversion asked
+		{"°C", UnitsMetric}, // already metric
+		{"°F", UnitsImperial},
+		{"%", UnitsImperial}, // unknown unit
+		{"lux", UnitsMetric},
+		{"", UnitsImperial}, // no unit
+	}
+	for _, tc := range tests {
+		c := converterFor(tc.unit, tc.units)
+		if c.unit != tc.unit {
+			t.Errorf("%q in %q units: got unit %q, expected it unchanged", tc.unit, tc.units, c.unit)
+		}
+		if got := c.convert(21.5); got != 21.5 {
+			t.Errorf("%q in %q units: 21.5 converted to %v", tc.unit, tc.units, got)
+		}
+		if got := c.revert(21.5); got != 21.5 {
+			t.Errorf("%q in %q units: 21.5 reverted to %v", tc.unit, tc.units, got)
+		}
+		if got := c.convertDifference(2); got != 2 {
+			t.Errorf("%q in %q units: difference of 2 converted to %v", tc.unit, tc.units, got)
+		}
+	}
+}
+
+func TestConvertNonNumeric(t *testing.T) {
+	c := converterFor("°C", UnitsImperial)
+	for _, value := range []interface{}{nil, true, "cold", map[string]interface{}{"a": 1.0}, []interface{}{1.0}} {
+		if got := c.convert(value); !reflect.DeepEqual(got, value) {
+			t.Errorf("convert(%v) = %v, expected the value unchanged", value, got)
+		}
+		if got := c.revert(value); !reflect.DeepEqual(got, value) {
+			t.Errorf("revert(%v) = %v, expected the value unchanged", value, got)
+		}
+	}
+}
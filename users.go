@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const TOKEN_CHECK_INTERVAL = 30 * time.Second // how often to check for revoked tokens of connected controls
+
+// User is a named account that can control one or more devices.
+type User struct {
+	dbId         int64
+	name         string
+	passwordHash string // bcrypt hash
+}
+
+// Token is an API token, to be used instead of a user name and password by
+// clients that need to stay logged in (like a phone or a script). Tokens can be
+// revoked individually.
+type Token struct {
+	dbId    int64
+	userId  int64
+	name    string
+	created time.Time
+	revoked time.Time // zero if still valid
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// hashToken returns the hash under which a token is stored. Tokens are long
+// random strings, so a plain (fast) hash is enough.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// newToken returns a new random token.
+func newToken() string {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// authenticateUser returns the user for the given credentials, or nil if they
+// are invalid. Either a user name and password or a token must be given.
+func authenticateUser(name, password, token string) *User {
+	if token != "" {
+		user, err := store.GetTokenUser(hashToken(token))
+		if err != nil {
+			if err != errNotFound {
+				log.Println("could not look up token:", err)
+			}
+			return nil
+		}
+		return user
+	}
+
+	if name == "" || password == "" {
+		return nil
+	}
+	user, err := store.GetUser(name)
+	if err != nil {
+		if err != errNotFound {
+			log.Printf("could not look up user '%s': %s", name, err)
+		}
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.passwordHash), []byte(password)) != nil {
+		return nil
+	}
+	return user
+}
+
+// userDevice returns the device with the given ID and the permissions the user
+// has on it, or nil if the user may not access it. The device ID may be 0 when
+// the user has access to exactly one device.
+func (ds *DeviceSet) userDevice(user *User, deviceId int64) (*Device, *Permissions) {
+	if deviceId == 0 {
+		deviceIds, err := store.GetUserDevices(user.dbId)
+		if err != nil {
+			log.Printf("could not look up devices of user '%s': %s", user.name, err)
+			return nil, nil
+		}
+		if len(deviceIds) != 1 {
+			return nil, nil
+		}
+		deviceId = deviceIds[0]
+	}
+	permissions := userPermissions(user, deviceId)
+	if permissions == nil {
+		return nil, nil
+	}
+	device := ds.deviceById(deviceId)
+	if device == nil {
+		return nil, nil
+	}
+	return device, permissions
+}
+
+// userDevices returns all loaded devices the user may access.
+func (ds *DeviceSet) userDevices(user *User) []*Device {
+	deviceIds, err := store.GetUserDevices(user.dbId)
+	if err != nil {
+		log.Printf("could not look up devices of user '%s': %s", user.name, err)
+		return nil
+	}
+	devices := make([]*Device, 0, len(deviceIds))
+	for _, id := range deviceIds {
+		if device := ds.deviceById(id); device != nil {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// runTokenCheck periodically disconnects controls that logged in with a token
+// that has been revoked since. Tokens are revoked with a subcommand, which
+// runs in another process, so the server has to poll for it.
+func runTokenCheck(ds *DeviceSet) {
+	for {
+		time.Sleep(TOKEN_CHECK_INTERVAL)
+		for _, device := range ds.allDevices() {
+			revoked := make(map[string]bool)
+			for _, tokenHash := range device.tokenHashes() {
+				_, err := store.GetTokenUser(tokenHash)
+				if err == errNotFound {
+					revoked[tokenHash] = true
+				} else if err != nil {
+					log.Println("could not check token:", err)
+				}
+			}
+			if len(revoked) != 0 {
+				device.disconnectRevoked(revoked)
+			}
+		}
+	}
+}